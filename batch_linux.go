@@ -0,0 +1,63 @@
+//go:build linux
+
+package dit
+
+import (
+	"net"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// mmsghdr is the struct mmsghdr of sendmmsg(2), the size of the message is
+// padded to the alignment of the platform like in C
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// writeBatch sends pkts on the connected socket c with as few sendmmsg calls
+// as the kernel allows
+func writeBatch(c *net.UDPConn, pkts [][]byte) (int, error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	iovs := make([]unix.Iovec, len(pkts))
+	msgs := make([]mmsghdr, len(pkts))
+	for i, p := range pkts {
+		if len(p) > 0 {
+			iovs[i].Base = &p[0]
+		}
+		iovs[i].SetLen(len(p))
+		msgs[i].hdr.Iov = &iovs[i]
+		msgs[i].hdr.SetIovlen(1)
+	}
+
+	var sent int
+	for sent < len(msgs) {
+		var errno unix.Errno
+		werr := rc.Write(func(fd uintptr) bool {
+			var n uintptr
+			n, _, errno = unix.Syscall6(unix.SYS_SENDMMSG, fd,
+				uintptr(unsafe.Pointer(&msgs[sent])), uintptr(len(msgs)-sent), 0, 0, 0)
+			if errno == unix.EAGAIN {
+				return false
+			}
+			if errno == 0 {
+				sent += int(n)
+			}
+			return true
+		})
+		runtime.KeepAlive(msgs)
+		if werr != nil {
+			return sent, werr
+		}
+		if errno != 0 {
+			return sent, &net.OpError{Op: "write", Net: "udp", Addr: c.RemoteAddr(), Err: errno}
+		}
+	}
+	return sent, nil
+}
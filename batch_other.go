@@ -0,0 +1,16 @@
+//go:build !linux
+
+package dit
+
+import "net"
+
+// writeBatch sends pkts on the connected socket c one datagram at a time,
+// there is no batched send on this platform
+func writeBatch(c *net.UDPConn, pkts [][]byte) (int, error) {
+	for i, p := range pkts {
+		if _, err := c.Write(p); err != nil {
+			return i, err
+		}
+	}
+	return len(pkts), nil
+}
@@ -0,0 +1,592 @@
+package dit
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// default size of a data block as specified in rfc1350
+	defaultBlksize = 512
+
+	// how long a client waits for a packet before retransmitting
+	defaultTimeout = time.Second
+
+	// number of times a client retransmits a packet before giving up
+	defaultRetries = 5
+)
+
+// ErrNegotiationFailed is returned by transfers terminated during option
+// negotiation, either by the server with a RequestDenied error or by the client
+// because the server acknowledged options it can not accept
+var ErrNegotiationFailed = errors.New("dit: option negotiation failed")
+
+// ErrTransferIncomplete is returned by Get when a transfer ends after some of
+// the file was recieved but before the short block that terminates it, like
+// when the server dies or aborts midway. What was written is only a part of
+// the file and can not be trusted
+var ErrTransferIncomplete = errors.New("dit: transfer incomplete")
+
+// Dial returns a client connection for transfering files with the TFTP server
+// at address. The connection is not bound to the server until the first reply
+// to a request arrives, since the server replies from a new TID (port). The
+// network is one of "udp", "udp4", "udp6" and "unixgram", whose address is the
+// path of the socket of the server
+func Dial(network, address string) (*Conn, error) {
+	return DialFrom(network, "", address)
+}
+
+// DialFrom is Dial with the local address of the client connection chosen by
+// the caller, for multi-homed hosts or firewalls that expect a fixed source
+// port. An empty localAddr lets the system pick the address and port. A
+// unixgram client needs a socket path of its own for the server to reply to,
+// an empty localAddr binds it in the temporary directory
+func DialFrom(network, localAddr, remoteAddr string) (*Conn, error) {
+	if network == "unixgram" {
+		return dialUnix(localAddr, remoteAddr)
+	}
+	if !strings.HasPrefix(network, "udp") {
+		return nil, fmt.Errorf("dit: %w: %s", ErrUnsupportedNetwork, network)
+	}
+	raddr, err := net.ResolveUDPAddr(network, remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	var laddr *net.UDPAddr
+	if localAddr != "" {
+		if laddr, err = net.ResolveUDPAddr(network, localAddr); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{c: conn, dialed: raddr, remote: raddr, done: make(chan struct{})}, nil
+}
+
+// Fetch gets filename from the TFTP server at address into w, dialing the
+// server and closing the connection when done. The transfer is abandoned with
+// the error of ctx when ctx is done before the transfer completes. It requests
+// no options, Client.Fetch makes the transfer with the settings of a Client
+func Fetch(ctx context.Context, address, filename string, w io.Writer) error {
+	return new(Client).Fetch(ctx, address, filename, w)
+}
+
+// readReply waits for the next packet from the server into buf,
+// retransmitting last each time the wait times out. The first reply of a
+// transfer binds the connection to the TID of the server, packets from any
+// other TID after that are answered with an UnknownTID error and ignored
+func (c *Conn) readReply(buf, last []byte) (Packet, error) {
+	timeout, maxRetries := c.timeout, c.retries
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	if maxRetries <= 0 {
+		maxRetries = defaultRetries
+	}
+	for retries := 0; ; {
+		if err := c.SetReadDeadline(timeout); err != nil {
+			return nil, err
+		}
+		var (
+			n    int
+			addr netip.AddrPort
+			from *net.UnixAddr
+			err  error
+		)
+		if c.u != nil {
+			n, from, err = c.u.ReadFromUnix(buf)
+		} else {
+			n, addr, err = c.ReadFrom(buf)
+		}
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) && retries < maxRetries {
+				retries++
+				// with nothing to retransmit the wait just goes on
+				if last == nil {
+					continue
+				}
+				if _, err := c.Write(last); err != nil {
+					return nil, peerGone(err)
+				}
+				continue
+			}
+			return nil, peerGone(err)
+		}
+
+		// runts too short to hold an opcode are dropped, they must not
+		// bind the transfer to their TID either
+		if n < 2 {
+			continue
+		}
+
+		// the first reply tells us the TID of the server for this transfer
+		if c.u != nil {
+			if !c.unixReply(from) {
+				continue
+			}
+		} else if !c.connected {
+			if !c.firstReply(addr) {
+				continue
+			}
+			c.connected = true
+			c.destTID = addr.Port()
+			c.remote = net.UDPAddrFromAddrPort(addr)
+		} else if !c.knownTID(addr) {
+			c.rejectTID(addr)
+			if c.StrictTID && addr.Addr() == c.remote.AddrPort().Addr() {
+				return nil, fmt.Errorf("%w: server changed its TID from %d to %d", ErrUnexpectedTID, c.destTID, addr.Port())
+			}
+			continue
+		}
+
+		return c.decode(buf[:n])
+	}
+}
+
+// firstReply reports whether a packet from addr can be the first reply to a
+// request, which binds the transfer to its TID. It has to come from the host
+// the request was sent to, and not from the TID of the previous transfer,
+// whose retransmissions could otherwise take over the new one. A server
+// answering from the port it listens on uses it for every transfer
+func (c *Conn) firstReply(addr netip.AddrPort) bool {
+	if c.AllowAnyTID {
+		return true
+	}
+	dialed := c.dialed.AddrPort()
+	if addr.Addr().Unmap() != dialed.Addr().Unmap() {
+		return false
+	}
+	return addr.Port() == dialed.Port() || addr.Port() != c.staleTID
+}
+
+// request starts a new transfer by sending a read/write request for filename
+// to the dialed server. It returns the request as sent on the wire
+func (c *Conn) request(op Opcode, filename string, options map[Option]int) ([]byte, error) {
+	// every request starts a new transfer with a new server TID
+	if c.connected {
+		c.staleTID = c.destTID
+		if c.upeer != nil {
+			c.ustale = c.upeer.Name
+		}
+	}
+	c.connected = false
+	c.remote = c.dialed
+	c.upeer = c.udialed
+	c.negotiated = nil
+	req, err := newRequest(op, filename, c.mode.String(), options)
+	if err != nil {
+		return nil, err
+	}
+	return c.WritePacket(req)
+}
+
+// checkOAck verifies an option acknowledgement from the server against the
+// options that were requested. As specified in rfc2347 the server must only
+// acknowledge requested options, and rfc2348 and rfc7440 do not allow it to
+// raise the blksize or windowsize. It returns the blksize of the transfer
+func checkOAck(requested map[Option]int, oack *OAckPacket) (int, error) {
+	blksize := defaultBlksize
+	for opt, val := range oack.Options {
+		want, ok := requested[opt]
+		if !ok {
+			return 0, fmt.Errorf("%w: server acknowledged %s which was not requested", ErrNegotiationFailed, opt)
+		}
+		switch opt {
+		case Blksize, Windowsize:
+			if val > want {
+				return 0, fmt.Errorf("%w: server %s %d is larger than the requested %d", ErrNegotiationFailed, opt, val, want)
+			}
+		}
+		if opt == Blksize {
+			blksize = val
+		}
+	}
+	return blksize, nil
+}
+
+// acceptOAck checks an option acknowledgement, terminating the transfer with a
+// RequestDenied error if the options are not acceptable
+func (c *Conn) acceptOAck(requested map[Option]int, oack *OAckPacket) (int, error) {
+	blksize, err := checkOAck(requested, oack)
+	if err != nil {
+		_ = c.WriteErr(RequestDenied, "options not acceptable")
+		return 0, err
+	}
+	c.negotiated = make(map[Option]int, len(oack.Options))
+	for opt, val := range oack.Options {
+		c.negotiated[opt] = val
+	}
+	return blksize, nil
+}
+
+// NegotiatedOptions returns the options the server acknowledged for the last
+// transfer started with Get or Put, with the values it settled on, which can be
+// lower than the ones requested. It is nil until the server acknowledges
+// options, and stays nil for a server that does not
+func (c *Conn) NegotiatedOptions() map[Option]int {
+	return c.negotiated
+}
+
+// serverErr converts an error packet from the server into an error
+func serverErr(p *ErrorPacket) error {
+	if p.ErrorCode == RequestDenied {
+		return fmt.Errorf("%w: %s", ErrNegotiationFailed, p.ErrMsg)
+	}
+	return fmt.Errorf("dit: server error %s: %s", p.ErrorCode, p.ErrMsg)
+}
+
+// Get requests filename from the server and writes its contents to w. It
+// returns the number of bytes written to w. A transfer that breaks off before
+// the last block fails with ErrTransferIncomplete
+func (c *Conn) Get(filename string, w io.Writer) (int64, error) {
+	requested := c.options
+	last, err := c.request(Rrq, filename, requested)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		written int64
+		seq     BlockSequence
+		blksize = defaultBlksize
+
+		// the first block when it arrives ahead of the option
+		// acknowledgement, see below
+		early *DataPacket
+		oack  bool
+	)
+
+	// data handles a data packet, reporting whether it ends the transfer
+	data := func(p *DataPacket) (bool, error) {
+		switch seq.Classify(p.BlockNumber) {
+		case BlockExpected:
+			m, err := w.Write(p.Data)
+			written += int64(m)
+			if err != nil {
+				_ = c.WriteErr(NotDefined, "could not write data")
+				return false, err
+			}
+			seq.Advance()
+		case BlockOutOfWindow:
+			return false, nil
+		}
+
+		// acknowledge duplicates too, our last ack might have been lost
+		if last, err = c.WritePacket(NewAck(seq.Last())); err != nil {
+			return false, peerGone(err)
+		}
+		return p.IsLast(blksize), nil
+	}
+
+	// a block larger than the default arriving before the acknowledgement
+	// must not be cut short, so the buffer fits the requested blksize
+	size := blksize
+	if requested[Blksize] > size {
+		size = requested[Blksize]
+	}
+	buf := make([]byte, size+4)
+
+	// a transfer that fails once blocks have arrived leaves a truncated file
+	// behind, which callers have to be able to tell from any other failure
+	incomplete := func(err error) error {
+		if seq.Last() == 0 {
+			return err
+		}
+		return fmt.Errorf("%w after %d bytes: %w", ErrTransferIncomplete, written, err)
+	}
+	for {
+		p, err := c.readReply(buf, last)
+		if err != nil {
+			return written, incomplete(err)
+		}
+
+		switch p := p.(type) {
+		case *OAckPacket:
+			// only the first reply to a request can be an acknowledgement
+			if seq.Last() != 0 {
+				continue
+			}
+			if blksize, err = c.acceptOAck(requested, p); err != nil {
+				return written, err
+			}
+			oack = true
+			if blksize+4 > len(buf) {
+				buf = make([]byte, blksize+4)
+			}
+			if last, err = c.WritePacket(NewAck(0)); err != nil {
+				return written, err
+			}
+			if early != nil {
+				p := early
+				early = nil
+				if done, err := data(p); done || err != nil {
+					return written, err
+				}
+			}
+		case *DataPacket:
+			// packets can be reordered on the way, a first block larger
+			// than the default can only follow an acknowledgement of a
+			// larger blksize that has not arrived yet. the block is held
+			// until it does, waiting without retransmitting the request to
+			// the server. smaller blocks are taken to come from a server
+			// that does not negotiate
+			if !oack && p.BlockNumber == 1 && seq.Last() == 0 && len(p.Data) > defaultBlksize {
+				early = &DataPacket{Opcode: Data, BlockNumber: 1, Data: append([]byte(nil), p.Data...)}
+				last = nil
+				continue
+			}
+			if done, err := data(p); done || err != nil {
+				return written, err
+			}
+		case *ErrorPacket:
+			return written, incomplete(serverErr(p))
+		default:
+			return written, fmt.Errorf("dit: unexpected %s packet", p.opcode())
+		}
+	}
+}
+
+// Put writes the contents of r to filename on the server. It returns the
+// number of bytes sent.
+//
+// Blocks are read from r straight into the buffer of the data packet that goes
+// on the wire, and that packet is kept as is until it is acknowledged so it can
+// be retransmitted. This is why a plain io.Copy can not be used, the last block
+// has to survive until the server acknowledges it. For an *os.File the reads
+// go directly to the file without an intermediate buffer, other readers are
+// buffered to avoid many small reads
+func (c *Conn) Put(filename string, r io.Reader) (int64, error) {
+	if _, ok := r.(*os.File); !ok {
+		r = bufio.NewReaderSize(r, defaultBlksize)
+	}
+
+	requested := c.options
+	last, err := c.request(Wrq, filename, requested)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		sent    int64
+		block   uint16
+		done    bool
+		blksize = defaultBlksize
+	)
+	buf := make([]byte, 512)
+	pkt := make([]byte, blksize+4)
+	for {
+		// the last block is retransmitted like the others while waiting
+		// for its ack, a sender can not wait for it forever though
+		p, err := c.readReply(buf, last)
+		if err != nil {
+			if done && errors.Is(err, os.ErrDeadlineExceeded) {
+				err = fmt.Errorf("%w: %w", ErrNoFinalAck, err)
+			}
+			return sent, err
+		}
+
+		switch p := p.(type) {
+		case *OAckPacket:
+			// an acknowledgement takes the place of the ack of block 0
+			if block != 0 {
+				continue
+			}
+			if blksize, err = c.acceptOAck(requested, p); err != nil {
+				return sent, err
+			}
+			pkt = make([]byte, blksize+4)
+		case *AckPacket:
+			// acks of earlier blocks are duplicates and can be ignored
+			if p.BlockNumber != block {
+				continue
+			}
+		case *ErrorPacket:
+			return sent, serverErr(p)
+		default:
+			return sent, fmt.Errorf("dit: unexpected %s packet", p.opcode())
+		}
+
+		if done {
+			return sent, nil
+		}
+
+		n, err := io.ReadFull(r, pkt[4:])
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			_ = c.WriteErr(NotDefined, "could not read data")
+			return sent, err
+		}
+		// the data was read in place, marshaling the packet into pkt only
+		// fills in the header in front of it
+		block++
+		data := DataPacket{Opcode: Data, BlockNumber: block, Data: pkt[4 : n+4]}
+		if last, err = data.MarshalAppend(pkt[:0]); err != nil {
+			return sent, err
+		}
+		if _, err := c.Write(last); err != nil {
+			return sent, peerGone(err)
+		}
+		sent += int64(n)
+
+		// a short block terminates the transfer once acknowledged
+		done = data.IsLast(blksize)
+	}
+}
+
+// Client makes transfers with the same settings, dialing the server for each
+// one. The zero value transfers in octet mode without requesting any options
+type Client struct {
+	// transfer mode of requests, octet for the zero value. dit does not
+	// translate the data of netascii transfers
+	Mode Mode
+
+	// options requested from the server, 0 leaves an option out. Timeout is
+	// in seconds and is also how long the client waits for a reply before
+	// retransmitting. Windowsize is only requested, transfers are still
+	// acknowledged block by block
+	Blksize, Timeout, Windowsize int
+
+	// number of retransmissions before a transfer is abandoned, 0 for the
+	// default of 5
+	Retries int
+
+	// fail transfers when the server changes its TID, see Conn.StrictTID
+	StrictTID bool
+}
+
+// Dial returns a connection to the server at address with the settings of the
+// client, for making several transfers on it or looking at what they
+// negotiated with NegotiatedOptions
+func (cl *Client) Dial(address string) (*Conn, error) {
+	conn, err := Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn.mode = cl.Mode
+	conn.retries = cl.Retries
+	conn.StrictTID = cl.StrictTID
+	conn.timeout = time.Duration(cl.Timeout) * time.Second
+	// invalid values are reported by the request of a transfer
+	for opt, val := range map[Option]int{Blksize: cl.Blksize, Timeout: cl.Timeout, Windowsize: cl.Windowsize} {
+		if val == 0 {
+			continue
+		}
+		if conn.options == nil {
+			conn.options = make(map[Option]int)
+		}
+		conn.options[opt] = val
+	}
+	return conn, nil
+}
+
+// Get requests filename from the server at address and writes its contents to
+// w. It returns the number of bytes written to w
+func (cl *Client) Get(address, filename string, w io.Writer) (int64, error) {
+	conn, err := cl.Dial(address)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	return conn.Get(filename, w)
+}
+
+// Put writes the contents of r to filename on the server at address. It
+// returns the number of bytes sent
+func (cl *Client) Put(address, filename string, r io.Reader) (int64, error) {
+	conn, err := cl.Dial(address)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	return conn.Put(filename, r)
+}
+
+// Fetch is the package Fetch with the settings of the client
+func (cl *Client) Fetch(ctx context.Context, address, filename string, w io.Writer) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	conn, err := cl.Dial(address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// closing the connection unblocks a transfer waiting on the server
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-conn.Done():
+		}
+	}()
+
+	_, err = conn.Get(filename, w)
+	if cerr := ctx.Err(); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// GetResult is the outcome of fetching a single file with GetAll
+type GetResult struct {
+	Filename string
+	Bytes    int64
+	Err      error
+}
+
+// GetAll fetches each of names from the server one after the other into
+// destDir, keeping the directory structure of the names. A failed transfer does
+// not stop the others, its error is recorded in its result and a file already
+// at its destination is left as it was
+func (c *Conn) GetAll(names []string, destDir string) []GetResult {
+	results := make([]GetResult, 0, len(names))
+	for _, name := range names {
+		res := GetResult{Filename: name}
+		res.Bytes, res.Err = c.getFile(name, destDir)
+		results = append(results, res)
+	}
+	return results
+}
+
+func (c *Conn) getFile(name, destDir string) (int64, error) {
+	// cleaning the name as an absolute path keeps it within destDir
+	path := filepath.Join(destDir, filepath.Clean("/"+filepath.FromSlash(name)))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return 0, err
+	}
+
+	// the file is fetched next to the destination and renamed over it once
+	// complete, a failed transfer leaves whatever was there before
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return 0, err
+	}
+	// temporary files are private, the fetched one gets the mode os.Create
+	// would give it under the usual umask
+	err = f.Chmod(0o644)
+	var n int64
+	if err == nil {
+		n, err = c.Get(name, f)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return n, err
+}
@@ -0,0 +1,747 @@
+package dit
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeServer answers the requests of a client packet by packet, for tests
+// that need a server to misbehave
+type fakeServer struct {
+	t    testing.TB
+	conn *net.UDPConn
+	buf  []byte
+}
+
+func listenUDP(t testing.TB, ip string) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(ip)})
+	if err != nil {
+		t.Skipf("can not listen on %s: %v", ip, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func newFakeServer(t testing.TB) *fakeServer {
+	return &fakeServer{t: t, conn: listenUDP(t, "127.0.0.1"), buf: make([]byte, 65536)}
+}
+
+// request waits for a request of the client, returning its filename and the
+// address of the client
+func (s *fakeServer) request() (string, *net.UDPAddr) {
+	s.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, addr, err := s.conn.ReadFromUDP(s.buf)
+	if err != nil {
+		s.t.Error(err)
+		return "", nil
+	}
+	p, err := Marshal(s.buf[:n])
+	if err != nil {
+		s.t.Error(err)
+		return "", nil
+	}
+	req, ok := p.(*ReadWriteRequest)
+	if !ok {
+		s.t.Errorf("got %s, want a request", Describe(p))
+		return "", nil
+	}
+	return req.Filename, addr
+}
+
+// send writes p from the TID tid to the client at addr
+func send(t testing.TB, tid *net.UDPConn, p Packet, addr *net.UDPAddr) {
+	b, err := Unmarshal(p)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := tid.WriteToUDP(b, addr); err != nil {
+		t.Error(err)
+	}
+}
+
+// block sends data as block from tid to the client at addr and waits for its
+// acknowledgement
+func block(t testing.TB, tid *net.UDPConn, block uint16, data string, addr *net.UDPAddr) {
+	p, _ := NewData(block, []byte(data))
+	send(t, tid, p, addr)
+	buf := make([]byte, 516)
+	tid.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := tid.Read(buf)
+	if err != nil {
+		t.Errorf("no ack for block %d: %v", block, err)
+		return
+	}
+	if p, _ := Marshal(buf[:n]); Describe(p) != Describe(NewAck(block)) {
+		t.Errorf("got %s, want an ack for block %d", Describe(p), block)
+	}
+}
+
+func TestGetFirstReplyFromDialedHost(t *testing.T) {
+	srv := newFakeServer(t)
+	rogue := listenUDP(t, "127.0.0.2")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, client := srv.request()
+		if client == nil {
+			return
+		}
+		// another host races the server to the first reply
+		p, _ := NewData(1, []byte("evil"))
+		send(t, rogue, p, client)
+		time.Sleep(50 * time.Millisecond)
+		block(t, listenUDP(t, "127.0.0.1"), 1, "good", client)
+	}()
+
+	conn, err := Dial("udp", srv.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var buf bytes.Buffer
+	_, err = conn.Get("file", &buf)
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "good" {
+		t.Fatalf("got %q from the transfer, want %q", buf.String(), "good")
+	}
+}
+
+func TestGetAll(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "failed"), []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := newFakeServer(t)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, client := srv.request()
+		if client == nil {
+			return
+		}
+		first := listenUDP(t, "127.0.0.1")
+		block(t, first, 1, "first", client)
+
+		// the last block of the previous transfer is sent again, its ack
+		// was lost, while the client requests the next file
+		_, client = srv.request()
+		if client == nil {
+			return
+		}
+		p, _ := NewData(1, []byte("first"))
+		send(t, first, p, client)
+		time.Sleep(50 * time.Millisecond)
+		block(t, listenUDP(t, "127.0.0.1"), 1, "second", client)
+
+		// the third transfer fails midway
+		_, client = srv.request()
+		if client == nil {
+			return
+		}
+		tid := listenUDP(t, "127.0.0.1")
+		block(t, tid, 1, string(make([]byte, 512)), client)
+		abort, _ := NewError(NotDefined, "going away")
+		send(t, tid, abort, client)
+	}()
+
+	conn, err := Dial("udp", srv.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	results := conn.GetAll([]string{"first", "sub/second", "failed"}, dir)
+	<-done
+
+	for i, want := range []string{"first", "second"} {
+		if err := results[i].Err; err != nil {
+			t.Fatalf("%s: %v", results[i].Filename, err)
+		}
+		got, err := os.ReadFile(filepath.Join(dir, results[i].Filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s: got %q, want %q", results[i].Filename, got, want)
+		}
+	}
+	if err := results[2].Err; !errors.Is(err, ErrTransferIncomplete) {
+		t.Fatalf("failed transfer returned %v, want %v", err, ErrTransferIncomplete)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "failed")); string(got) != "old" {
+		t.Fatalf("failed transfer changed the file to %q", got)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("%d entries in the destination, want first, sub and failed", len(entries))
+	}
+}
+
+func TestGetStrayPacket(t *testing.T) {
+	srv := newFakeServer(t)
+	stray := listenUDP(t, "127.0.0.1")
+	first := string(bytes.Repeat([]byte("a"), 512))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, client := srv.request()
+		if client == nil {
+			return
+		}
+		tid := listenUDP(t, "127.0.0.1")
+		block(t, tid, 1, first, client)
+
+		// a third host sends a packet into the transfer, it is told its
+		// TID is unknown and the transfer goes on
+		p, _ := NewData(2, []byte("evil"))
+		send(t, stray, p, client)
+		buf := make([]byte, 516)
+		stray.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := stray.Read(buf)
+		if err != nil {
+			t.Errorf("stray packet not answered: %v", err)
+			return
+		}
+		p2, _ := Marshal(buf[:n])
+		if e, ok := p2.(*ErrorPacket); !ok || e.ErrorCode != UnknownTID {
+			t.Errorf("stray packet answered with %s, want an unknown TID error", Describe(p2))
+		}
+		block(t, tid, 2, "good", client)
+	}()
+
+	conn, err := Dial("udp", srv.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var buf bytes.Buffer
+	_, err = conn.Get("file", &buf)
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != first+"good" {
+		t.Fatalf("got %d bytes that differ from the 516 of the server", buf.Len())
+	}
+}
+
+func TestGetBlksizeNegotiationFails(t *testing.T) {
+	larger, err := NewOAck(map[Option]int{Blksize: 2048})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deny, err := NewError(RequestDenied, "blksize not supported")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name  string
+		reply Packet // answer of the server to a request for blksize 1024
+	}{
+		{"server acknowledges a larger blksize", larger},
+		{"server denies the request", deny},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newFakeServer(t)
+			denied := make(chan bool, 1)
+			go func() {
+				_, client := srv.request()
+				if client == nil {
+					denied <- false
+					return
+				}
+				tid := listenUDP(t, "127.0.0.1")
+				send(t, tid, tt.reply, client)
+				if _, ok := tt.reply.(*OAckPacket); !ok {
+					denied <- true
+					return
+				}
+				// the client terminates the negotiation itself
+				buf := make([]byte, 516)
+				tid.SetReadDeadline(time.Now().Add(5 * time.Second))
+				n, err := tid.Read(buf)
+				if err != nil {
+					t.Errorf("no answer to the acknowledgement: %v", err)
+					denied <- false
+					return
+				}
+				p, _ := Marshal(buf[:n])
+				e, ok := p.(*ErrorPacket)
+				denied <- ok && e.ErrorCode == RequestDenied
+			}()
+
+			_, err := (&Client{Blksize: 1024}).Get(srv.conn.LocalAddr().String(), "file", io.Discard)
+			if !errors.Is(err, ErrNegotiationFailed) {
+				t.Fatalf("got %v, want %v", err, ErrNegotiationFailed)
+			}
+			if !<-denied {
+				t.Fatal("negotiation not terminated with a request denied error")
+			}
+		})
+	}
+}
+
+func TestDialFrom(t *testing.T) {
+	// a port that was free a moment ago
+	free := listenUDP(t, "127.0.0.1")
+	local := free.LocalAddr().String()
+	free.Close()
+
+	srv := newFakeServer(t)
+	conn, err := DialFrom("udp", local, srv.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var from string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, client := srv.request()
+		if client == nil {
+			return
+		}
+		from = client.String()
+		block(t, listenUDP(t, "127.0.0.1"), 1, "file", client)
+	}()
+	_, err = conn.Get("file", io.Discard)
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != local {
+		t.Fatalf("server got the request from %s, want %s", from, local)
+	}
+
+	if _, err := DialFrom("tcp", local, srv.conn.LocalAddr().String()); !errors.Is(err, ErrUnsupportedNetwork) {
+		t.Fatalf("dialing tcp failed with %v, want %v", err, ErrUnsupportedNetwork)
+	}
+}
+
+func TestGetDataBeforeOAck(t *testing.T) {
+	srv := newFakeServer(t)
+	first := string(bytes.Repeat([]byte("a"), 1024))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, client := srv.request()
+		if client == nil {
+			return
+		}
+		// the first block overtakes the option acknowledgement
+		tid := listenUDP(t, "127.0.0.1")
+		p, _ := NewData(1, []byte(first))
+		send(t, tid, p, client)
+		oack, _ := NewOAck(map[Option]int{Blksize: 1024})
+		send(t, tid, oack, client)
+
+		// the client acknowledges the options, then the held block
+		buf := make([]byte, 516)
+		for _, want := range []uint16{0, 1} {
+			tid.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, err := tid.Read(buf)
+			if err != nil {
+				t.Errorf("no ack for block %d: %v", want, err)
+				return
+			}
+			if p, _ := Marshal(buf[:n]); Describe(p) != Describe(NewAck(want)) {
+				t.Errorf("got %s, want an ack for block %d", Describe(p), want)
+				return
+			}
+		}
+		block(t, tid, 2, "end", client)
+	}()
+
+	var buf bytes.Buffer
+	_, err := (&Client{Blksize: 1024}).Get(srv.conn.LocalAddr().String(), "file", &buf)
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != first+"end" {
+		t.Fatalf("got %d bytes that differ from the 1027 of the server", buf.Len())
+	}
+}
+
+func TestNegotiatedOptions(t *testing.T) {
+	srv := newFakeServer(t)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, client := srv.request()
+		if client == nil {
+			return
+		}
+		// the server settles on a smaller blksize than requested
+		tid := listenUDP(t, "127.0.0.1")
+		oack, _ := NewOAck(map[Option]int{Blksize: 600})
+		send(t, tid, oack, client)
+		buf := make([]byte, 516)
+		tid.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := tid.Read(buf); err != nil {
+			t.Errorf("option acknowledgement not acknowledged: %v", err)
+			return
+		}
+		block(t, tid, 1, "end", client)
+	}()
+
+	conn, err := (&Client{Blksize: 1024}).Dial(srv.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if opts := conn.NegotiatedOptions(); opts != nil {
+		t.Fatalf("negotiated %v before a transfer", opts)
+	}
+	_, err = conn.Get("file", io.Discard)
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts := conn.NegotiatedOptions(); !reflect.DeepEqual(opts, map[Option]int{Blksize: 600}) {
+		t.Fatalf("negotiated %v, want the blksize of 600 the server settled on", opts)
+	}
+}
+
+func TestClientRequest(t *testing.T) {
+	cl := &Client{Blksize: 1024, Timeout: 1, Windowsize: 4, Retries: 1}
+	want := map[Option]int{Blksize: 1024, Timeout: 1, Windowsize: 4}
+	for _, tt := range []struct {
+		op       Opcode
+		transfer func(address string) error
+	}{
+		{Rrq, func(address string) error {
+			_, err := cl.Get(address, "file", io.Discard)
+			return err
+		}},
+		{Wrq, func(address string) error {
+			_, err := cl.Put(address, "file", strings.NewReader("data"))
+			return err
+		}},
+	} {
+		t.Run(tt.op.String(), func(t *testing.T) {
+			// the server never answers, the client sends its request once
+			// and again for each of its retries before giving up
+			srv := newFakeServer(t)
+			requests := make(chan *ReadWriteRequest, 10)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				defer close(requests)
+				buf := make([]byte, 516)
+				for {
+					srv.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+					n, err := srv.conn.Read(buf)
+					if err != nil {
+						return
+					}
+					p, err := Marshal(buf[:n])
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if req, ok := p.(*ReadWriteRequest); ok {
+						requests <- req
+					}
+				}
+			}()
+
+			if err := tt.transfer(srv.conn.LocalAddr().String()); err == nil {
+				t.Fatal("transfer to a silent server succeeded")
+			}
+			srv.conn.Close()
+			<-done
+			var n int
+			for req := range requests {
+				n++
+				if req.Opcode != tt.op || !reflect.DeepEqual(req.Options, want) {
+					t.Fatalf("got %s with options %v, want %s with %v", req.Opcode, req.Options, tt.op, want)
+				}
+			}
+			if n != 1+cl.Retries {
+				t.Fatalf("got %d requests, want 1 and %d retransmissions", n, cl.Retries)
+			}
+		})
+	}
+}
+
+func TestPutFinalAckLost(t *testing.T) {
+	srv := newFakeServer(t)
+	done := make(chan struct{})
+	var copies int
+	go func() {
+		defer close(done)
+		_, client := srv.request()
+		if client == nil {
+			return
+		}
+		tid := listenUDP(t, "127.0.0.1")
+		send(t, tid, NewAck(0), client)
+
+		// the ack of the only block is lost once, the client sends the
+		// block again and gets the ack of the copy
+		buf := make([]byte, 516)
+		for copies < 2 {
+			tid.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, err := tid.Read(buf)
+			if err != nil {
+				t.Errorf("last block not sent again: %v", err)
+				return
+			}
+			if p, err := Marshal(buf[:n]); err != nil || Describe(p) != "DATA block=1 len=3" {
+				t.Errorf("got %s (%v), want the last block", Describe(p), err)
+				return
+			}
+			copies++
+		}
+		send(t, tid, NewAck(1), client)
+	}()
+
+	_, err := (&Client{Timeout: 1}).Put(srv.conn.LocalAddr().String(), "file", strings.NewReader("end"))
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copies != 2 {
+		t.Fatalf("last block sent %d times, want 2", copies)
+	}
+}
+
+func TestGetIncomplete(t *testing.T) {
+	abort, _ := NewError(NotDefined, "shutting down")
+	for _, tt := range []struct {
+		name string
+		last Packet // sent after the first block, nil when the server dies
+	}{
+		{"server dies", nil},
+		{"server aborts", abort},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newFakeServer(t)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				_, client := srv.request()
+				if client == nil {
+					return
+				}
+				tid := listenUDP(t, "127.0.0.1")
+				block(t, tid, 1, string(bytes.Repeat([]byte("a"), 512)), client)
+				if tt.last != nil {
+					send(t, tid, tt.last, client)
+				}
+				tid.Close()
+			}()
+
+			var buf bytes.Buffer
+			n, err := (&Client{Timeout: 1, Retries: 1}).Get(srv.conn.LocalAddr().String(), "file", &buf)
+			<-done
+			if !errors.Is(err, ErrTransferIncomplete) {
+				t.Fatalf("got %v, want %v", err, ErrTransferIncomplete)
+			}
+			if n != 512 {
+				t.Fatalf("wrote %d bytes, want the 512 of the first block", n)
+			}
+		})
+	}
+
+	// a transfer that fails before any block arrives is not incomplete
+	srv := newFakeServer(t)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, client := srv.request()
+		if client != nil {
+			p, _ := NewError(FileNotFound, "no such file")
+			send(t, listenUDP(t, "127.0.0.1"), p, client)
+		}
+	}()
+	_, err := new(Client).Get(srv.conn.LocalAddr().String(), "file", io.Discard)
+	<-done
+	if err == nil || errors.Is(err, ErrTransferIncomplete) {
+		t.Fatalf("got %v, want a file not found error", err)
+	}
+}
+
+func TestGetStrictTID(t *testing.T) {
+	first := string(bytes.Repeat([]byte("a"), 512))
+	for _, strict := range []bool{false, true} {
+		srv := newFakeServer(t)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_, client := srv.request()
+			if client == nil {
+				return
+			}
+			tid := listenUDP(t, "127.0.0.1")
+			block(t, tid, 1, first, client)
+
+			// the next block comes from another port of the server
+			moved := listenUDP(t, "127.0.0.1")
+			p, _ := NewData(2, []byte("moved"))
+			send(t, moved, p, client)
+			buf := make([]byte, 516)
+			moved.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, err := moved.Read(buf)
+			if err != nil {
+				t.Errorf("strict %v: packet from the new TID not answered: %v", strict, err)
+				return
+			}
+			reply, _ := Marshal(buf[:n])
+			if e, ok := reply.(*ErrorPacket); !ok || e.ErrorCode != UnknownTID {
+				t.Errorf("strict %v: new TID answered with %s, want an unknown TID error", strict, Describe(reply))
+			}
+			if !strict {
+				block(t, tid, 2, "good", client)
+			}
+		}()
+
+		var buf bytes.Buffer
+		_, err := (&Client{StrictTID: strict}).Get(srv.conn.LocalAddr().String(), "file", &buf)
+		<-done
+		if strict {
+			if !errors.Is(err, ErrUnexpectedTID) {
+				t.Fatalf("strict: got %v, want %v", err, ErrUnexpectedTID)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("lenient: %v", err)
+		}
+		if buf.String() != first+"good" {
+			t.Fatalf("lenient: got %d bytes that differ from the 516 of the server", buf.Len())
+		}
+	}
+}
+
+// ackServer acknowledges every write request and data block sent to srv until
+// it is closed, replying from the port the requests are sent to
+func ackServer(srv *fakeServer) {
+	for {
+		n, addr, err := srv.conn.ReadFromUDP(srv.buf)
+		if err != nil {
+			return
+		}
+		var ack []byte
+		switch p, _ := Marshal(srv.buf[:n]); p := p.(type) {
+		case *ReadWriteRequest:
+			ack, _ = Unmarshal(NewAck(0))
+		case *DataPacket:
+			ack, _ = Unmarshal(NewAck(p.BlockNumber))
+		default:
+			continue
+		}
+		srv.conn.WriteToUDP(ack, addr)
+	}
+}
+
+// naivePut is Put reading each block into a buffer of its own and marshaling
+// a new packet from it, which is what Put avoids
+func naivePut(c *Conn, filename string, r io.Reader) (int64, error) {
+	last, err := c.request(Wrq, filename, nil)
+	if err != nil {
+		return 0, err
+	}
+	var (
+		sent  int64
+		block uint16
+		done  bool
+	)
+	buf := make([]byte, 512)
+	chunk := make([]byte, defaultBlksize)
+	for {
+		p, err := c.readReply(buf, last)
+		if err != nil {
+			return sent, err
+		}
+		if ack, ok := p.(*AckPacket); !ok || ack.BlockNumber != block {
+			continue
+		}
+		if done {
+			return sent, nil
+		}
+		n, err := io.ReadFull(r, chunk)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return sent, err
+		}
+		block++
+		d, err := NewData(block, chunk[:n])
+		if err != nil {
+			return sent, err
+		}
+		if last, err = Unmarshal(d); err != nil {
+			return sent, err
+		}
+		if _, err := c.Write(last); err != nil {
+			return sent, err
+		}
+		sent += int64(n)
+		done = n < defaultBlksize
+	}
+}
+
+func BenchmarkPut(b *testing.B) {
+	srv := newFakeServer(b)
+	go ackServer(srv)
+
+	content := make([]byte, 1<<20)
+	f, err := os.CreateTemp(b.TempDir(), "file")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(content); err != nil {
+		b.Fatal(err)
+	}
+	conn, err := Dial("udp", srv.conn.LocalAddr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, bench := range []struct {
+		name string
+		put  func() (int64, error)
+	}{
+		// reads go straight into the packet sent
+		{"file", func() (int64, error) {
+			f.Seek(0, io.SeekStart)
+			return conn.Put("file", f)
+		}},
+		// through a bufio.Reader first
+		{"reader", func() (int64, error) {
+			return conn.Put("file", struct{ io.Reader }{bytes.NewReader(content)})
+		}},
+		{"naive", func() (int64, error) {
+			f.Seek(0, io.SeekStart)
+			return naivePut(conn, "file", f)
+		}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.SetBytes(int64(len(content)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if n, err := bench.put(); err != nil || n != int64(len(content)) {
+					b.Fatalf("sent %d bytes: %v", n, err)
+				}
+			}
+		})
+	}
+}
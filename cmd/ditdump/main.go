@@ -0,0 +1,229 @@
+// ditdump decodes TFTP packets and prints them one per line. It reads a pcap
+// capture or hex encoded datagrams, one per line, from a file or stdin
+//
+//	ditdump capture.pcap
+//	echo 0001666f6f006f6374657400 | ditdump
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/Joe-Degs/dit"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [file]\n", os.Args[0])
+	}
+	flag.Parse()
+
+	in := io.Reader(os.Stdin)
+	if name := flag.Arg(0); name != "" && name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	data, err := io.ReadAll(in)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if isPcap(data) {
+		err = dumpPcap(os.Stdout, data)
+	} else {
+		err = dumpHex(os.Stdout, data)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// print a decoded packet or the reason it could not be decoded
+func dump(w io.Writer, n int, prefix string, b []byte) {
+	p, err := dit.DecodePacket(b)
+	if err != nil {
+		fmt.Fprintf(w, "#%d %serror: %v\n", n, prefix, err)
+		return
+	}
+	fmt.Fprintf(w, "#%d %s%s\n", n, prefix, dit.Describe(p))
+}
+
+// every line is a datagram in hex, spaces and colons between bytes are
+// allowed and lines starting with # are comments
+func dumpHex(w io.Writer, data []byte) error {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for n := 1; sc.Scan(); {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.NewReplacer(" ", "", ":", "", "\t", "").Replace(line)
+		b, err := hex.DecodeString(line)
+		if err != nil {
+			fmt.Fprintf(w, "#%d error: %v\n", n, err)
+		} else {
+			dump(w, n, "", b)
+		}
+		n++
+	}
+	return sc.Err()
+}
+
+// pcap file format, see https://wiki.wireshark.org/Development/LibpcapFileFormat
+const (
+	pcapMagic     = 0xa1b2c3d4
+	pcapMagicNano = 0xa1b23c4d
+
+	pcapHeaderLen = 24
+	pcapRecordLen = 16
+
+	// link types of the captured frames
+	linkEthernet = 1
+	linkRaw      = 101
+	linkSLL      = 113
+	linkSLL2     = 276
+)
+
+func pcapOrder(data []byte) binary.ByteOrder {
+	if len(data) < pcapHeaderLen {
+		return nil
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		if m := order.Uint32(data); m == pcapMagic || m == pcapMagicNano {
+			return order
+		}
+	}
+	return nil
+}
+
+func isPcap(data []byte) bool {
+	return pcapOrder(data) != nil
+}
+
+func dumpPcap(w io.Writer, data []byte) error {
+	order := pcapOrder(data)
+	link := order.Uint32(data[20:24])
+	data = data[pcapHeaderLen:]
+
+	// a capture cut off while it was written ends in a truncated record,
+	// the packets before it are still worth seeing
+	for n := 1; len(data) > 0; n++ {
+		if len(data) < pcapRecordLen {
+			fmt.Fprintf(w, "#%d error: truncated record header\n", n)
+			return nil
+		}
+		incl := int(order.Uint32(data[8:12]))
+		data = data[pcapRecordLen:]
+		if incl > len(data) {
+			fmt.Fprintf(w, "#%d error: truncated data, %d of %d bytes\n", n, len(data), incl)
+			return nil
+		}
+		frame := data[:incl]
+		data = data[incl:]
+
+		src, dst, payload, err := udpPayload(link, frame)
+		if err != nil {
+			fmt.Fprintf(w, "#%d error: %v\n", n, err)
+			continue
+		}
+		dump(w, n, fmt.Sprintf("%s > %s ", src, dst), payload)
+	}
+	return nil
+}
+
+var errNotUDP = errors.New("not a udp datagram")
+
+// udpPayload extracts the addresses and payload of the UDP datagram in frame
+func udpPayload(link uint32, frame []byte) (src, dst netip.AddrPort, payload []byte, err error) {
+	var proto uint16
+	switch link {
+	case linkEthernet:
+		if len(frame) < 14 {
+			return src, dst, nil, errors.New("truncated ethernet header")
+		}
+		proto, frame = binary.BigEndian.Uint16(frame[12:14]), frame[14:]
+		// skip a vlan tag
+		if proto == 0x8100 && len(frame) >= 4 {
+			proto, frame = binary.BigEndian.Uint16(frame[2:4]), frame[4:]
+		}
+	case linkSLL:
+		if len(frame) < 16 {
+			return src, dst, nil, errors.New("truncated sll header")
+		}
+		proto, frame = binary.BigEndian.Uint16(frame[14:16]), frame[16:]
+	case linkSLL2:
+		if len(frame) < 20 {
+			return src, dst, nil, errors.New("truncated sll2 header")
+		}
+		proto, frame = binary.BigEndian.Uint16(frame[0:2]), frame[20:]
+	case linkRaw:
+		if len(frame) < 1 {
+			return src, dst, nil, errors.New("empty frame")
+		}
+		switch frame[0] >> 4 {
+		case 4:
+			proto = 0x0800
+		case 6:
+			proto = 0x86dd
+		}
+	default:
+		return src, dst, nil, fmt.Errorf("unsupported link type %d", link)
+	}
+
+	var srcIP, dstIP netip.Addr
+	switch proto {
+	case 0x0800:
+		if len(frame) < 20 {
+			return src, dst, nil, errors.New("truncated ipv4 header")
+		}
+		ihl := int(frame[0]&0x0f) * 4
+		if frame[9] != 17 {
+			return src, dst, nil, errNotUDP
+		}
+		if ihl < 20 || len(frame) < ihl {
+			return src, dst, nil, errors.New("truncated ipv4 header")
+		}
+		srcIP, _ = netip.AddrFromSlice(frame[12:16])
+		dstIP, _ = netip.AddrFromSlice(frame[16:20])
+		frame = frame[ihl:]
+	case 0x86dd:
+		if len(frame) < 40 {
+			return src, dst, nil, errors.New("truncated ipv6 header")
+		}
+		if frame[6] != 17 {
+			return src, dst, nil, errNotUDP
+		}
+		srcIP, _ = netip.AddrFromSlice(frame[8:24])
+		dstIP, _ = netip.AddrFromSlice(frame[24:40])
+		frame = frame[40:]
+	default:
+		return src, dst, nil, fmt.Errorf("unsupported ethertype %#04x", proto)
+	}
+
+	if len(frame) < 8 {
+		return src, dst, nil, errors.New("truncated udp header")
+	}
+	src = netip.AddrPortFrom(srcIP, binary.BigEndian.Uint16(frame[0:2]))
+	dst = netip.AddrPortFrom(dstIP, binary.BigEndian.Uint16(frame[2:4]))
+	payload = frame[8:]
+	if l := int(binary.BigEndian.Uint16(frame[4:6])) - 8; l >= 0 && l < len(payload) {
+		payload = payload[:l]
+	}
+	return src, dst, payload, nil
+}
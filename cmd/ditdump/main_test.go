@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// pcapRecord returns a pcap record of a raw ipv4 frame carrying payload in a
+// udp datagram from 10.0.0.1:2000 to 10.0.0.2:69
+func pcapRecord(payload []byte) []byte {
+	frame := make([]byte, 28, 28+len(payload))
+	frame[0] = 0x45 // ipv4 with a header of 20 bytes
+	frame[9] = 17   // udp
+	copy(frame[12:16], []byte{10, 0, 0, 1})
+	copy(frame[16:20], []byte{10, 0, 0, 2})
+	binary.BigEndian.PutUint16(frame[20:22], 2000)
+	binary.BigEndian.PutUint16(frame[22:24], 69)
+	binary.BigEndian.PutUint16(frame[24:26], uint16(8+len(payload)))
+	frame = append(frame, payload...)
+
+	rec := make([]byte, pcapRecordLen, pcapRecordLen+len(frame))
+	binary.LittleEndian.PutUint32(rec[8:12], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(rec[12:16], uint32(len(frame)))
+	return append(rec, frame...)
+}
+
+func TestDumpPcapTruncated(t *testing.T) {
+	header := make([]byte, pcapHeaderLen)
+	binary.LittleEndian.PutUint32(header[0:4], pcapMagic)
+	binary.LittleEndian.PutUint32(header[20:24], linkRaw)
+	ack := pcapRecord([]byte{0, 4, 0, 1})
+	capture := bytes.Join([][]byte{header, ack}, nil)
+
+	for _, tt := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"complete", capture, "#1 10.0.0.1:2000 > 10.0.0.2:69 ACK block=1\n"},
+		{"record header cut off", bytes.Join([][]byte{capture, ack[:10]}, nil),
+			"#1 10.0.0.1:2000 > 10.0.0.2:69 ACK block=1\n#2 error: truncated record header\n"},
+		{"data cut off", bytes.Join([][]byte{capture, ack[:len(ack)-2]}, nil),
+			"#1 10.0.0.1:2000 > 10.0.0.2:69 ACK block=1\n#2 error: truncated data, 30 of 32 bytes\n"},
+	} {
+		var out bytes.Buffer
+		if err := dumpPcap(&out, tt.data); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if out.String() != tt.want {
+			t.Errorf("%s: got\n%swant\n%s", tt.name, out.String(), tt.want)
+		}
+	}
+}
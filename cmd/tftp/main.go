@@ -0,0 +1,102 @@
+// tftp is a client to get and put files on a TFTP server
+//
+//	tftp get host[:port] remote [local]
+//	tftp put host[:port] local [remote]
+//
+// A local name of "-" gets to stdout or puts from stdin. Everything other than
+// the file data is written to stderr, so a download to stdout can be piped
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/Joe-Degs/dit"
+)
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "usage:\n\t%[1]s get host[:port] remote [local]\n\t%[1]s put host[:port] local [remote]\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("tftp: ")
+	log.SetOutput(os.Stderr)
+
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 3 || len(args) > 4 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, address, name := args[0], args[1], args[2]
+	other := filepath.Base(name)
+	if len(args) == 4 {
+		other = args[3]
+	}
+
+	// the tftp port is the default when address has no port
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "69")
+	}
+
+	conn, err := dit.Dial("udp", address)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	var n int64
+	switch cmd {
+	case "get":
+		n, err = get(conn, name, other, os.Stdout)
+	case "put":
+		n, err = put(conn, name, other, os.Stdin)
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("%s %s: %d bytes", cmd, name, n)
+}
+
+// get remote from the server into local, or stdout if local is "-"
+func get(conn *dit.Conn, remote, local string, stdout io.Writer) (int64, error) {
+	w := stdout
+	if local != "-" {
+		f, err := os.Create(local)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		w = f
+	}
+	return conn.Get(remote, w)
+}
+
+// put local, or stdin if local is "-", on the server as remote
+func put(conn *dit.Conn, local, remote string, stdin io.Reader) (int64, error) {
+	r := stdin
+	if local != "-" {
+		f, err := os.Open(local)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		r = f
+	}
+	if remote == "-" {
+		return 0, fmt.Errorf("a remote name is required when putting from stdin")
+	}
+	return conn.Put(remote, r)
+}
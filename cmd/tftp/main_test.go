@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Joe-Degs/dit"
+	"github.com/Joe-Degs/dit/dittest"
+)
+
+func TestStdio(t *testing.T) {
+	dir := t.TempDir()
+	addr, cleanup := dittest.NewTestServer(t, dir)
+	defer cleanup()
+	want := make([]byte, 1500)
+	rand.New(rand.NewSource(1)).Read(want)
+	if err := os.WriteFile(filepath.Join(dir, "file"), want, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := dit.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// a local name of - gets to stdout
+	var stdout bytes.Buffer
+	if n, err := get(conn, "file", "-", &stdout); err != nil || n != int64(len(want)) {
+		t.Fatalf("get to stdout: %d bytes, %v", n, err)
+	}
+	if !bytes.Equal(stdout.Bytes(), want) {
+		t.Fatalf("got %d bytes on stdout that differ from the %d of the file", stdout.Len(), len(want))
+	}
+
+	// and puts from stdin
+	if n, err := put(conn, "-", "copy", bytes.NewReader(want)); err != nil || n != int64(len(want)) {
+		t.Fatalf("put from stdin: %d bytes, %v", n, err)
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "copy")); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("file put from stdin differs: %v", err)
+	}
+	if _, err := put(conn, "-", "-", bytes.NewReader(want)); err == nil {
+		t.Fatal("put from stdin without a remote name succeeded")
+	}
+}
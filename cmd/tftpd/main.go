@@ -69,11 +69,11 @@ func doProfile(typ string) func() {
 			log.Fatal(err)
 		}
 		pprofer(f)
+		log.Printf("%s profiler started", typ)
 		return func() {
 			stop()
 			f.Close()
 		}
-		log.Printf("%s profiler started", typ)
 	}
 	return stop
 }
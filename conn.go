@@ -9,7 +9,11 @@ import (
 	"math/rand"
 	"net"
 	"net/netip"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -22,6 +26,61 @@ var (
 	// on a client connection. Only listening connections (opened with the
 	// Listen function) are allowed to wait and accept new client connections.
 	ErrClientAccept = errors.New("client cannot accept new connections")
+
+	// ErrListenerWrite is returned if the Write method is called on a
+	// listening connection. A listener has no peer to write to, replies to
+	// requests go out through the connections returned by Accept.
+	ErrListenerWrite = errors.New("listener cannot write without a peer")
+
+	// ErrMalformedPacket is returned by ReadPacket if the datagram it read
+	// could not be decoded into a packet.
+	ErrMalformedPacket = errors.New("malformed packet")
+
+	// ErrUnsupportedNetwork is returned when dialing or listening on a
+	// network other than udp, the transport of the protocol, and unixgram,
+	// unix datagram sockets for local use, or when a feature of the
+	// connection is not supported on its network
+	ErrUnsupportedNetwork = errors.New("protocol runs only over udp and unixgram")
+
+	// ErrNoFinalAck is returned by a sender that gave up waiting for the
+	// acknowledgement of the last block. Every block was sent, but whether
+	// the peer recieved the last one is not known, its ack may have been
+	// lost
+	ErrNoFinalAck = errors.New("last block not acknowledged")
+
+	// ErrPeerGone is returned when the system reports that the peer of a
+	// transfer can no longer be reached, usually because it closed its
+	// socket. There is no point in retransmitting to it
+	ErrPeerGone = errors.New("peer went away")
+)
+
+// IsPeerGone reports whether err of a read or write on a connection means the
+// peer of the transfer is gone. The ICMP port unreachable of an earlier packet
+// is reported by the system as a refused connection, or as a reset one on
+// windows, and a firewall rejecting the packets on the way out as EPERM
+func IsPeerGone(err error) bool {
+	return errors.Is(err, ErrPeerGone) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EHOSTUNREACH) ||
+		errors.Is(err, syscall.EPERM)
+}
+
+// peerGone wraps err in ErrPeerGone if it means the peer is gone, so transfers
+// end with the same error however the system reported it
+func peerGone(err error) error {
+	if !IsPeerGone(err) || errors.Is(err, ErrPeerGone) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ErrPeerGone, err)
+}
+
+// Direction is the direction in which a traced packet crossed the wire
+type Direction uint8
+
+const (
+	Send Direction = iota // packet written to the connection
+	Recv                  // packet read from the connection
 )
 
 // Conn is a tftp connection and providing functionality to send, recieve and
@@ -39,36 +98,156 @@ type Conn struct {
 	// This holds the address that a client is actively connected to.
 	destTID uint16
 
+	// TID of the server for the previous transfer of a dialed client, late
+	// packets from it must not be taken for the first reply of the next one
+	staleTID uint16
+
+	// For a dialed client, dialed is the address of the server requests are
+	// sent to and remote the address of the server TID of the current transfer
+	dialed, remote *net.UDPAddr
+
+	// a connection over a unixgram socket has it in u instead of c, see
+	// unixgram.go. the TID of a peer is the path of its socket, upeer is
+	// the one of the current transfer and udialed and ustale are the
+	// counterparts of dialed and staleTID
+	u              *net.UnixConn
+	udialed, upeer *net.UnixAddr
+	ustale         string
+
 	// True if the Conn is a client actively reading/writing to another
 	// client. False if Conn is a server and only listening for new connections
 	connected bool
 	req       *ReadWriteRequest
+
+	// closed when the connection is closed
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// called with every packet written/read with WritePacket/ReadPacket
+	trace func(Direction, Packet)
+
+	// picks the port of the next connection accepted with a port range,
+	// randomPort if nil. tests set it to make the ports predictable
+	nextPort func(lo, hi uint16) uint16
+
+	// reply sockets bound ahead of time for Accept to hand out, by the
+	// address they are bound to. prewarm is the number of them kept for
+	// each address
+	socksMu sync.Mutex
+	socks   map[netip.Addr]chan *net.UDPConn
+	prewarm int
+
+	// kernel buffer sizes of the reply sockets created by Accept, 0 leaves
+	// the system default
+	rbuf, wbuf int
+
+	// datagram and control message buffers of AcceptRange
+	abuf, aoob []byte
+
+	// settings of the transfers of a client, the zero values use the
+	// defaults
+	mode    Mode
+	options map[Option]int
+	timeout time.Duration
+	retries int
+
+	// options the server acknowledged for the current transfer
+	negotiated map[Option]int
+
+	// AllowAnyTID turns off the check that packets of a transfer come from
+	// the TID (port) of the peer, for debugging relays and middleboxes that
+	// rewrite ports. Replies still go to the TID of the first packet.
+	//
+	// The check is what stops other hosts from injecting packets into a
+	// transfer, with it turned off any host that can reach the connection
+	// can feed it data. Never set it on connections exposed to untrusted
+	// networks
+	AllowAnyTID bool
+
+	// StrictTID makes a dialed client fail a transfer when a packet arrives
+	// from the host of the server but from a port other than the TID the
+	// transfer started with. A correct server never changes its TID, one
+	// that does is broken or the packet is spoofed. By default the packet
+	// is answered with an UnknownTID error and the transfer goes on, which
+	// copes with odd servers
+	StrictTID bool
+
+	// routes the datagrams of transfers in progress to their connections
+	// on a listener in single port mode
+	peers *demux
+
+	// a connection accepted in single port mode shares the socket of its
+	// listener and recieves the datagrams of its peer on inbox. its read
+	// deadline is kept here, the one of the socket belongs to the listener
+	shared   *demux
+	inbox    chan []byte
+	deadline atomic.Int64
+	wake     chan struct{}
 }
 
 // Write writes atmost len(b) bytes from b into the connection. If the
 // connection is actively sending/reading files from/to another client it writes
-// to that specific host instead. Otherwise it's behaviour is specified by the
-// net.Conn's Write method.
+// to that specific host. A dialed client that is yet to hear from the server
+// writes to the address it dialed. Listening connections have no peer and
+// return ErrListenerWrite.
 func (c *Conn) Write(b []byte) (int, error) {
-	return c.c.Write(b)
+	switch {
+	case c.upeer != nil:
+		return c.u.WriteToUnix(b, c.upeer)
+	case c.u != nil:
+		return 0, ErrListenerWrite
+	case c.c.RemoteAddr() != nil:
+		// connections created by Accept are bound to their peer
+		return c.c.Write(b)
+	case c.remote != nil:
+		return c.c.WriteToUDP(b, c.remote)
+	}
+	return 0, ErrListenerWrite
 }
 
+// WriteBatch writes each of pkts to the peer of the connection as a datagram
+// of its own, like calling Write with each in turn, for sending a window of
+// data packets at once. On linux connections returned by Accept send them in
+// as few system calls as possible. It returns the number of packets written
+func (c *Conn) WriteBatch(pkts [][]byte) (int, error) {
+	if c.u == nil && c.c.RemoteAddr() != nil {
+		return writeBatch(c.c, pkts)
+	}
+	// the others need the address of the peer in every datagram
+	for i, p := range pkts {
+		if _, err := c.Write(p); err != nil {
+			return i, err
+		}
+	}
+	return len(pkts), nil
+}
+
+// WriteTo writes b to addr, whoever the peer of the connection is. It is not
+// supported on unixgram connections
 func (c *Conn) WriteTo(b []byte, addr *net.UDPAddr) (int, error) {
+	if c.u != nil {
+		return 0, fmt.Errorf("dit: %w: WriteTo on unixgram", ErrUnsupportedNetwork)
+	}
 	return c.c.WriteToUDP(b, addr)
 }
 
 // Read tries to read len(b) bytes from the connection to b. If the connection
 // is actively sending/reading files from/to another client, read only accepts
 // reads from that host. It throws ErrUnexpectedTID if it gets data from a host
-// other than the one it is actively connected to. Otherwise its behaviour
+// other than the one it is actively connected to, after sending that host an
+// UnknownTID error packet, unless AllowAnyTID is set. Otherwise its behaviour
 // conforms to that of net.Conn's Read method
 func (c *Conn) Read(b []byte) (int, error) {
+	if c.u != nil {
+		return c.readUnix(b, true)
+	}
 
 	// if this is an active connection, but the write
 	// is from a different TID return unexpected TID error
 	if c.connected {
 		n, addr, err := c.ReadFrom(b)
-		if err == nil && addr.Port() != c.destTID {
+		if err == nil && !c.knownTID(addr) {
+			c.rejectTID(addr)
 			return n, ErrUnexpectedTID
 		}
 		return n, err
@@ -77,30 +256,213 @@ func (c *Conn) Read(b []byte) (int, error) {
 	return c.c.Read(b)
 }
 
+// SetTrace sets a function to be called with every packet that crosses the wire
+// through WritePacket and ReadPacket, which makes it possible to capture the
+// full exchange of a transfer. Connections returned by Accept inherit the trace
+// function of the listener. A nil fn disables tracing
+func (c *Conn) SetTrace(fn func(dir Direction, p Packet)) {
+	c.trace = fn
+}
+
+// WritePacket marshals p and writes it to the connection. It returns the bytes
+// written for callers that keep them for retransmission
+func (c *Conn) WritePacket(p Packet) ([]byte, error) {
+	return c.WritePacketBuf(p, nil)
+}
+
+// WritePacketBuf is like WritePacket but marshals p into buf, growing it if it
+// is too small, so transfer loops can send every packet from the same slice
+func (c *Conn) WritePacketBuf(p Packet, buf []byte) ([]byte, error) {
+	if p == nil {
+		return nil, ErrNilPacket
+	}
+	b, err := p.MarshalAppend(buf[:0])
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.Write(b); err != nil {
+		return nil, err
+	}
+	if c.trace != nil {
+		c.trace(Send, p)
+	}
+	return b, nil
+}
+
+// ReadPacket reads a datagram from the connection into b and decodes it. The
+// read behaves like ReadPeer, and ErrMalformedPacket is returned if the
+// datagram is not a valid packet. Runts too short to hold an opcode are dropped
+// without a word
+func (c *Conn) ReadPacket(b []byte) (Packet, error) {
+	for {
+		n, err := c.ReadPeer(b)
+		if err != nil {
+			return nil, err
+		}
+		if n < 2 {
+			continue
+		}
+		return c.decode(b[:n])
+	}
+}
+
+// decode unmarshals a packet recieved from the connection
+func (c *Conn) decode(b []byte) (Packet, error) {
+	p, err := Marshal(b)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedPacket, err)
+	}
+	if c.trace != nil {
+		c.trace(Recv, p)
+	}
+	return p, nil
+}
+
+// ReadPeer is Read with the RFC1350 handling of stray datagrams. If the
+// connection is actively sending/reading files from/to another client,
+// packets from any other host are answered with an UnknownTID error and
+// dropped instead of returning ErrUnexpectedTID, and it returns only once a packet from the connected host
+// arrives or the read deadline passes. Otherwise it behaves like Read
+func (c *Conn) ReadPeer(b []byte) (int, error) {
+	if c.u != nil {
+		return c.readUnix(b, false)
+	}
+	if !c.connected {
+		return c.c.Read(b)
+	}
+	for {
+		n, addr, err := c.ReadFrom(b)
+		if err != nil || c.knownTID(addr) {
+			return n, err
+		}
+		c.rejectTID(addr)
+	}
+}
+
+// knownTID reports whether a packet from addr belongs to the transfer in
+// progress
+func (c *Conn) knownTID(addr netip.AddrPort) bool {
+	if c.AllowAnyTID {
+		return true
+	}
+	// a socket connected to its peer only recieves the packets of the
+	// peer's host. the others, prewarmed sockets and dialed clients, can
+	// recieve from any host and check it along with the port
+	if c.remote != nil {
+		peer := c.remote.AddrPort()
+		return addr.Port() == peer.Port() && addr.Addr().Unmap() == peer.Addr().Unmap()
+	}
+	return addr.Port() == c.destTID
+}
+
+// rejectTID tells a host that sent a packet to a connection actively
+// transfering with another host that its TID is unknown. As specified in
+// RFC1350 this does not disturb the transfer in progress
+func (c *Conn) rejectTID(addr netip.AddrPort) {
+	_ = c.writeErrTo(UnknownTID, "unknown transfer id", net.UDPAddrFromAddrPort(addr))
+}
+
 // ReadFrom waits and reads atmost len(b) bytes into b, returning the
-// number of bytes written and the address of the sender or an error
+// number of bytes written and the address of the sender or an error. The
+// senders on unixgram connections have paths for addresses, the address
+// returned is zero
 func (c *Conn) ReadFrom(b []byte) (int, netip.AddrPort, error) {
+	if c.u != nil {
+		n, err := c.u.Read(b)
+		return n, netip.AddrPort{}, err
+	}
+	if c.shared != nil {
+		return c.readInbox(b)
+	}
 	return c.c.ReadFromUDPAddrPort(b)
 }
 
 // SetReadDeadline sets a deadline on reads from the TFTP server.
 func (c *Conn) SetReadDeadline(n time.Duration) error {
-	return c.c.SetReadDeadline(time.Now().Add(n))
+	if c.shared != nil {
+		c.setInboxDeadline(time.Now().Add(n))
+		return nil
+	}
+	return c.socket().SetReadDeadline(time.Now().Add(n))
 }
 
 // SetWriteDeadline sets a deadline on writes to the TFTP server.
 func (c *Conn) SetWriteDeadline(n time.Duration) error {
-	return c.c.SetWriteDeadline(time.Now().Add(n))
+	// the socket is shared with the listener and every other transfer
+	if c.shared != nil {
+		return nil
+	}
+	return c.socket().SetWriteDeadline(time.Now().Add(n))
 }
 
 // Close the connection and resource associated with it.
 func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		// sockets bound after this see the connection is done, see
+		// bindSocket
+		c.socksMu.Lock()
+		for _, socks := range c.socks {
+			for len(socks) > 0 {
+				(<-socks).Close()
+			}
+		}
+		c.socksMu.Unlock()
+	})
+	if c.shared != nil {
+		c.shared.remove(c)
+		return nil
+	}
+	if c.u != nil {
+		return closeUnix(c.u)
+	}
 	return c.c.Close()
 }
 
+// Release closes a connection returned by Accept and recycles its request for
+// the requests accepted after it. Neither the request nor the connection may
+// be used once it is released, Request returns nil
+func (c *Conn) Release() error {
+	err := c.Close()
+	if c.req != nil {
+		putRequest(c.req)
+		c.req = nil
+	}
+	return err
+}
+
+// Done returns a channel that is closed when the connection is closed. It lets
+// goroutines waiting on the connection tell a shutdown from a failure
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
 // Addr returns the address of the underlying connection
 func (c *Conn) Addr() net.Addr {
-	return c.c.LocalAddr()
+	return c.socket().LocalAddr()
+}
+
+// socket returns the socket of the connection, whichever network it is on
+func (c *Conn) socket() net.PacketConn {
+	if c.u != nil {
+		return c.u
+	}
+	return c.c
+}
+
+// Peer returns the address of the host the connection is transfering with. It
+// is zero on unixgram connections, whose peers have paths for addresses
+func (c *Conn) Peer() netip.AddrPort {
+	if c.u != nil {
+		return netip.AddrPort{}
+	}
+	if c.remote != nil {
+		return c.remote.AddrPort()
+	}
+	if addr, ok := c.c.RemoteAddr().(*net.UDPAddr); ok {
+		return addr.AddrPort()
+	}
+	return netip.AddrPort{}
 }
 
 func (c *Conn) Request() *ReadWriteRequest { return c.req }
@@ -113,98 +475,318 @@ func (c *Conn) AcceptRange(lo, hi uint16) (*Conn, error) {
 		return nil, ErrClientAccept
 	}
 
-	var err error
-
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	// TODO(Joe-Degs): this seems like a bad way to do this. go see the
-	// go package see how they allocate memory for accept
-	buf := make([]byte, 256)
+	if c.u != nil {
+		return c.acceptUnix(lo, hi)
+	}
+
+	// the buffers are reused by every accept, which is safe since the
+	// mutex allows only one accept at a time and decoding the request
+	// copies everything out of them. control messages carry the address
+	// requests were sent to, so that a listener bound to all interfaces
+	// replies from that same address
+	if c.abuf == nil {
+		c.abuf = make([]byte, maxRequestLen)
+		c.aoob = make([]byte, 128)
+	}
+	buf, oob := c.abuf, c.aoob
 	for {
-		n, raddr, err := c.c.ReadFromUDP(buf)
+		n, oobn, _, raddr, err := c.c.ReadMsgUDP(buf, oob)
 		if err != nil {
 			return nil, fmt.Errorf("accept: %w", err)
 		}
 
+		// in single port mode the datagrams of transfers in progress
+		// come in here too, requests from their peers included
+		if c.peers != nil && c.peers.route(raddr.AddrPort(), buf[:n]) {
+			continue
+		}
+
+		// a runt without even an opcode is not worth an answer
+		if n < 2 {
+			continue
+		}
+
 		if op := opcode(buf[:n]); op != Rrq && op != Wrq {
 			_ = c.writeErrTo(IllegalOperation, "cannot perform operation", raddr)
 			continue
 		}
 
-		req, err := Marshal(buf[:n])
+		req, err := decodeRequest(buf[:n])
 		if err != nil {
 			_ = c.writeErrTo(NotDefined, "could not decode packet", raddr)
 			continue
 		}
 
-		conn, err := connectWithRange(lo, hi, raddr)
+		if c.peers != nil {
+			return c.peers.accept(c, raddr, req), nil
+		}
+
+		// prewarmed sockets are not connected to the client, the
+		// connection writes to and reads from it by address instead
+		dst := dstIP(oob[:oobn])
+		if lo == 0 && hi == 0 && c.socks != nil {
+			if sock := c.prewarmed(dst); sock != nil {
+				return &Conn{
+					c:         sock,
+					destTID:   raddr.AddrPort().Port(),
+					connected: true,
+					req:       req,
+					done:      make(chan struct{}),
+					trace:     c.trace,
+					remote:    raddr,
+				}, nil
+			}
+		}
+
+		conn, err := connectWithRange(lo, hi, c.nextPort, dst, raddr)
+		if err == nil {
+			if err = setBuffers(conn, c.rbuf, c.wbuf); err != nil {
+				conn.Close()
+			}
+		}
 		if err != nil {
-			err = c.writeErrTo(NotDefined, "could not connect", raddr)
-			return nil, err
+			_ = c.writeErrTo(NotDefined, "could not connect", raddr)
+			return nil, fmt.Errorf("accept: %w", err)
 		}
 
 		return &Conn{
 			c:         conn,
 			destTID:   raddr.AddrPort().Port(),
 			connected: true,
-			req:       req.(*ReadWriteRequest),
+			req:       req,
+			done:      make(chan struct{}),
+			trace:     c.trace,
 		}, nil
 	}
-	return nil, err
+}
+
+// WriteAck acknowledges block to the peer of the connection
+func (c *Conn) WriteAck(block uint16) error {
+	_, err := c.WritePacket(NewAck(block))
+	return err
 }
 
 func (c *Conn) WriteErr(code ErrorCode, msg string) error {
-	b, err := encode(Error, code, msg)
+	p, err := NewError(code, msg)
 	if err != nil {
 		return err
 	}
-	if _, err := c.Write(b); err != nil {
+	_, err = c.WritePacket(p)
+	return err
+}
+
+// Abort ends the transfer of the connection, sending the peer an error packet
+// with code and msg before closing it. The connection is closed even if the
+// error could not be sent, the first error is returned
+func (c *Conn) Abort(code ErrorCode, msg string) error {
+	err := c.WriteErr(code, msg)
+	if cerr := c.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (c *Conn) writeErrTo(code ErrorCode, msg string, addr net.Addr) error {
+	p, err := NewError(code, msg)
+	if err != nil {
 		return err
 	}
+	b, err := p.marshal()
+	if err != nil {
+		return err
+	}
+	if _, err := c.socket().WriteTo(b, addr); err != nil {
+		return err
+	}
+	return nil
+}
+
+// SetBuffers sets the size of the kernel receive and send buffers of the
+// connection, and of the sockets Accept creates for the connections it returns.
+// A size of 0 leaves the system default. Larger buffers keep a busy server from
+// dropping packets that arrive in bursts, the system may cap the sizes though.
+//
+// This function is only supposed to be called on listening Conn's before
+// they start accepting
+func (c *Conn) SetBuffers(read, write int) error {
+	c.rbuf, c.wbuf = read, write
+	if c.u != nil {
+		return setBuffers(c.u, read, write)
+	}
+	return setBuffers(c.c, read, write)
+}
+
+func setBuffers(conn interface {
+	SetReadBuffer(int) error
+	SetWriteBuffer(int) error
+}, read, write int) error {
+	if read > 0 {
+		if err := conn.SetReadBuffer(read); err != nil {
+			return err
+		}
+	}
+	if write > 0 {
+		if err := conn.SetWriteBuffer(write); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (c *Conn) writeErrTo(code ErrorCode, msg string, addr *net.UDPAddr) error {
-	b, err := encode(Error, code, msg)
+// PrewarmSockets binds n reply sockets ahead of time for Accept to hand out to
+// the connections it creates, saving the setup of a socket on the accept path
+// when requests come in bursts. A new socket is bound in the background for
+// each one handed out. Replies have to come from the address the request was
+// sent to, so the sockets are bound to it. A listener bound to all interfaces
+// binds them for an address when the first request to it arrives, that request
+// and the ones before the sockets are ready get sockets of their own. The
+// prewarmed sockets are not used by AcceptRange with a port range. They are not
+// supported on unixgram listeners.
+//
+// This function is only supposed to be called on listening Conn's before
+// they start accepting
+func (c *Conn) PrewarmSockets(n int) error {
+	if c.connected {
+		return ErrClientAccept
+	}
+	if c.u != nil {
+		return fmt.Errorf("dit: %w: prewarmed sockets on unixgram", ErrUnsupportedNetwork)
+	}
+	c.prewarm = n
+	c.socks = make(map[netip.Addr]chan *net.UDPConn)
+	laddr := c.c.LocalAddr().(*net.UDPAddr)
+	if laddr.IP.IsUnspecified() {
+		return nil
+	}
+	addr := laddr.AddrPort().Addr().Unmap()
+	socks := make(chan *net.UDPConn, n)
+	c.socks[addr] = socks
+	for i := 0; i < n; i++ {
+		if err := c.bindSocket(addr, socks); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prewarmed returns a prewarmed socket bound to dst, the address a request was
+// sent to, or the address of the listener if it is not known. It returns nil
+// if there are none ready, starting to bind them for a new address
+func (c *Conn) prewarmed(dst net.IP) *net.UDPConn {
+	addr, ok := netip.AddrFromSlice(dst)
+	if !ok {
+		addr = c.c.LocalAddr().(*net.UDPAddr).AddrPort().Addr()
+	}
+	addr = addr.Unmap()
+
+	c.socksMu.Lock()
+	socks, ok := c.socks[addr]
+	if !ok {
+		socks = make(chan *net.UDPConn, c.prewarm)
+		c.socks[addr] = socks
+	}
+	c.socksMu.Unlock()
+	if !ok {
+		go func() {
+			for i := 0; i < c.prewarm; i++ {
+				if c.bindSocket(addr, socks) != nil {
+					return
+				}
+			}
+		}()
+		return nil
+	}
+
+	select {
+	case sock := <-socks:
+		go c.bindSocket(addr, socks)
+		return sock
+	default:
+		return nil
+	}
+}
+
+// bindSocket binds a reply socket to addr and adds it to socks, the prewarmed
+// sockets of addr. It is closed instead if the listener is closed or socks is
+// full
+func (c *Conn) bindSocket(addr netip.Addr, socks chan *net.UDPConn) error {
+	laddr := c.c.LocalAddr().(*net.UDPAddr)
+	conn, err := net.ListenUDP(laddr.Network(), net.UDPAddrFromAddrPort(netip.AddrPortFrom(addr, 0)))
 	if err != nil {
 		return err
 	}
-	if _, err := c.WriteTo(b, addr); err != nil {
+	if err := setBuffers(conn, c.rbuf, c.wbuf); err != nil {
+		conn.Close()
 		return err
 	}
-	return nil
+
+	// Close drains the sockets holding the lock, so a socket is either
+	// added before it does and closed by it or sees the listener is done
+	c.socksMu.Lock()
+	defer c.socksMu.Unlock()
+	select {
+	case <-c.done:
+		return conn.Close()
+	default:
+	}
+	select {
+	case socks <- conn:
+		return nil
+	default:
+		return conn.Close()
+	}
 }
 
 // Accept waits for new requests to the listening connection, creating new
-// Conn's out of accepted requests and ignoring the others
+// Conn's out of accepted requests and ignoring the others. The connections
+// accepted on a unixgram listener get sockets of their own, bound at the path
+// of the listener followed by a dot and a random number, which AcceptRange
+// picks from its range instead
 //
-// This function is only supposed to be called on listening Conn's
+// This function is only supposed to be called on listening Conn's. Concurrent
+// calls wait for each other, so a single goroutine accepting is enough
 func (c *Conn) Accept() (*Conn, error) {
 	return c.AcceptRange(0, 0)
 }
 
-// given a range it will try to find a port (also the TID) in the range to connect with
-func connectWithRange(lo, hi uint16, remote *net.UDPAddr) (conn *net.UDPConn, err error) {
-	var local *net.UDPAddr
+// ports of a range are picked at random so the TIDs of transfers can not be
+// guessed, from a source of their own as the global one is not seeded
+var (
+	portMu   sync.Mutex
+	portRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// randomPort returns a random port between lo and hi inclusive
+func randomPort(lo, hi uint16) uint16 {
+	portMu.Lock()
+	defer portMu.Unlock()
+	return uint16(portRand.Intn(int(hi-lo)+1)) + lo
+}
+
+// given a range it will try to find a port (also the TID) in the range to connect with.
+// If ip is not nil the connection is bound to it, otherwise the kernel picks
+// the local address
+func connectWithRange(lo, hi uint16, next func(lo, hi uint16) uint16, ip net.IP, remote *net.UDPAddr) (conn *net.UDPConn, err error) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
 
 	if lo == 0 && hi == 0 {
-		if local, err = net.ResolveUDPAddr(remote.Network(), ":0"); err != nil {
-			return nil, err
-		}
+		local := &net.UDPAddr{IP: ip}
 		if conn, err = net.DialUDP(remote.Network(), local, remote); err != nil {
 			return nil, err
 		}
 		return
 	}
 
-	next := func() int { return rand.Intn(int(hi-lo+1)) + int(lo) }
-	rand.Seed(time.Now().UnixNano())
-	for i := 0; i > 10; i++ {
-		addr := fmt.Sprintf(":%d", next())
-		if local, err = net.ResolveUDPAddr(remote.Network(), addr); err != nil {
-			continue
-		}
+	if next == nil {
+		next = randomPort
+	}
+	for i := 0; i < 10; i++ {
+		local := &net.UDPAddr{IP: ip, Port: int(next(lo, hi))}
 		if conn, err = net.DialUDP(remote.Network(), local, remote); err != nil {
 			continue
 		} else {
@@ -215,6 +797,28 @@ func connectWithRange(lo, hi uint16, remote *net.UDPAddr) (conn *net.UDPConn, er
 	return
 }
 
+// Listen returns a listening connection for the requests sent to address on
+// network, one of "udp", "udp4", "udp6" and "unixgram". The address of a
+// unixgram connection is the path of its socket, which is removed when the
+// connection is closed
+func Listen(network, address string) (*Conn, error) {
+	if network == "unixgram" {
+		return listenUnix(address)
+	}
+	if !strings.HasPrefix(network, "udp") {
+		return nil, fmt.Errorf("dit: %w: %s", ErrUnsupportedNetwork, network)
+	}
+	laddr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{c: conn, done: make(chan struct{})}, nil
+}
+
 // ListenConfigConn is Listen but gives you more control over the behaviour
 // of the underlying socket connection.
 // This makes it possible to do things like set platform specific socket options
@@ -224,5 +828,29 @@ func ListenConfigConn(ctx context.Context, cfg *net.ListenConfig, address string
 	if err != nil {
 		return nil, err
 	}
-	return &Conn{c: conn.(*net.UDPConn)}, nil
+	return &Conn{c: conn.(*net.UDPConn), done: make(chan struct{})}, nil
+}
+
+// ListenFD returns a listening connection from fd, the inherited file
+// descriptor of a bound UDP socket. This is how a socket activated by systemd
+// is handed to the process. The connection works on its own copy of fd, fd
+// stays with the caller, who closes it when it is no longer needed
+func ListenFD(fd int) (*Conn, error) {
+	nfd, err := dupFD(fd)
+	if err != nil {
+		return nil, fmt.Errorf("dit: invalid file descriptor %d: %w", fd, err)
+	}
+	f := os.NewFile(uintptr(nfd), fmt.Sprintf("fd %d", fd))
+	defer f.Close()
+
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	conn, ok := pc.(*net.UDPConn)
+	if !ok {
+		pc.Close()
+		return nil, fmt.Errorf("dit: file descriptor %d is not a udp socket", fd)
+	}
+	return &Conn{c: conn, done: make(chan struct{})}, nil
 }
@@ -0,0 +1,387 @@
+package dit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestKnownTID(t *testing.T) {
+	c := &Conn{connected: true, destTID: 5000, remote: net.UDPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:5000"))}
+	for addr, known := range map[string]bool{
+		"127.0.0.1:5000":          true,
+		"[::ffff:127.0.0.1]:5000": true,
+		"127.0.0.1:5001":          false,
+		"127.0.0.2:5000":          false,
+	} {
+		if got := c.knownTID(netip.MustParseAddrPort(addr)); got != known {
+			t.Errorf("knownTID(%s) = %v, want %v", addr, got, known)
+		}
+	}
+}
+
+func TestAcceptPrewarmed(t *testing.T) {
+	l, err := ListenConfigConn(context.Background(), &net.ListenConfig{}, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := l.PrewarmSockets(1); err != nil {
+		t.Fatal(err)
+	}
+
+	client := listenUDP(t, "127.0.0.1")
+	rrq, _ := NewRRQ("file", "octet", nil)
+	b, _ := Unmarshal(rrq)
+	if _, err := client.WriteToUDP(b, l.Addr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.c.RemoteAddr() != nil {
+		t.Fatal("accepted connection did not get the prewarmed socket")
+	}
+	if laddr := conn.c.LocalAddr().(*net.UDPAddr); !laddr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("prewarmed socket bound to %s, want the address of the listener", laddr)
+	}
+
+	// a socket bound while the listener closes is closed with it
+	l.Close()
+	addr := netip.MustParseAddr("127.0.0.1")
+	socks := l.socks[addr]
+	if err := l.bindSocket(addr, socks); err != nil {
+		t.Fatal(err)
+	}
+	if len(socks) > 0 {
+		t.Fatal("socket bound after the listener closed is kept")
+	}
+}
+
+func TestAbort(t *testing.T) {
+	l, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client := listenUDP(t, "127.0.0.1")
+	rrq, _ := NewRRQ("file", "octet", nil)
+	send(t, client, rrq, l.Addr().(*net.UDPAddr))
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Abort(FileNotFound, "no such file"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the error reaches the client before the socket is gone
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b := make([]byte, 512)
+	n, err := client.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := DecodePacket(b[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := p.(*ErrorPacket); !ok || e.ErrorCode != FileNotFound || e.ErrMsg != "no such file" {
+		t.Fatalf("got %s, want a file not found error", Describe(p))
+	}
+	if _, err := conn.Write(b[:n]); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("write after Abort returned %v, want %v", err, net.ErrClosed)
+	}
+	if err := conn.Abort(FileNotFound, "no such file"); err == nil {
+		t.Fatal("Abort of a closed connection succeeded")
+	}
+}
+
+func TestAcceptRangeNextPort(t *testing.T) {
+	l, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// a port that was free a moment ago starts the range
+	free := listenUDP(t, "127.0.0.1")
+	lo := uint16(free.LocalAddr().(*net.UDPAddr).Port)
+	free.Close()
+	hi := lo + 9
+	next := lo
+	l.nextPort = func(from, to uint16) uint16 {
+		if from != lo || to != hi {
+			t.Errorf("port picked from %d-%d, want %d-%d", from, to, lo, hi)
+		}
+		port := next
+		next++
+		return port
+	}
+
+	client := listenUDP(t, "127.0.0.1")
+	rrq, _ := NewRRQ("file", "octet", nil)
+	for i := uint16(0); i < 3; i++ {
+		send(t, client, rrq, l.Addr().(*net.UDPAddr))
+		conn, err := l.AcceptRange(lo, hi)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if port := conn.Addr().(*net.UDPAddr).Port; port != int(lo+i) {
+			t.Fatalf("connection %d got port %d, want %d", i, port, lo+i)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		if port := randomPort(lo, hi); port < lo || port > hi {
+			t.Fatalf("random port %d outside of %d-%d", port, lo, hi)
+		}
+	}
+}
+
+func TestIsPeerGone(t *testing.T) {
+	opErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("recvmsg", errno)}
+	}
+	for _, tt := range []struct {
+		name string
+		err  error
+		gone bool
+	}{
+		{"connection refused", opErr(syscall.ECONNREFUSED), true},
+		{"connection reset", opErr(syscall.ECONNRESET), true},
+		{"host unreachable", opErr(syscall.EHOSTUNREACH), true},
+		{"operation not permitted", opErr(syscall.EPERM), true},
+		{"wrapped ErrPeerGone", fmt.Errorf("transfer: %w", ErrPeerGone), true},
+		{"deadline exceeded", os.ErrDeadlineExceeded, false},
+		{"closed connection", net.ErrClosed, false},
+		{"no buffer space", opErr(syscall.ENOBUFS), false},
+		{"nil", nil, false},
+	} {
+		if got := IsPeerGone(tt.err); got != tt.gone {
+			t.Errorf("%s: IsPeerGone = %v, want %v", tt.name, got, tt.gone)
+		}
+		err := peerGone(tt.err)
+		if errors.Is(err, ErrPeerGone) != tt.gone {
+			t.Errorf("%s: peerGone returned %v", tt.name, err)
+		}
+		if !tt.gone && err != tt.err {
+			t.Errorf("%s: peerGone changed the error to %v", tt.name, err)
+		}
+	}
+}
+
+// acceptFrom has client send a request to l and returns the connection l
+// accepts for it
+func acceptFrom(t testing.TB, l *Conn, client *net.UDPConn) *Conn {
+	t.Helper()
+	rrq, _ := NewRRQ("file", "octet", nil)
+	send(t, client, rrq, l.Addr().(*net.UDPAddr))
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestWriteSinglePort(t *testing.T) {
+	l, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := l.SetSinglePort(true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Write([]byte("listener")); !errors.Is(err, ErrListenerWrite) {
+		t.Fatalf("Write on a listener returned %v, want %v", err, ErrListenerWrite)
+	}
+
+	// both transfers write from the socket of the listener, each reply has
+	// to reach the client of its own transfer and no other
+	clients := []*net.UDPConn{listenUDP(t, "127.0.0.1"), listenUDP(t, "127.0.0.1")}
+	conns := []*Conn{acceptFrom(t, l, clients[0]), acceptFrom(t, l, clients[1])}
+	for i, conn := range conns {
+		if _, err := conn.Write([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := make([]byte, 16)
+	for i, client := range clients {
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, from, err := client.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("client %d: %v", i, err)
+		}
+		if n != 1 || buf[0] != byte(i) || from.Port != l.Addr().(*net.UDPAddr).Port {
+			t.Fatalf("client %d got %v from %v, want [%d] from the listener", i, buf[:n], from, i)
+		}
+		client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if n, _, err := client.ReadFromUDP(buf); err == nil {
+			t.Fatalf("client %d got %v as well", i, buf[:n])
+		}
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	l, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if _, err := l.WriteBatch([][]byte{{0}}); !errors.Is(err, ErrListenerWrite) {
+		t.Fatalf("WriteBatch on a listener returned %v, want %v", err, ErrListenerWrite)
+	}
+
+	client := listenUDP(t, "127.0.0.1")
+	accepted := acceptFrom(t, l, client)
+	dialed, err := Dial("udp", client.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dialed.Close()
+
+	// the connected socket of Accept and the unconnected one of Dial send
+	// the datagrams in order, empty ones too
+	pkts := [][]byte{[]byte("one"), {}, []byte("three"), bytes.Repeat([]byte("4"), 1000)}
+	for name, conn := range map[string]*Conn{"accepted": accepted, "dialed": dialed} {
+		n, err := conn.WriteBatch(pkts)
+		if err != nil || n != len(pkts) {
+			t.Fatalf("%s: wrote %d of %d packets: %v", name, n, len(pkts), err)
+		}
+		buf := make([]byte, 2048)
+		for i, want := range pkts {
+			client.SetReadDeadline(time.Now().Add(2 * time.Second))
+			m, err := client.Read(buf)
+			if err != nil {
+				t.Fatalf("%s: packet %d: %v", name, i, err)
+			}
+			if !bytes.Equal(buf[:m], want) {
+				t.Fatalf("%s: packet %d is %q, want %q", name, i, buf[:m], want)
+			}
+		}
+	}
+}
+
+func BenchmarkWriteBatch(b *testing.B) {
+	l, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	sink := listenUDP(b, "127.0.0.1")
+	conn := acceptFrom(b, l, sink)
+	go io.Copy(io.Discard, sink)
+
+	// a window of 16 blocks of the default blksize
+	window := make([][]byte, 16)
+	for i := range window {
+		window[i] = make([]byte, 516)
+	}
+	b.Run("batch", func(b *testing.B) {
+		b.SetBytes(int64(len(window) * 516))
+		for i := 0; i < b.N; i++ {
+			if _, err := conn.WriteBatch(window); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("loop", func(b *testing.B) {
+		b.SetBytes(int64(len(window) * 516))
+		for i := 0; i < b.N; i++ {
+			for _, p := range window {
+				if _, err := conn.Write(p); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+func BenchmarkAccept(b *testing.B) {
+	for _, bench := range []struct {
+		name       string
+		singlePort bool
+	}{
+		{"own socket", false},
+		// without binding a socket for every transfer, what is left is
+		// reading and decoding the request
+		{"single port", true},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			l, err := Listen("udp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer l.Close()
+			if err := l.SetSinglePort(bench.singlePort); err != nil {
+				b.Fatal(err)
+			}
+			client := listenUDP(b, "127.0.0.1")
+			rrq, _ := NewRRQ("file", "octet", map[Option]int{Blksize: 1428, Tsize: 0})
+			req, _ := Unmarshal(rrq)
+			addr := l.Addr().(*net.UDPAddr)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := client.WriteToUDP(req, addr); err != nil {
+					b.Fatal(err)
+				}
+				conn, err := l.Accept()
+				if err != nil {
+					b.Fatal(err)
+				}
+				conn.Release()
+			}
+		})
+	}
+}
+
+func TestListenFD(t *testing.T) {
+	sock := listenUDP(t, "127.0.0.1")
+	f, err := sock.File()
+	if err != nil {
+		t.Skipf("socket has no file descriptor: %v", err)
+	}
+	defer f.Close()
+
+	conn, err := ListenFD(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the descriptor still belongs to the caller and is open
+	if _, err := f.Stat(); err != nil {
+		t.Fatalf("descriptor closed by ListenFD: %v", err)
+	}
+
+	// the connection listens on the socket behind the descriptor
+	client := listenUDP(t, "127.0.0.1")
+	if _, err := client.WriteTo([]byte("request"), sock.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	if err := conn.SetReadDeadline(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	n, from, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "request" || from.Port() != uint16(client.LocalAddr().(*net.UDPAddr).Port) {
+		t.Fatalf("got %q from %v, want the datagram sent from %v", buf[:n], from, client.LocalAddr())
+	}
+}
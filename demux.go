@@ -0,0 +1,164 @@
+package dit
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// largest datagram a transfer in single port mode can send the listener,
+	// a data packet of the largest blksize
+	maxDatagram = 65536
+
+	// datagrams queued for a connection in single port mode before any more
+	// are dropped
+	inboxLen = 16
+)
+
+// demux routes the datagrams a listener in single port mode recieves from the
+// peers of transfers in progress to the connections accepted for them
+type demux struct {
+	mu    sync.Mutex
+	peers map[netip.AddrPort]*Conn
+
+	// closed with the listener
+	done <-chan struct{}
+}
+
+// SetSinglePort makes the connections the listener accepts share its socket
+// instead of each getting a socket (TID) of its own, so replies come from the
+// port requests were sent to. Datagrams are told apart by the address of the
+// client, which means a client can have only one transfer in progress at a
+// time, new requests from it are dropped until it is done. Accept also hands
+// the datagrams of transfers in progress to their connections, so it has to be
+// called continuously for them to make progress.
+//
+// This is not what RFC1350 specifies, it is for networks whose firewalls let
+// through nothing but the port of the server. Prewarmed sockets and port
+// ranges are not used in single port mode. It is not supported on unixgram
+// listeners.
+//
+// This function is only supposed to be called on listening Conn's before
+// they start accepting
+func (c *Conn) SetSinglePort(on bool) error {
+	if c.connected {
+		return ErrClientAccept
+	}
+	if c.u != nil && on {
+		return fmt.Errorf("dit: %w: single port mode on unixgram", ErrUnsupportedNetwork)
+	}
+	c.peers = nil
+	if on {
+		c.peers = &demux{peers: make(map[netip.AddrPort]*Conn), done: c.done}
+		c.abuf = make([]byte, maxDatagram)
+		c.aoob = make([]byte, 128)
+	}
+	return nil
+}
+
+// route hands b to the connection of the transfer with peer. It reports
+// whether peer has a transfer in progress, b is dropped if its connection is
+// not keeping up like it would be by a full socket buffer
+func (d *demux) route(peer netip.AddrPort, b []byte) bool {
+	d.mu.Lock()
+	conn, ok := d.peers[peer]
+	d.mu.Unlock()
+	if !ok {
+		return false
+	}
+	// a client whose first answer got lost sends its request again. the
+	// transfer already answering it retransmits that answer, the request is
+	// not for it to handle and would only break it off
+	if len(b) >= 2 {
+		if op := opcode(b); op == Rrq || op == Wrq {
+			return true
+		}
+	}
+	select {
+	case conn.inbox <- append([]byte(nil), b...):
+	default:
+	}
+	return true
+}
+
+// accept creates a connection for req from raddr sharing the socket of l
+func (d *demux) accept(l *Conn, raddr *net.UDPAddr, req *ReadWriteRequest) *Conn {
+	conn := &Conn{
+		c:         l.c,
+		destTID:   raddr.AddrPort().Port(),
+		connected: true,
+		req:       req,
+		done:      make(chan struct{}),
+		trace:     l.trace,
+		remote:    raddr,
+		shared:    d,
+		inbox:     make(chan []byte, inboxLen),
+		wake:      make(chan struct{}, 1),
+	}
+	d.mu.Lock()
+	d.peers[raddr.AddrPort()] = conn
+	d.mu.Unlock()
+	return conn
+}
+
+// remove stops routing the datagrams of the peer of conn to it
+func (d *demux) remove(conn *Conn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.peers[conn.Peer()] == conn {
+		delete(d.peers, conn.Peer())
+	}
+}
+
+// readInbox waits for the next datagram routed to a connection sharing the
+// socket of a listener, until the read deadline of the connection passes
+func (c *Conn) readInbox(b []byte) (int, netip.AddrPort, error) {
+	for {
+		var (
+			timer   *time.Timer
+			expired <-chan time.Time
+		)
+		if d := c.deadline.Load(); d != 0 {
+			wait := time.Until(time.Unix(0, d))
+			if wait <= 0 {
+				return 0, netip.AddrPort{}, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(wait)
+			expired = timer.C
+		}
+		var (
+			p   []byte
+			err error
+		)
+		select {
+		case p = <-c.inbox:
+		case <-expired:
+		case <-c.wake:
+			// the deadline changed, wait for the new one
+		case <-c.done:
+			err = net.ErrClosed
+		case <-c.shared.done:
+			err = net.ErrClosed
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if p != nil || err != nil {
+			return copy(b, p), c.remote.AddrPort(), err
+		}
+	}
+}
+
+// setInboxDeadline sets the read deadline of a connection sharing the socket
+// of a listener, waking up a read in progress to wait for it instead
+func (c *Conn) setInboxDeadline(t time.Time) {
+	c.deadline.Store(t.UnixNano())
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
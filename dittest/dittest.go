@@ -0,0 +1,33 @@
+// Package dittest provides utilities for testing against a tftp server, in the
+// spirit of net/http/httptest
+package dittest
+
+import (
+	"testing"
+
+	"github.com/Joe-Degs/dit/server"
+)
+
+// NewTestServer starts a server on an ephemeral port of the loopback interface
+// serving the files of dir, failing t if it can not. It returns the address of
+// the server to dial and a function that shuts it down, which callers should
+// defer. Read requests are served from dir, write requests can create files in
+// it
+func NewTestServer(t testing.TB, dir string) (addr string, cleanup func()) {
+	t.Helper()
+	// the options go through the flag parser like those of tftpd, so they
+	// are checked the same way
+	opts, getopt := server.NewOpts()
+	if _, err := getopt.Parse([]string{"--secure", dir, "--address", "127.0.0.1:0", "--create"}); err != nil {
+		t.Fatalf("dittest: invalid server options: %v", err)
+	}
+	a, stop, err := server.Start(opts)
+	if err != nil {
+		t.Fatalf("dittest: failed to start server: %v", err)
+	}
+	return a.String(), func() {
+		if err := stop(); err != nil {
+			t.Errorf("dittest: failed to stop server: %v", err)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package dittest_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Joe-Degs/dit"
+	"github.com/Joe-Degs/dit/dittest"
+)
+
+// exampleTB reports the failures of NewTestServer outside of a test, examples
+// have no testing.TB of their own
+type exampleTB struct{ testing.TB }
+
+func (exampleTB) Helper()                        {}
+func (exampleTB) Fatalf(format string, v ...any) { log.Fatalf(format, v...) }
+func (exampleTB) Errorf(format string, v ...any) { log.Printf(format, v...) }
+
+func ExampleNewTestServer() {
+	dir, err := os.MkdirTemp("", "dittest")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.WriteFile(filepath.Join(dir, "hello.txt"), []byte("hello, world\n"), 0o644); err != nil {
+		log.Fatal(err)
+	}
+
+	// in a test this is dittest.NewTestServer(t, dir)
+	addr, cleanup := dittest.NewTestServer(exampleTB{}, dir)
+	defer cleanup()
+
+	var buf bytes.Buffer
+	if err := dit.Fetch(context.Background(), addr, "hello.txt", &buf); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Print(buf.String())
+	// Output: hello, world
+}
@@ -1,3 +1,3 @@
 package dit
 
-//go:generate stringer -type=Opcode,ErrorCode,Option -output=string.go
+//go:generate stringer -type=Opcode,ErrorCode,Option,Direction -output=string.go
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package dit
+
+import "errors"
+
+// dupFD is not supported here, sockets are not inherited as file descriptors
+func dupFD(fd int) (int, error) {
+	return -1, errors.New("dit: file descriptors are not supported on this platform")
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package dit
+
+import "syscall"
+
+// dupFD returns a copy of the file descriptor fd that is closed on exec
+func dupFD(fd int) (int, error) {
+	// the lock keeps a fork from inheriting the copy before it is marked
+	syscall.ForkLock.RLock()
+	defer syscall.ForkLock.RUnlock()
+	nfd, err := syscall.Dup(fd)
+	if err != nil {
+		return -1, err
+	}
+	syscall.CloseOnExec(nfd)
+	return nfd, nil
+}
@@ -25,6 +25,9 @@ type FileBuffer struct {
 	// buf keeps the most recents data read/written from/to the underlying data
 	// source for retransmission
 	buf *bytes.Buffer
+
+	// size of the buffered reader/writer, bufio decides when it is zero
+	size int
 }
 
 // NewFileBufferFunc returns the request and a closure to open/create file and
@@ -33,13 +36,25 @@ func NewFileBuffer() *FileBuffer {
 	return &FileBuffer{buf: new(bytes.Buffer)}
 }
 
+// SetBufferSize sets the size of the buffered reader/writer created by the
+// next call to WithRequest. Sizes smaller than the bufio default are rounded up
+// to it. Blocks as large as the buffer go straight to the file, so it takes a
+// syscall per block unless the size is a few times the negotiated blksize
+func (f *FileBuffer) SetBufferSize(n int) {
+	f.size = n
+}
+
 func (f *FileBuffer) WithRequest(op Opcode, file io.ReadWriteCloser) {
 	f.f = file
+	size := f.size
+	if size < 4096 {
+		size = 4096
+	}
 	switch op {
 	case Rrq:
-		f.r = bufio.NewReader(file)
+		f.r = bufio.NewReaderSize(file, size)
 	case Wrq:
-		f.w = bufio.NewWriter(file)
+		f.w = bufio.NewWriterSize(file, size)
 	}
 }
 
@@ -139,6 +154,13 @@ func (f *FileBuffer) ReadBuffer(b []byte) int {
 	return copy(b, f.buf.Bytes())
 }
 
+// RetransmitBlock returns the data in the temporary buffer as data packet
+// blockNum, ready to be sent again. The packet shares the temporary buffer, it
+// is only valid until the next call to ReadNext or WriteNext
+func (f *FileBuffer) RetransmitBlock(blockNum uint16) (*DataPacket, error) {
+	return NewData(blockNum, f.buf.Bytes())
+}
+
 // BufferedObject returns the underlying reader or writer depending on the
 // request. It returns a reader when request is a read request and a writer
 // if request if a write request
@@ -149,11 +171,19 @@ func (f *FileBuffer) BufferedObject() any {
 	return f.w
 }
 
-// Close resources associated with buffered io operations
-func (f *FileBuffer) Close() error {
+// Flush writes buffered data of a write request to the underlying file, the
+// file stays open and the temporary buffer is left alone. It does nothing for a
+// read request
+func (f *FileBuffer) Flush() error {
 	if f.w != nil {
 		return f.w.Flush()
 	}
-	f.buf.Reset()
 	return nil
 }
+
+// Close resources associated with buffered io operations
+func (f *FileBuffer) Close() error {
+	err := f.Flush()
+	f.buf.Reset()
+	return err
+}
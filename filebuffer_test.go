@@ -0,0 +1,116 @@
+package dit
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// countingFile is a file of n zero bytes that counts the reads made from it
+type countingFile struct {
+	r     io.Reader
+	reads int
+}
+
+func (c *countingFile) Read(b []byte) (int, error) {
+	c.reads++
+	return c.r.Read(b)
+}
+
+func (c *countingFile) Write(b []byte) (int, error) { return len(b), nil }
+func (c *countingFile) Close() error                { return nil }
+
+func BenchmarkReadNext(b *testing.B) {
+	const blksize = 32768
+	file := make([]byte, 64*blksize)
+	for _, bench := range []struct {
+		name string
+		size int
+	}{
+		{"default", 0},
+		{"one block", blksize},
+		{"four blocks", 4 * blksize},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			block := make([]byte, blksize)
+			reads, blocks := 0, 0
+			b.SetBytes(int64(len(file)))
+			for i := 0; i < b.N; i++ {
+				f := &countingFile{r: bytes.NewReader(file)}
+				buf := NewFileBuffer()
+				buf.SetBufferSize(bench.size)
+				buf.WithRequest(Rrq, f)
+				for {
+					n, err := buf.ReadNext(block)
+					blocks++
+					if err != nil || n < blksize {
+						break
+					}
+				}
+				reads += f.reads
+			}
+			b.ReportMetric(float64(reads)/float64(blocks), "reads/block")
+		})
+	}
+}
+
+func TestFileBufferFlush(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "file")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := NewFileBuffer()
+	buf.WithRequest(Wrq, f)
+
+	if _, err := buf.WriteNext([]byte("hello ")); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(name); len(got) != 0 {
+		t.Fatalf("file holds %q before the flush, want the write buffered", got)
+	}
+	if err := buf.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(name); string(got) != "hello " {
+		t.Fatalf("file holds %q after the flush, want %q", got, "hello ")
+	}
+	// the flush leaves the retransmission buffer alone
+	if n := buf.BufferLen(); n != 6 {
+		t.Fatalf("retransmission buffer holds %d bytes after the flush, want 6", n)
+	}
+
+	if _, err := buf.WriteNext([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if err := buf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(name); string(got) != "hello world" {
+		t.Fatalf("file holds %q, want %q", got, "hello world")
+	}
+}
+
+func TestRetransmitBlock(t *testing.T) {
+	file := bytes.Repeat([]byte("0123456789"), 100)
+	buf := NewFileBuffer()
+	buf.WithRequest(Rrq, &countingFile{r: bytes.NewReader(file)})
+
+	// the last block read comes back as a data packet, the short one too
+	block := make([]byte, 512)
+	for i, want := range [][]byte{file[:512], file[512:]} {
+		if _, err := buf.ReadNext(block); err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			t.Fatal(err)
+		}
+		p, err := buf.RetransmitBlock(uint16(i + 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.BlockNumber != uint16(i+1) || !bytes.Equal(p.Data, want) {
+			t.Fatalf("block %d: got %s, want %d bytes", i+1, Describe(p), len(want))
+		}
+	}
+}
@@ -6,5 +6,6 @@ go 1.19
 
 require (
 	github.com/DavidGamba/go-getoptions v0.25.3
-	golang.org/x/sys v0.0.0-20220520151302-bc2c85ada10a
+	golang.org/x/sys v0.0.0-20220722155257-8c9f86f7a55f
+	golang.org/x/text v0.3.8
 )
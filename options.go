@@ -0,0 +1,81 @@
+package dit
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Option of the first option registered with RegisterOption, the one after the
+// last built-in option
+const firstCustom = Offset + 1
+
+// options registered with RegisterOption
+var (
+	customMu   sync.RWMutex
+	customOpts []customOption
+)
+
+type customOption struct {
+	name     string
+	validate func(string) (int, error)
+}
+
+// RegisterOption makes the parser recognize the option name, for experimental
+// and vendor specific options. validate parses the value of the option from a
+// packet and reports whether it is acceptable, options with invalid values are
+// dropped like those of the built-in options. It returns the Option that
+// stands for name in the options of packets.
+//
+// Options are meant to be registered once at startup, before any packets are
+// parsed. Registering a name that is already known is an error
+func RegisterOption(name string, validate func(string) (int, error)) (Option, error) {
+	name = strings.ToLower(trimToken(name))
+	if name == "" || validate == nil {
+		return Unknown, fmt.Errorf("dit: option name and validate function are required")
+	}
+	if MarshalOpts(name) != Unknown {
+		return Unknown, fmt.Errorf("dit: option %q is already known", name)
+	}
+
+	customMu.Lock()
+	defer customMu.Unlock()
+	// the last Option value is left free so loops over all options can
+	// end on the one after the last registered
+	if len(customOpts) >= int(^Option(0)-firstCustom) {
+		return Unknown, fmt.Errorf("dit: too many registered options")
+	}
+	opt := firstCustom + Option(len(customOpts))
+	customOpts = append(customOpts, customOption{name, validate})
+	return opt, nil
+}
+
+// lookupOption returns the registered option opt
+func lookupOption(opt Option) (customOption, bool) {
+	customMu.RLock()
+	defer customMu.RUnlock()
+	if opt < firstCustom || int(opt-firstCustom) >= len(customOpts) {
+		return customOption{}, false
+	}
+	return customOpts[opt-firstCustom], true
+}
+
+// lookupOptionName returns the registered option called name, which is
+// expected in lower case
+func lookupOptionName(name string) Option {
+	customMu.RLock()
+	defer customMu.RUnlock()
+	for i, o := range customOpts {
+		if o.name == name {
+			return firstCustom + Option(i)
+		}
+	}
+	return Unknown
+}
+
+// registeredOptions returns the number of registered options
+func registeredOptions() int {
+	customMu.RLock()
+	defer customMu.RUnlock()
+	return len(customOpts)
+}
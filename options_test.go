@@ -0,0 +1,57 @@
+package dit
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// options can not be unregistered, registering once for the test binary lets
+// the tests run several times
+var vendorOpt, vendorErr = RegisterOption("X-Vendor", func(val string) (int, error) {
+	n, err := strconv.Atoi(val)
+	if err != nil || n < 0 {
+		return 0, errors.New("not a count")
+	}
+	return n, nil
+})
+
+func TestRegisterOption(t *testing.T) {
+	if vendorErr != nil {
+		t.Fatal(vendorErr)
+	}
+	if got := MarshalOpts("x-vendor"); got != vendorOpt {
+		t.Fatalf("x-vendor parses as %s, want the registered option", got)
+	}
+	// the values of the built-in options do not change as they are added
+	if Unknown != 4 || vendorOpt <= Offset {
+		t.Fatalf("Unknown is %d and x-vendor %d, want 4 and after Offset %d", Unknown, vendorOpt, Offset)
+	}
+	for _, name := range []string{"x-vendor", "blksize", ""} {
+		if _, err := RegisterOption(name, func(string) (int, error) { return 0, nil }); err == nil {
+			t.Errorf("registered %q, want an error", name)
+		}
+	}
+
+	// the option survives a round trip through a request, and is dropped
+	// when its value does not validate
+	req, err := NewRRQ("file", "octet", map[Option]int{vendorOpt: 42, Blksize: 1024, Offset: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p, req) {
+		t.Fatalf("%s round trips to %s", Describe(req), Describe(p))
+	}
+	p, err = DecodePacket([]byte("\x00\x01file\x00octet\x00x-vendor\x00many\x00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts := p.(*ReadWriteRequest).Options; len(opts) != 0 {
+		t.Fatalf("invalid value decoded as options %v", opts)
+	}
+}
@@ -0,0 +1,35 @@
+//go:build linux
+
+package dit
+
+import (
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// dstIP extracts the destination address of a datagram from the IP_PKTINFO or
+// IPV6_PKTINFO control messages in oob. It returns nil if there is none, in
+// which case the kernel picks the source address of replies
+func dstIP(oob []byte) net.IP {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == unix.IPPROTO_IP && m.Header.Type == unix.IP_PKTINFO &&
+			len(m.Data) >= unix.SizeofInet4Pktinfo:
+			info := (*unix.Inet4Pktinfo)(unsafe.Pointer(&m.Data[0]))
+			return net.IPv4(info.Addr[0], info.Addr[1], info.Addr[2], info.Addr[3])
+		case m.Header.Level == unix.IPPROTO_IPV6 && m.Header.Type == unix.IPV6_PKTINFO &&
+			len(m.Data) >= unix.SizeofInet6Pktinfo:
+			info := (*unix.Inet6Pktinfo)(unsafe.Pointer(&m.Data[0]))
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, info.Addr[:])
+			return ip
+		}
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package dit
+
+import "net"
+
+// dstIP is not supported on this platform, replies are sent from whatever
+// address the kernel picks
+func dstIP(oob []byte) net.IP {
+	return nil
+}
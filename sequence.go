@@ -0,0 +1,47 @@
+package dit
+
+// BlockClass classifies a recieved data block against the block a receiver
+// expects next
+type BlockClass uint8
+
+const (
+	// BlockExpected is the next block of the transfer, it should be written
+	// and acknowledged
+	BlockExpected BlockClass = iota
+
+	// BlockDuplicate is the block most recently recieved. The sender did not
+	// get our acknowledgement so it should be acknowledged again
+	BlockDuplicate
+
+	// BlockOutOfWindow is neither the next block nor a duplicate, it arrived
+	// out of order and should be dropped
+	BlockOutOfWindow
+)
+
+// BlockSequence tracks the data blocks recieved in a transfer. The zero value
+// expects block 1 as the first block of a transfer
+type BlockSequence struct {
+	last uint16
+}
+
+// Classify reports how a data block numbered block should be handled
+func (s *BlockSequence) Classify(block uint16) BlockClass {
+	switch block {
+	case s.last + 1:
+		return BlockExpected
+	case s.last:
+		return BlockDuplicate
+	}
+	return BlockOutOfWindow
+}
+
+// Advance records that the expected block has been recieved
+func (s *BlockSequence) Advance() {
+	s.last++
+}
+
+// Last returns the number of the last block recieved, which is the block the
+// receiver acknowledges
+func (s *BlockSequence) Last() uint16 {
+	return s.last
+}
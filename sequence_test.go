@@ -0,0 +1,41 @@
+package dit
+
+import "testing"
+
+func TestBlockSequence(t *testing.T) {
+	tests := []struct {
+		name  string
+		last  uint16 // blocks recieved before
+		block uint16
+		want  BlockClass
+	}{
+		{"first block", 0, 1, BlockExpected},
+		{"ack of the request", 0, 0, BlockDuplicate},
+		{"next block", 5, 6, BlockExpected},
+		{"duplicate", 5, 5, BlockDuplicate},
+		{"earlier block", 5, 4, BlockOutOfWindow},
+		{"skipped ahead", 5, 7, BlockOutOfWindow},
+		{"block number wraps", 65535, 0, BlockExpected},
+		{"duplicate before wrap", 65535, 65535, BlockDuplicate},
+	}
+	for _, tt := range tests {
+		var seq BlockSequence
+		for i := 0; i < int(tt.last); i++ {
+			seq.Advance()
+		}
+		if got := seq.Classify(tt.block); got != tt.want {
+			t.Errorf("%s: Classify(%d) after block %d = %d, want %d", tt.name, tt.block, tt.last, got, tt.want)
+		}
+	}
+
+	// only advancing moves on to the next block
+	var seq BlockSequence
+	seq.Classify(1)
+	if seq.Last() != 0 {
+		t.Fatalf("Classify moved the sequence to block %d", seq.Last())
+	}
+	seq.Advance()
+	if seq.Last() != 1 || seq.Classify(2) != BlockExpected {
+		t.Fatalf("after Advance last block is %d, want 1", seq.Last())
+	}
+}
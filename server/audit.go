@@ -0,0 +1,56 @@
+package server
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Joe-Degs/dit"
+)
+
+// auditLog records one line for every transfer in the --audit-log file,
+// separate from the operational log. A nil auditLog records nothing
+type auditLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func openAuditLog(name string) (*auditLog, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{f: f}, nil
+}
+
+// record writes the outcome of a transfer as a line of key=value pairs, err is
+// nil for a completed transfer
+//
+//	2006-01-02T15:04:05.000000Z remote=127.0.0.1:49152 op=Rrq file="f.bin" bytes=1300 duration=2.5ms result=ok
+func (a *auditLog) record(remote netip.AddrPort, req *dit.ReadWriteRequest, bytes int64, took time.Duration, err error) {
+	if a == nil {
+		return
+	}
+	result := "ok"
+	if err != nil {
+		result = strconv.Quote(err.Error())
+	}
+	line := fmt.Sprintf("%s remote=%s op=%s file=%q bytes=%d duration=%s result=%s\n",
+		time.Now().UTC().Format("2006-01-02T15:04:05.000000Z"), remote, req.Opcode,
+		req.Filename, bytes, took.Round(time.Microsecond), result)
+
+	// lines of concurrent transfers must not interleave
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.f.WriteString(line)
+}
+
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	return a.f.Close()
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Joe-Degs/dit"
+)
+
+func TestAuditLog(t *testing.T) {
+	audit := filepath.Join(t.TempDir(), "audit.log")
+	addr, dir := startServer(t, func(o *Opts) { o.AuditLog = audit })
+	if err := os.WriteFile(filepath.Join(dir, "file"), randomBytes(1300), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	client := new(dit.Client)
+	if _, err := client.Get(addr, "file", io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(addr, "missing", io.Discard); err == nil {
+		t.Fatal("got a file that does not exist")
+	}
+	// the lines of concurrent transfers are appended whole
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.Get(addr, "file", io.Discard); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// transfers are recorded once the server is done with them
+	var lines []string
+	for i := 0; i < 100 && len(lines) < 12; i++ {
+		time.Sleep(10 * time.Millisecond)
+		b, err := os.ReadFile(audit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	}
+	if len(lines) != 12 {
+		t.Fatalf("audit log has %d lines, want 12:\n%s", len(lines), strings.Join(lines, "\n"))
+	}
+	ok := regexp.MustCompile(`^\S+Z remote=127\.0\.0\.1:\d+ op=Rrq file="file" bytes=1300 duration=\S+ result=ok$`)
+	failed := regexp.MustCompile(`^\S+Z remote=127\.0\.0\.1:\d+ op=Rrq file="missing" bytes=0 duration=\S+ result=".+"$`)
+	var oks, fails int
+	for _, line := range lines {
+		switch {
+		case ok.MatchString(line):
+			oks++
+		case failed.MatchString(line):
+			fails++
+		default:
+			t.Errorf("unexpected audit line %q", line)
+		}
+	}
+	if oks != 11 || fails != 1 {
+		t.Fatalf("audit log records %d completed and %d failed transfers, want 11 and 1", oks, fails)
+	}
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"errors"
+	"sync"
+)
+
+// values of --lock
+const (
+	lockWait   = "wait"
+	lockRefuse = "refuse"
+)
+
+var errFileBusy = errors.New("file is in use by another transfer")
+
+// fileLocks keeps a transfer that writes a file from overlapping the ones that
+// read it with --lock. Uploads are mostly renamed over the file once complete,
+// so a reader rarely sees a torn file without it, but readers started during an
+// upload get the old content and the upload may replace the file under them.
+// Uploads written in place, see openUpload, are only kept from readers by it
+type fileLocks struct {
+	mu    sync.Mutex
+	files map[string]*fileLock
+}
+
+type fileLock struct {
+	sync.RWMutex
+	refs int // transfers holding or waiting for the lock
+}
+
+func newFileLocks() *fileLocks {
+	return &fileLocks{files: make(map[string]*fileLock)}
+}
+
+// lock takes the lock of path, exclusive for write, shared otherwise. It waits
+// for the lock to be free if wait is set, otherwise it returns errFileBusy if
+// it is not. The returned function releases the lock
+func (l *fileLocks) lock(path string, write, wait bool) (func(), error) {
+	l.mu.Lock()
+	fl, ok := l.files[path]
+	if !ok {
+		fl = &fileLock{}
+		l.files[path] = fl
+	}
+	fl.refs++
+	l.mu.Unlock()
+
+	var locked bool
+	switch {
+	case write && wait:
+		fl.Lock()
+		locked = true
+	case write:
+		locked = fl.TryLock()
+	case wait:
+		fl.RLock()
+		locked = true
+	default:
+		locked = fl.TryRLock()
+	}
+
+	// locks nobody holds or waits for are dropped, so the table only ever
+	// holds the files of transfers in progress
+	put := func() {
+		l.mu.Lock()
+		if fl.refs--; fl.refs == 0 {
+			delete(l.files, path)
+		}
+		l.mu.Unlock()
+	}
+	if !locked {
+		put()
+		return nil, errFileBusy
+	}
+	return func() {
+		if write {
+			fl.Unlock()
+		} else {
+			fl.RUnlock()
+		}
+		put()
+	}, nil
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"sync/atomic"
+
+	"github.com/Joe-Degs/dit"
+)
+
+// Metrics is a snapshot of the counters a server keeps about its transfers
+type Metrics struct {
+	Requests     int64 // read/write requests accepted
+	Active       int64 // transfers in progress
+	BytesRead    int64 // bytes recieved from clients in write requests
+	BytesWritten int64 // bytes sent to clients in read requests
+
+	// error packets sent to clients by error code
+	Errors map[dit.ErrorCode]int64
+}
+
+// server wide counters, updated atomically by the accept and transfer loops
+type metrics struct {
+	requests     atomic.Int64
+	active       atomic.Int64
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
+	errors       [dit.RequestDenied + 1]atomic.Int64
+}
+
+func (m *metrics) countErr(code dit.ErrorCode) {
+	if int(code) < len(m.errors) {
+		m.errors[code].Add(1)
+	}
+}
+
+func (m *metrics) snapshot() Metrics {
+	s := Metrics{
+		Requests:     m.requests.Load(),
+		Active:       m.active.Load(),
+		BytesRead:    m.bytesRead.Load(),
+		BytesWritten: m.bytesWritten.Load(),
+		Errors:       make(map[dit.ErrorCode]int64),
+	}
+	for code := range m.errors {
+		if n := m.errors[code].Load(); n > 0 {
+			s.Errors[dit.ErrorCode(code)] = n
+		}
+	}
+	return s
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Joe-Degs/dit"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	opts, _ := NewOpts()
+	opts.Secure = dir
+	opts.Address = "127.0.0.1:0"
+	opts.Create = true
+	srv, err := StartServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	addr := srv.Addr().String()
+
+	if err := os.WriteFile(filepath.Join(dir, "file"), randomBytes(700), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	client := new(dit.Client)
+	if _, err := client.Get(addr, "file", io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Put(addr, "upload", bytes.NewReader(randomBytes(1000))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(addr, "missing", io.Discard); err == nil {
+		t.Fatal("got a file that does not exist")
+	}
+
+	// the server finishes a transfer after the client is done with it
+	var m Metrics
+	for i := 0; i < 100; i++ {
+		if m = srv.Snapshot(); m.Active == 0 && m.Requests == 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	want := Metrics{
+		Requests:     3,
+		BytesRead:    1000,
+		BytesWritten: 700,
+		Errors:       map[dit.ErrorCode]int64{dit.FileNotFound: 1},
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Fatalf("got %+v, want %+v", m, want)
+	}
+}
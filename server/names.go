@@ -0,0 +1,32 @@
+package server
+
+import (
+	"errors"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+var errControlChar = errors.New("filename contains control characters")
+
+// cleanName checks the filename of a request before it is joined into a path
+// and returns it in normalization form C, so a name decomposed by the client
+// (macOS does that) finds the file stored under the composed one. Names with
+// control characters are refused, they have no business in a path and make a
+// mess of logs
+func cleanName(name string) (string, error) {
+	ascii := true
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "", errControlChar
+		}
+		if r >= utf8.RuneSelf {
+			ascii = false
+		}
+	}
+	if ascii {
+		return name, nil
+	}
+	return norm.NFC.String(name), nil
+}
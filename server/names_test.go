@@ -0,0 +1,75 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Joe-Degs/dit"
+)
+
+func TestCleanName(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"boot/pxelinux.0", "boot/pxelinux.0"},
+		{"caf\u00e9", "caf\u00e9"},
+		// decomposed by the client
+		{"cafe\u0301", "caf\u00e9"},
+		{"u\u0308\u0304", "\u01d6"},
+		// marks out of canonical order are sorted before composing
+		{"s\u0307\u0323", "\u1e69"},
+		{"q\u0307\u0323", "q\u0323\u0307"},
+		// a mark of the same class blocks the composition
+		{"a\u0308\u0301", "\u00e4\u0301"},
+		// a starter in between blocks the composition
+		{"eA\u0301", "e\u00c1"},
+		// singletons and exclusions are never composed
+		{"\u212b", "\u00c5"},
+		{"\u0958", "\u0915\u093c"},
+		{"\u1100\u1161\u11a8", "\uac01"},
+		{"\uac00\u11a8", "\uac01"},
+	}
+	for _, tt := range tests {
+		got, err := cleanName(tt.name)
+		if err != nil {
+			t.Errorf("cleanName(%+q) failed: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("cleanName(%+q) = %+q, want %+q", tt.name, got, tt.want)
+		}
+	}
+
+	for _, name := range []string{"file\x00name", "file\nname", "caf\u00e9\x7f", "\u0085"} {
+		if got, err := cleanName(name); err == nil {
+			t.Errorf("cleanName(%+q) = %+q, want an error", name, got)
+		}
+	}
+}
+
+func TestGetNormalizedName(t *testing.T) {
+	addr, dir := startServer(t, nil)
+	want := []byte("content")
+	if err := os.WriteFile(filepath.Join(dir, "caf\u00e9"), want, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file is found under its precomposed and its decomposed name
+	for _, name := range []string{"caf\u00e9", "cafe\u0301"} {
+		var buf bytes.Buffer
+		if _, err := new(dit.Client).Get(addr, name, &buf); err != nil {
+			t.Fatalf("%+q: %v", name, err)
+		}
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Fatalf("%+q: got %q, want %q", name, buf.Bytes(), want)
+		}
+	}
+
+	var buf bytes.Buffer
+	_, err := new(dit.Client).Get(addr, "caf\u00e9\x01", &buf)
+	if err == nil || !bytes.Contains([]byte(err.Error()), []byte(dit.AccessViolation.String())) {
+		t.Fatalf("name with a control character failed with %v, want %s", err, dit.AccessViolation)
+	}
+}
@@ -1,9 +1,16 @@
 package server
 
 import (
+	"fmt"
 	"io"
+	"io/fs"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
 
 	"github.com/DavidGamba/go-getoptions"
+	"github.com/Joe-Degs/dit"
 )
 
 // Opts are tftpd compatible flags to configure the behaviour of the server
@@ -15,21 +22,76 @@ type Opts struct {
 	Pidfile   string // --pidfile|-p pidfile
 	Verbosity string // --verbosity value
 	Refuse    string // --refuse|-r tftp-option
+	FileMode  string // --file-mode mode
+	Config    string // --config path
+	Health    string // --health-file name
+	AuditLog  string // --audit-log path
+	ForceMode string // --force-mode mode
+	Lock      string // --lock wait|refuse
 
-	BlockSize  int // --blocksize|-B max-block-size
-	Timeout    int // --timeout|-t secs
-	Retransmit int // --restransmit|-T secs
+	Writable []string // --writable dir
+
+	BlockSize   int // --blocksize|-B max-block-size
+	Timeout     int // --timeout|-t secs
+	Retransmit  int // --restransmit|-T secs
+	Workers     int // --workers n
+	Prewarm     int // --prewarm n
+	MaxFileSize int // --max-file-size bytes
+	RecvBuffer  int // --recv-buffer bytes
+	SendBuffer  int // --send-buffer bytes
+	OpenTimeout int // --open-timeout secs
+	IdleTimeout int // --idle-timeout secs
+	Priority    int // --priority n
+	FlushEvery  int // --flush-every blocks
+	MaxRetries  int // --max-retries n
 
-	IPv4       bool // --ipv6|-4
-	IPv6       bool // --ipv4|-6
-	Listen     bool // --listen|-l
-	Foreground bool // --foreground|-L
-	Permissive bool // --permissive|-p
-	Create     bool // --create|-c
-	Verbose    bool // --verbose|-v
-	Version    bool // --version|-V
+	IPv4        bool // --ipv6|-4
+	IPv6        bool // --ipv4|-6
+	Listen      bool // --listen|-l
+	Foreground  bool // --foreground|-L
+	Permissive  bool // --permissive|-p
+	Create      bool // --create|-c
+	NoOverwrite bool // --no-overwrite
+	Sync        bool // --sync
+	Offset      bool // --allow-offset
+	Systemd     bool // --systemd
+	Keepalive   bool // --keepalive
+	ReadOnly    bool // --read-only
+	SinglePort  bool // --single-port
+	Verbose     bool // --verbose|-v
+	Version     bool // --version|-V
 
 	Out, Err io.Writer
+
+	// Authorize is called with every accepted request before its transfer
+	// starts. Returning an error denies the request, the client is sent an
+	// AccessViolation error and the request is dropped
+	Authorize func(remote netip.AddrPort, req *dit.ReadWriteRequest) error
+
+	// Negotiate is called with every option of a request that was added
+	// with dit.RegisterOption. It returns the value to acknowledge and
+	// whether the option is acknowledged at all. Without it registered
+	// options are ignored like unknown ones
+	Negotiate func(req *dit.ReadWriteRequest, opt dit.Option, val int) (int, bool)
+
+	// Virtual is called with every read request before the file is looked
+	// up on disk. It returns the content to send instead and its size, -1
+	// if not known, for serving files that are generated on request like
+	// a boot script per client. Returning a nil reader serves the file from
+	// disk, returning an error sends the client a FileNotFound error or an
+	// AccessViolation error for one that is fs.ErrPermission
+	Virtual func(req *dit.ReadWriteRequest, remote netip.AddrPort) (io.ReadCloser, int64, error)
+
+	// Open is called to open the file at path for a read request or to
+	// create it for a write request in place of the filesystem, for serving
+	// files from other storage or opening them differently. It takes over
+	// everything the server does to files on disk, --create, --no-overwrite
+	// and --sync do not apply and the file is closed whether or not the
+	// transfer succeeded. Errors are reported to the client as FileNotFound,
+	// AccessViolation or FileAlreadyExists when they are fs.ErrNotExist,
+	// fs.ErrPermission or fs.ErrExist. The size of a file is only reported
+	// if it has a Stat method like os.File
+	Open func(path string, op dit.Opcode) (io.ReadWriteCloser, error)
 }
 
 // connection specific configuration variables
@@ -43,10 +105,129 @@ type config struct {
 
 	// never accept specific tftp option
 	Refuse string // --refuse|-r tftp-option
+
+	// permissions of files created by write requests
+	FileMode fs.FileMode // --file-mode mode
+
+	// flush uploaded files to stable storage before closing them
+	Sync bool // --sync
+
+	// honor the non-standard offset option on read requests
+	Offset bool // --allow-offset
+
+	// refuse write requests for files that already exist
+	NoOverwrite bool // --no-overwrite
+
+	// largest number of bytes a single transfer can move, 0 for no limit
+	MaxFileSize int // --max-file-size bytes
+
+	// filename of liveness probes, answered from memory
+	Health string // --health-file name
+
+	// re-acknowledge halfway through the retransmission interval on uploads
+	Keepalive bool // --keepalive
+
+	// seconds to wait for the stat and open of a file, 0 for no limit
+	OpenTimeout int // --open-timeout secs
+
+	// how transfers wait for a file another is writing or reading, empty
+	// for no locking
+	Lock string // --lock wait|refuse
+
+	// seconds a transfer goes without hearing from the client before it is
+	// abandoned
+	IdleTimeout int // --idle-timeout secs
+
+	// directories under the served one write requests are limited to, any
+	// when empty
+	Writable []string // --writable dir
+
+	// times a packet is retransmitted before the transfer is abandoned
+	MaxRetries int // --max-retries n
+
+	// blocks of an upload buffered before they are written to the file, 0
+	// to write them only once the buffer is full
+	FlushEvery int // --flush-every blocks
+
+	// decides on the options added with dit.RegisterOption
+	Negotiate func(req *dit.ReadWriteRequest, opt dit.Option, val int) (int, bool)
+
+	// supplies generated content for read requests
+	Virtual func(req *dit.ReadWriteRequest, remote netip.AddrPort) (io.ReadCloser, int64, error)
+
+	// opens files in place of the filesystem
+	Open func(path string, op dit.Opcode) (io.ReadWriteCloser, error)
+}
+
+func (o Opts) connConfig() (config, error) {
+	mode, err := strconv.ParseUint(o.FileMode, 8, 32)
+	if err != nil || fs.FileMode(mode)&^fs.ModePerm != 0 {
+		return config{}, fmt.Errorf("invalid file mode '%s'", o.FileMode)
+	}
+	if o.ForceMode != "" {
+		if _, err := dit.ParseMode(o.ForceMode); err != nil {
+			return config{}, fmt.Errorf("invalid transfer mode '%s'", o.ForceMode)
+		}
+	}
+	if o.Lock != "" && o.Lock != lockWait && o.Lock != lockRefuse {
+		return config{}, fmt.Errorf("invalid lock behavior '%s', expected %s or %s", o.Lock, lockWait, lockRefuse)
+	}
+	if o.Refuse != "" && dit.MarshalOpts(o.Refuse) == dit.Unknown {
+		return config{}, fmt.Errorf("invalid option '%s' to refuse", o.Refuse)
+	}
+	if o.MaxRetries < 0 {
+		return config{}, fmt.Errorf("invalid number of retries %d", o.MaxRetries)
+	}
+	if o.FlushEvery < 0 {
+		return config{}, fmt.Errorf("invalid flush interval %d", o.FlushEvery)
+	}
+	if o.BlockSize != 0 && (o.BlockSize < 8 || o.BlockSize > maxBlksize) {
+		return config{}, fmt.Errorf("invalid block size %d, expected 8-%d", o.BlockSize, maxBlksize)
+	}
+	idle := o.IdleTimeout
+	if idle <= 0 {
+		idle = o.Timeout
+	}
+	return config{
+		o.BlockSize, o.Timeout, o.Retransmit, o.Create, o.Refuse,
+		fs.FileMode(mode), o.Sync, o.Offset, o.NoOverwrite, o.MaxFileSize,
+		o.Health, o.Keepalive, o.OpenTimeout, o.Lock, idle, o.Writable, o.MaxRetries, o.FlushEvery,
+		o.Negotiate, o.Virtual, o.Open,
+	}, nil
 }
 
-func (o Opts) connConfig() config {
-	return config{o.BlockSize, o.Timeout, o.Retransmit, o.Create, o.Refuse}
+// boundOpts are the options applied once when the server starts, to its socket
+// and the rest of it. Changing any of them takes a restart
+type boundOpts struct {
+	Address, PortRange, User, Pidfile, Verbosity, AuditLog string
+
+	Workers, Prewarm, RecvBuffer, SendBuffer, Priority int
+
+	IPv4, IPv6, Listen, Foreground, Systemd, SinglePort, Verbose bool
+}
+
+func (o *Opts) bound() boundOpts {
+	return boundOpts{
+		o.Address, o.PortRange, o.User, o.Pidfile, o.Verbosity, o.AuditLog,
+		o.Workers, o.Prewarm, o.RecvBuffer, o.SendBuffer, o.Priority,
+		o.IPv4, o.IPv6, o.Listen, o.Foreground, o.Systemd, o.SinglePort, o.Verbose,
+	}
+}
+
+// logLevel returns the logging level from --verbosity, --verbose raises it to
+// atleast the debug level
+func (o Opts) logLevel() (int, error) {
+	level := levelInfo
+	if o.Verbosity != "" {
+		var err error
+		if level, err = strconv.Atoi(o.Verbosity); err != nil || level < levelQuiet || level > levelTrace {
+			return 0, fmt.Errorf("invalid verbosity '%s'", o.Verbosity)
+		}
+	}
+	if o.Verbose && level < levelDebug {
+		level = levelDebug
+	}
+	return level, nil
 }
 
 func NewOpts() (*Opts, *getoptions.GetOpt) {
@@ -59,17 +240,34 @@ func NewOpts() (*Opts, *getoptions.GetOpt) {
 	opt.Bool("help", false, opt.Alias("h", "?"))
 
 	// options accepting string values
-	opt.StringVar(&opts.Address, "address", ":69", opt.Alias("a"), opt.Description("specify specific address and port to listen to when called with --listen or --foreground. the default is to listen on the tftp port specified in /etc/services on all local interfaces"))
+	opt.StringVar(&opts.Address, "address", ":tftp", opt.Alias("a"), opt.Description("specify specific address and port to listen to when called with --listen or --foreground. the address can be a host name and the port a service name from /etc/services, a missing port is the tftp port. the default is to listen on the tftp port on all local interfaces"))
 	opt.StringVar(&opts.PortRange, "port-range", "", opt.Alias("R"), opt.Description("Force the designated server port number (TID) to be in specififed range"))
 	opt.StringVar(&opts.Secure, "secure", "/srv/tftp", opt.Alias("s"), opt.Description("Change the root sdirectory at server startup and serve/write files only fromt this directory. All paths are relative to the specified directory"))
 	opt.StringVar(&opts.User, "user", "nobody", opt.Alias("u"), opt.Description("specify the username which the server will run as; the default is \"nobody\""))
 	opt.StringVar(&opts.Pidfile, "pidfile", "", opt.Alias("P"), opt.Description("Write the process id of server to pidfile. Delete said pidfile during normal termination (SIGINT, SIGTERM)"))
-	opt.StringVar(&opts.Verbosity, "verbosity", "", opt.Description("Set the verbosity level"))
-	opt.StringVar(&opts.Refuse, "refuse", "", opt.Alias("r"), opt.Description("Specify which TFTP option from rfc2347 should be ignored"))
+	opt.StringVar(&opts.Verbosity, "verbosity", "", opt.Description("Set the verbosity level: 0 logs only errors, 1 adds informational messages, 2 adds request details and 3 traces every packet of a transfer. The default is 1"))
+	opt.StringVar(&opts.Refuse, "refuse", "", opt.Alias("r"), opt.Description("Specify which TFTP option from rfc2347 should be ignored, it is left out of option acknowledgements like an option the server does not know"))
+	opt.StringVar(&opts.Config, "config", "", opt.Description("Read options from a file of key=value lines, with the long option names as keys. Blank lines and lines starting with # are ignored, boolean options take true or false. Options on the command line override the ones in the file"))
+	opt.StringVar(&opts.Health, "health-file", "", opt.Description("Answer read requests for this filename with a canned response without touching the filesystem, so load balancers and orchestrators can probe the server. Disabled by default"))
+	opt.StringVar(&opts.AuditLog, "audit-log", "", opt.Description("Append a line for every completed or failed transfer to this file, with the time, client address, request, bytes moved, duration and result. The file is separate from the operational log"))
+	opt.StringVar(&opts.ForceMode, "force-mode", "", opt.Description("Serve every transfer in this mode, octet, netascii or mail, whatever mode the client asks for. Forcing octet keeps binaries from being treated as text. By default the mode of the client is used"))
+	opt.StringVar(&opts.Lock, "lock", "", opt.Description("Lock files for the duration of a transfer, a write request excluding all other transfers of the file and read requests only writes. With wait a transfer waits for the file to be free, with refuse the client is sent an error. Uploads replace files whole when the directory is writable, so without locking readers do not see a partial upload but may get the file as it was before it. Uploads to files in directories the server can not write to, to files with several hard links and new files with --no-overwrite are written in place"))
+	opt.StringVar(&opts.FileMode, "file-mode", "0644", opt.Description("Permissions in octal of files created when called with --create. The process umask is applied on top of it"))
 
 	// options accepting integer values
-	opt.IntVar(&opts.BlockSize, "blocksize", 0, opt.Alias("B"), opt.Description("specify the maximum permitted block size. values in the range 512-65464 inclusive are permitted. a reasonable value is MTU - 32"))
-	opt.IntVar(&opts.Timeout, "timeout", 900, opt.Alias("t"), opt.Description("Specify how long , in seconds to wait for a second request before terminating the connection"))
+	opt.IntVar(&opts.Workers, "workers", 0, opt.Description("Handle requests with a fixed number of workers. New requests wait for a free worker when all are busy, as many as there are workers. Requests beyond that are refused with a server busy error. The default of 0 handles every request as soon as it is accepted"))
+	opt.IntVar(&opts.MaxFileSize, "max-file-size", 0, opt.Description("Largest file in bytes a transfer can move. Write requests going past it are aborted with a disk full error and the partial file is removed, read requests are aborted. The default of 0 is no limit"))
+	opt.IntVar(&opts.OpenTimeout, "open-timeout", 0, opt.Description("Seconds to wait for the filesystem to stat and open the file of a request. A client whose file takes longer, on a hung network filesystem for example, is sent an error. The default of 0 waits forever"))
+	opt.IntVar(&opts.IdleTimeout, "idle-timeout", 0, opt.Description("Seconds a transfer can go without a packet from the client before it is abandoned, so clients that vanish do not hold on to a connection. The default of 0 uses the value of --timeout, with both 0 a client is only given up on after --max-retries retransmissions"))
+	opt.IntVar(&opts.RecvBuffer, "recv-buffer", 0, opt.Description("Size in bytes of the kernel receive buffer (SO_RCVBUF) of the listening and reply sockets. Raise it when packets are dropped under load, the system may cap it. The default of 0 keeps the system default"))
+	opt.IntVar(&opts.SendBuffer, "send-buffer", 0, opt.Description("Size in bytes of the kernel send buffer (SO_SNDBUF) of the listening and reply sockets. The default of 0 keeps the system default"))
+	opt.StringSliceVar(&opts.Writable, "writable", 1, 1, opt.Description("Accept write requests only for files in this directory, relative to the --secure directory, and refuse the others with an access violation. Repeat it to allow several directories. By default files can be written anywhere"))
+	opt.IntVar(&opts.MaxRetries, "max-retries", maxBlockRetries, opt.Description("Number of times a packet that is not answered within the --retransmit interval is sent again before the transfer is abandoned. Raise it for lossy links, lower it to give up on unresponsive clients sooner, 0 never sends a packet again"))
+	opt.IntVar(&opts.FlushEvery, "flush-every", 0, opt.Description("Write the data of uploads to the file every this many blocks instead of once the write buffer is full, so a large upload to a slow disk reaches it steadily instead of piling up in memory. The server acknowledges block by block, so the count is not affected by the windowsize of the client. 0 writes only when the buffer is full"))
+	opt.IntVar(&opts.Priority, "priority", 0, opt.Description("Socket priority (SO_PRIORITY) of the listening socket, on platforms that support it. Linux allows 0-6, higher values need CAP_NET_ADMIN. The default of 0 leaves it unset"))
+	opt.IntVar(&opts.Prewarm, "prewarm", 0, opt.Description("Bind this many reply sockets ahead of time so accepting a request does not wait on creating one. Useful for bursts of requests like PXE boot storms"))
+	opt.IntVar(&opts.BlockSize, "blocksize", 0, opt.Alias("B"), opt.Description("specify the maximum permitted block size. values in the range 8-65464 inclusive allowed by rfc2348 are permitted, blocks smaller than the default of 512 are only used when a client asks for them. a reasonable value is MTU - 32. The default of 0 grants up to 1468, the largest block that fits an ethernet frame without IP fragmentation. Set it to go higher on networks that allow larger frames"))
+	opt.IntVar(&opts.Timeout, "timeout", 900, opt.Alias("t"), opt.Description("Seconds a transfer may take in total before it is abandoned, however busy the client keeps it. Raise it to serve files that take longer than that to move, 0 sets no limit. It is also the default of --idle-timeout. The retransmission timeout is set with --retransmit"))
 	opt.IntVar(&opts.Retransmit, "retransmit", 1000000, opt.Alias("T"), opt.Description("Determine the default timeout in microseconds before the first packet is retransmitted. It can be modified by the client during option negotiation"))
 
 	// boolean options
@@ -79,13 +277,88 @@ func NewOpts() (*Opts, *getoptions.GetOpt) {
 	opt.BoolVar(&opts.Foreground, "foreground", false, opt.Alias("L"), opt.Description("Same as --listen but do not detach process from foreground"))
 	opt.BoolVar(&opts.Permissive, "permissive", false, opt.Alias("p"), opt.Description("perform no additional permission checks above the normal system-provided access controls from the user specified via the --user option"))
 	opt.BoolVar(&opts.Create, "create", false, opt.Alias("c"), opt.Description("Allow new files to be created. By default, the server only allows for existing files to be updated"))
+	opt.BoolVar(&opts.NoOverwrite, "no-overwrite", false, opt.Description("Refuse write requests for files that already exist. Combined with --create the server only accepts new files"))
+	opt.BoolVar(&opts.Sync, "sync", false, opt.Description("Flush uploaded files to stable storage before closing them. This makes write requests durable at the cost of slower transfers, since every upload waits on the disk"))
+	opt.BoolVar(&opts.Offset, "allow-offset", false, opt.Description("Allow clients to resume interrupted downloads with the non-standard offset option. The transfer starts from the requested byte offset of the file"))
+	opt.BoolVar(&opts.ReadOnly, "read-only", false, opt.Description("Refuse every write request with an access violation before touching the filesystem, for servers that only hand out files. This overrides --create"))
+	opt.BoolVar(&opts.SinglePort, "single-port", false, opt.Description("Reply to every client from the port of the server instead of a new port (TID) per transfer, telling transfers apart by the address of the client. This is not what RFC1350 specifies, it is for networks whose firewalls only let through the port of the server. A client gets one transfer at a time and --prewarm has no effect"))
+	opt.BoolVar(&opts.Keepalive, "keepalive", false, opt.Description("While recieving a file, send the last acknowledgement again halfway through the --retransmit interval when no data arrives, to nudge a stalled client on lossy links before the retransmission is due"))
+	opt.BoolVar(&opts.Systemd, "systemd", false, opt.Description("Listen on the socket passed by systemd socket activation (LISTEN_FDS) instead of binding --address"))
 	opt.BoolVar(&opts.Verbose, "verbose", false, opt.Alias("v"), opt.Description("Verbose output"))
 	opt.BoolVar(&opts.Version, "version", false, opt.Alias("V"), opt.Description("Print out version of server and exit"))
 
 	return &opts, opt
 }
 
+// parseArgs parses args into Opts, merging in the options of the --config
+// file. The flags of args are parsed after the options of the file, so they
+// take precedence
+func parseArgs(args []string) (*Opts, *getoptions.GetOpt, error) {
+	opts, getopt := NewOpts()
+	if _, err := getopt.Parse(args); err != nil || opts.Config == "" {
+		return opts, getopt, err
+	}
+
+	fileArgs, err := configArgs(opts.Config)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts, getopt = NewOpts()
+	if _, err := getopt.Parse(append(fileArgs, args...)); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", opts.Config, err)
+	}
+	return opts, getopt, nil
+}
+
+// configArgs reads a config file of key=value lines into the flags they stand
+// for
+func configArgs(name string) ([]string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var args []string
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, val, ok := strings.Cut(line, "=")
+		key, val = strings.TrimSpace(key), strings.TrimSpace(val)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%s:%d: expected key=value", name, i+1)
+		}
+		if key == "config" {
+			return nil, fmt.Errorf("%s:%d: config files can not include others", name, i+1)
+		}
+
+		// boolean flags are given as true or false, whatever spelling of
+		// them the file uses, so --flag=false on the command line can turn
+		// off what the file turned on
+		if b, err := strconv.ParseBool(val); err == nil && isBoolOpt(key) {
+			val = strconv.FormatBool(b)
+		}
+		args = append(args, fmt.Sprintf("--%s=%s", key, val))
+	}
+	return args, nil
+}
+
+// isBoolOpt reports whether name is a boolean option of the server
+func isBoolOpt(name string) bool {
+	_, getopt := NewOpts()
+	_, ok := getopt.Value(name).(bool)
+	return ok
+}
+
 func (o *Opts) outputs(out, err io.Writer) {
 	o.Out = out
 	o.Err = err
 }
+
+// inherit carries over the options of from that can not be set on the command
+// line or in a config file, the outputs and hooks of the server
+func (o *Opts) inherit(from *Opts) {
+	o.outputs(from.Out, from.Err)
+	o.Authorize, o.Negotiate, o.Virtual, o.Open = from.Authorize, from.Negotiate, from.Virtual, from.Open
+}
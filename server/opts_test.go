@@ -0,0 +1,90 @@
+package server
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Joe-Degs/dit"
+)
+
+func TestParseArgsConfig(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "tftpd.conf")
+	file := "# options of the test\ncreate = yes\nsync=false\nblocksize=1024\nverbosity = 2\n"
+	if err := os.WriteFile(config, []byte(file), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		args   []string
+		before bool // args come before --config
+		want   func(o *Opts) bool
+	}{
+		{"file over defaults", nil, false, func(o *Opts) bool {
+			return o.Create && !o.Sync && o.BlockSize == 1024 && o.Verbosity == "2" && o.Timeout == 900
+		}},
+		{"flag turns off file boolean", []string{"--create=false"}, false, func(o *Opts) bool {
+			return !o.Create && o.BlockSize == 1024
+		}},
+		{"flag turns on file boolean", []string{"--sync"}, false, func(o *Opts) bool {
+			return o.Create && o.Sync
+		}},
+		{"flag over file value", []string{"-B", "2048", "--verbosity=0"}, false, func(o *Opts) bool {
+			return o.BlockSize == 2048 && o.Verbosity == "0" && o.Create
+		}},
+		{"flag before --config", []string{"--blocksize=512", "--create=false"}, true, func(o *Opts) bool {
+			return o.BlockSize == 512 && !o.Create
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"--config", config}, tt.args...)
+			if tt.before {
+				args = append(tt.args, "--config", config)
+			}
+			o, _, err := parseArgs(args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.want(o) {
+				t.Errorf("parsed %v into create=%v sync=%v blocksize=%d verbosity=%q", args,
+					o.Create, o.Sync, o.BlockSize, o.Verbosity)
+			}
+		})
+	}
+}
+
+func TestListenAddress(t *testing.T) {
+	for _, tt := range []struct {
+		addr, want string
+	}{
+		{":tftp", ":69"},
+		{"localhost:tftp", "localhost:69"},
+		{"localhost", "localhost:69"},
+		{"127.0.0.1", "127.0.0.1:69"},
+		{"[::1]", "[::1]:69"},
+		{"[::1]:1069", "[::1]:1069"},
+		{":0", ":0"},
+	} {
+		got, err := listenAddress(tt.addr)
+		if err != nil {
+			t.Errorf("listenAddress(%q): %v", tt.addr, err)
+		} else if got != tt.want {
+			t.Errorf("listenAddress(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+	for _, addr := range []string{":no-such-service", "no-such-host.invalid:69"} {
+		if got, err := listenAddress(addr); err == nil {
+			t.Errorf("listenAddress(%q) = %q, want an error", addr, got)
+		}
+	}
+
+	// a server listens on a host name
+	addr, _ := startServer(t, func(o *Opts) { o.Address = "localhost:0" })
+	if _, err := new(dit.Client).Get(addr, "missing", io.Discard); err == nil || !strings.Contains(err.Error(), dit.FileNotFound.String()) {
+		t.Fatalf("server listening on localhost answered with %v, want %s", err, dit.FileNotFound)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build linux
+
+package server
+
+import "golang.org/x/sys/unix"
+
+// setPriority sets the SO_PRIORITY of the socket fd, the queue its packets
+// leave through. Linux takes 0-6 from anyone, higher needs CAP_NET_ADMIN
+func setPriority(fd uintptr, prio int) error {
+	if prio == 0 {
+		return nil
+	}
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_PRIORITY, prio)
+}
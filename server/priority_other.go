@@ -0,0 +1,8 @@
+//go:build !linux
+
+package server
+
+// setPriority does nothing, socket priority is not supported on this platform
+func setPriority(fd uintptr, prio int) error {
+	return nil
+}
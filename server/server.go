@@ -1,12 +1,15 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"net"
+	"net/netip"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -17,17 +20,64 @@ import (
 
 type server struct {
 	*dit.Conn
-	log        *logger
-	opts       *Opts
-	nextId     *atomic.Int64
-	dir        string
-	closed     chan bool
-	connParams config
+	log    *logger
+	nextId *atomic.Int64
+	closed chan bool
+	stats  *metrics
+	audit  *auditLog
+	locks  *fileLocks
+
+	// options the server started with, the ones applied to the listener
+	// and the rest of the server only once are read from here
+	opts *Opts
+
+	// options applied to every request, swapped by a reload. transfers
+	// keep the ones they started with
+	cur atomic.Pointer[settings]
+
+	// command line the server was started with, read again on reload
+	args []string
 
 	// connection pool
 	pool sync.Pool
+
+	// transfers in progress and when they were requested, see duplicate
+	inflightMu sync.Mutex
+	inflight   map[requestKey]time.Time
+
+	// transfers in progress by id, for CancelTransfer. the Conn of a
+	// transfer is kept apart from its srvconn, which lets go of it when the
+	// transfer ends
+	activeMu sync.Mutex
+	active   map[int64]activeConn
+}
+
+// settings are the options a server applies to each request, which can be
+// changed while it runs
+type settings struct {
+	opts *Opts
+	dir  string
+	cfg  config
+}
+
+type activeConn struct {
+	sconn *srvconn
+	conn  *dit.Conn
+}
+
+// requestKey tells requests for the same transfer apart from the rest. a
+// client retransmitting its request sends it again from the same port, so
+// the port is part of it and clients behind a NAT are not confused
+type requestKey struct {
+	peer netip.AddrPort
+	op   dit.Opcode
+	file string
 }
 
+// requests repeated within dupWindow of one still in progress are
+// retransmissions of it
+const dupWindow = 5 * time.Second
+
 // newServer returns a new tftp server
 func newServer(opts *Opts) (*server, error) {
 	abs, err := filepath.Abs(opts.Secure)
@@ -39,123 +89,458 @@ func newServer(opts *Opts) (*server, error) {
 		return nil, fmt.Errorf("directory '%s' does not exist", opts.Secure)
 	}
 
-	verbose = opts.Verbose
+	level, err := opts.logLevel()
+	if err != nil {
+		return nil, err
+	}
 
-	conn, err := udpListen(opts.Address)
+	params, err := opts.connConfig()
 	if err != nil {
 		return nil, err
 	}
+
+	if opts.Priority < 0 {
+		return nil, fmt.Errorf("invalid socket priority %d", opts.Priority)
+	}
+
+	var conn *dit.Conn
+	if opts.Systemd {
+		conn, err = systemdListen()
+	} else {
+		var addr string
+		if addr, err = listenAddress(opts.Address); err != nil {
+			return nil, err
+		}
+		conn, err = udpListen(addr, opts.Priority)
+	}
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return nil, fmt.Errorf("address %s is already in use, another server may be running on it. stop it or listen on another port with --address: %w", opts.Address, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// reply sockets get the buffer sizes of the listener, so they are set
+	// before any are prewarmed
+	if err := conn.SetBuffers(opts.RecvBuffer, opts.SendBuffer); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if opts.SinglePort {
+		if err := conn.SetSinglePort(true); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	} else if opts.Prewarm > 0 {
+		if err := conn.PrewarmSockets(opts.Prewarm); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	var audit *auditLog
+	if opts.AuditLog != "" {
+		if audit, err = openAuditLog(opts.AuditLog); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
 	s := &server{
-		Conn:       conn,
-		opts:       opts,
-		nextId:     &atomic.Int64{},
-		log:        newlogger("ditserver", opts.Out, opts.Err),
-		closed:     make(chan bool),
-		dir:        abs,
-		connParams: opts.connConfig(),
+		Conn:     conn,
+		opts:     opts,
+		nextId:   &atomic.Int64{},
+		log:      newlogger("ditserver", level, opts.Out, opts.Err),
+		closed:   make(chan bool),
+		stats:    &metrics{},
+		audit:    audit,
+		inflight: make(map[requestKey]time.Time),
+		active:   make(map[int64]activeConn),
+		locks:    newFileLocks(),
 	}
+	s.cur.Store(&settings{opts, abs, params})
 	s.pool = sync.Pool{
 		New: func() any {
-			return newsrvconn(s.dir, s.log, s.connParams)
+			st := s.cur.Load()
+			return newsrvconn(st.dir, s.log, st.cfg, s.stats, s.audit, s.locks)
 		},
 	}
 	return s, nil
 }
 
+// reload parses the command line of the server again, reading its config file
+// anew, and applies the options to the requests accepted from then on. It
+// reports false without applying anything if an option changed that takes
+// effect only when the server starts, like the address it listens on
+func (s *server) reload() (bool, error) {
+	next, _, err := parseArgs(s.args)
+	if err != nil {
+		return false, err
+	}
+	cur := s.cur.Load()
+	if next.bound() != cur.opts.bound() {
+		return false, nil
+	}
+	abs, err := filepath.Abs(next.Secure)
+	if err != nil {
+		return false, err
+	}
+	if !dirExists(abs) {
+		return false, fmt.Errorf("directory '%s' does not exist", next.Secure)
+	}
+	params, err := next.connConfig()
+	if err != nil {
+		return false, err
+	}
+	next.inherit(cur.opts)
+	s.cur.Store(&settings{next, abs, params})
+	return true, nil
+}
+
 func (s *server) newconn(conn *dit.Conn) (*srvconn, error) {
 	sconn := s.pool.Get().(*srvconn)
 	sconn.Conn = conn
+	// a recycled srvconn may predate a reload
+	st := s.cur.Load()
+	sconn.dir, sconn.cfg = st.dir, st.cfg
+	sconn.id = s.nextId.Add(1)
+	sconn.cancelled.Store(false)
+
+	s.activeMu.Lock()
+	s.active[sconn.id] = activeConn{sconn, conn}
+	s.activeMu.Unlock()
 	return sconn, nil
 }
 
+// cancel aborts the transfer with id, reporting whether it was in progress.
+// The transfer is woken from waiting on the client and sends it the error
+// itself, so nothing else writes to its connection
+func (s *server) cancel(id int64) bool {
+	s.activeMu.Lock()
+	defer s.activeMu.Unlock()
+	a, ok := s.active[id]
+	if !ok {
+		return false
+	}
+	a.sconn.cancelled.Store(true)
+	a.conn.SetReadDeadline(0)
+	return true
+}
+
+// duplicate reports whether req from peer repeats a request whose transfer
+// started less than dupWindow ago and is still going. A client sends its
+// request again when the first answer of the server is lost, starting a
+// second transfer for it would have two of them racing for the client
+func (s *server) duplicate(peer netip.AddrPort, req *dit.ReadWriteRequest) (requestKey, bool) {
+	key := requestKey{peer, req.Opcode, req.Filename}
+	s.inflightMu.Lock()
+	defer s.inflightMu.Unlock()
+	if began, ok := s.inflight[key]; ok && time.Since(began) < dupWindow {
+		return key, true
+	}
+	s.inflight[key] = time.Now()
+	return key, false
+}
+
+// done forgets the transfer of key, requests for it start a new one again
+func (s *server) done(key requestKey) {
+	s.inflightMu.Lock()
+	defer s.inflightMu.Unlock()
+	delete(s.inflight, key)
+}
+
+// putconn recycles a srvconn whose transfer is over. The socket of the
+// transfer must not outlive it, so one still held is closed and let go of
 func (s *server) putconn(sconn *srvconn) {
+	if sconn.Conn != nil {
+		s.log.Verbose("recycled connection still open, closing it")
+		sconn.end()
+	}
 	s.pool.Put(sconn)
 }
 
+// Close stops the server from accepting requests and closes the audit log
+func (s *server) Close() error {
+	err := s.Conn.Close()
+	if aerr := s.audit.Close(); err == nil {
+		err = aerr
+	}
+	return err
+}
+
+// Snapshot returns the current values of the server counters
+func (s *server) Snapshot() Metrics {
+	return s.stats.snapshot()
+}
+
+// start serves requests and handles the signals sent to the process until a
+// termination signal shuts the server down, returning why it could not be shut
+// down cleanly
 func (s *server) start() error {
 	cl := make(chan io.Closer)
+	errc := make(chan error, 2)
+	go func() { errc <- s.handleSignals(cl) }()
+	go func() {
+		if err := s.serve(cl); err != nil {
+			errc <- err
+		}
+	}()
+	return <-errc
+}
+
+// serve accepts requests and hands them to connection handlers until the
+// server is closed. A termination signal asks it to pass the server on cl to
+// be closed
+func (s *server) serve(cl chan<- io.Closer) error {
 	cc := make(chan *srvconn)
 
-	go s.handleSignals(cl)
-	s.log.Info("started and running <addr='%s' directory='%s'>", s.Addr(), s.dir)
+	// with a fixed number of workers accepted connections queue up for the
+	// next free worker, otherwise each gets its own goroutine. the accept
+	// loop never waits for a worker, it would stop answering everyone else
+	handle := func(sconn *srvconn) bool { go sconn.start(cc); return true }
+	if n := s.opts.Workers; n > 0 {
+		jobs := make(chan *srvconn, n)
+		for i := 0; i < n; i++ {
+			go func() {
+				for sconn := range jobs {
+					sconn.start(cc)
+				}
+			}()
+		}
+		handle = func(sconn *srvconn) bool {
+			select {
+			case jobs <- sconn:
+				return true
+			default:
+				return false
+			}
+		}
+	}
+
+	s.log.Info("started and running <addr='%s' directory='%s'>", s.Addr(), s.cur.Load().dir)
 
 	go func() {
 		for {
 			conn, err := s.Accept()
 			if err != nil {
-				log.Fatal(err)
+				// accept fails once the listener is closed on shutdown
+				select {
+				case <-s.Done():
+					return
+				default:
+				}
+				// a failed accept only costs the request it was for,
+				// everyone else is still served
+				s.log.Error("accept error: %v", err)
+				continue
 			}
+			s.stats.requests.Add(1)
 			req := conn.Request()
-			s.log.Verbose("recieved %s <file=%s mode=%s> from %s\n", req.Opcode, req.Filename, req.Mode, conn.Addr())
+			opts := s.cur.Load().opts
+			s.log.Verbose("recieved %s <file=%s mode=%s> from %s\n", req.Opcode, req.Filename, req.Mode, conn.Peer())
+
+			// the forced mode replaces the one of the client before anything
+			// looks at the request
+			if mode := strings.ToLower(opts.ForceMode); mode != "" && !strings.EqualFold(req.Mode, mode) {
+				s.log.Info("serving %s <file=%s> as %s, client asked for %s", req.Opcode, req.Filename, mode, req.Mode)
+				req.Mode = mode
+			}
+
+			name, err := cleanName(req.Filename)
+			if err != nil {
+				s.log.Info("refused %s <file=%q> from %s: %v", req.Opcode, req.Filename, conn.Peer(), err)
+				s.stats.countErr(dit.AccessViolation)
+				conn.Abort(dit.AccessViolation, "illegal filename")
+				continue
+			}
+			req.Filename = name
+
+			// a read-only server never opens a file for writing
+			if opts.ReadOnly && req.Opcode == dit.Wrq {
+				s.log.Info("refused %s <file=%s> from %s: server is read-only", req.Opcode, req.Filename, conn.Peer())
+				s.stats.countErr(dit.AccessViolation)
+				conn.Abort(dit.AccessViolation, "server is read-only")
+				continue
+			}
+
+			if auth := opts.Authorize; auth != nil {
+				if err := auth(conn.Peer(), req); err != nil {
+					s.log.Info("denied %s <file=%s> from %s: %v", req.Opcode, req.Filename, conn.Peer(), err)
+					s.stats.countErr(dit.AccessViolation)
+					conn.Abort(dit.AccessViolation, "access denied")
+					continue
+				}
+			}
+
+			// the transfer already answering a retransmitted request
+			// carries on, the retransmission is dropped without a word
+			key, dup := s.duplicate(conn.Peer(), req)
+			if dup {
+				s.log.Verbose("ignored duplicate %s <file=%s> from %s", req.Opcode, req.Filename, conn.Peer())
+				conn.Release()
+				continue
+			}
 
 			// get new connection from pool
 			sconn, err := s.newconn(conn)
 			if err != nil {
 				s.log.Error("failed to init new connection handler: %v\n", err)
-				conn.WriteErr(dit.NotDefined, "failed to create connection")
+				conn.Abort(dit.NotDefined, "failed to create connection")
+				s.done(key)
 				continue
 			}
-			go sconn.start(cc)
+			sconn.key = key
+			if !handle(sconn) {
+				s.log.Info("refused %s <file=%s> from %s: all workers busy", req.Opcode, req.Filename, conn.Peer())
+				s.stats.countErr(dit.NotDefined)
+				_ = sconn.WriteErr(dit.NotDefined, "server busy")
+				cc <- sconn.end()
+			}
 		}
 	}()
 
 	for {
 		select {
 		case <-s.closed:
-			close(cc)
 			cl <- s
-			break
+		case <-s.Done():
+			// transfers still in progress hand back their connection
+			// after the server is gone
+			go func() {
+				for range cc {
+				}
+			}()
+			return nil
 		case conn := <-cc:
+			s.done(conn.key)
+			s.activeMu.Lock()
+			delete(s.active, conn.id)
+			s.activeMu.Unlock()
 			s.putconn(conn)
 		}
 	}
+}
+
+// Start runs a server with opts in the background until the returned stop
+// function is called. It is meant for running the server within another
+// program, the tests of a client for example, so unlike Main it does not
+// handle signals or exit the process. Options not set by the caller should
+// come from NewOpts. The returned address tells the port the server picked
+// when opts.Address has port 0
+func Start(opts *Opts) (addr net.Addr, stop func() error, err error) {
+	srv, err := StartServer(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return srv.Addr(), srv.Close, nil
+}
+
+// Server is a server running in the background, started with StartServer
+type Server struct {
+	s *server
+}
+
+// StartServer is Start, returning the server for managing it while it runs
+func StartServer(opts *Opts) (*Server, error) {
+	if opts.Out == nil {
+		opts.Out = io.Discard
+	}
+	if opts.Err == nil {
+		opts.Err = io.Discard
+	}
+	srv, err := newServer(opts)
+	if err != nil {
+		return nil, err
+	}
+	go srv.serve(nil)
+	return &Server{srv}, nil
+}
+
+// Addr returns the address the server listens on
+func (s *Server) Addr() net.Addr {
+	return s.s.Addr()
+}
+
+// Close stops the server, transfers in progress run to completion
+func (s *Server) Close() error {
+	return s.s.Close()
+}
+
+// Snapshot returns the current values of the server counters
+func (s *Server) Snapshot() Metrics {
+	return s.s.Snapshot()
+}
 
-	return s.Close()
+// CancelTransfer aborts the transfer with id, the number every transfer is
+// logged with when it starts. The client is sent an error and the transfer is
+// cleaned up like a failed one. It reports whether the transfer was in
+// progress
+func (s *Server) CancelTransfer(id int64) bool {
+	return s.s.cancel(id)
 }
 
-func (s *server) handleSignals(shutdownc <-chan io.Closer) {
+// handleSignals reloads the server on SIGHUP and shuts it down on SIGINT and
+// SIGTERM, closing what serve passes on shutdownc. It returns once the server
+// is closed, with an error if closing it failed or took too long
+func (s *server) handleSignals(shutdownc <-chan io.Closer) error {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(c)
 	for {
-		sig := <-c
+		var sig os.Signal
+		select {
+		case sig = <-c:
+		case <-s.Done():
+			return nil
+		}
 		sysSig, ok := sig.(syscall.Signal)
 		if !ok {
-			s.log.Fatal("not a unix signal")
+			s.log.Error("not a unix signal: %v", sig)
+			continue
 		}
 		switch sysSig {
 		case syscall.SIGHUP:
+			// transfers in progress survive a reload, but not a restart
+			// which is only needed to bind the socket again
+			ok, err := s.reload()
+			if err != nil {
+				s.log.Error("failed to reload, keeping the current configuration: %v", err)
+				continue
+			}
+			if ok {
+				s.log.Info(`got "%v" signal: reloaded configuration <directory='%s'>`, sig, s.cur.Load().dir)
+				continue
+			}
 			s.log.Info(`got "%v" signal: restarting server`, sig)
 			if err := restartProcess(); err != nil {
-				s.log.Fatalf("failed to restart process: %v", err)
+				// the running server is still good, keep it
+				s.log.Error("failed to restart process: %v", err)
 			}
 		case syscall.SIGINT, syscall.SIGTERM:
 			s.log.Verbose(`handling termination (%v) signal`, sig)
 			s.closed <- true
 			s.log.Info(`got "%v" signal: shutting down`, sig)
-			donec := make(chan bool)
+			donec := make(chan error, 1)
 			go func() {
 				cl := <-shutdownc
-				if err := cl.Close(); err != nil {
-					s.log.Fatalf("error while shutting down: %v", err)
-				}
-				donec <- true
+				donec <- cl.Close()
 			}()
 			select {
-			case <-donec:
+			case err := <-donec:
+				if err != nil {
+					return fmt.Errorf("error while shutting down: %w", err)
+				}
 				s.log.Info("Goodbye!")
-				os.Exit(0)
+				return nil
 			case <-time.After(2 * time.Second):
-				s.log.Fatal("timedout while trying to shutdown.")
+				return errors.New("timedout while trying to shutdown")
 			}
 		default:
-			s.log.Fatal("recieved another signal, should not happen.")
+			s.log.Error("recieved another signal, should not happen: %v", sig)
 		}
 	}
 }
 
 func Main(args []string, stdout io.Writer, stderr io.Writer) {
-	options, getopt := NewOpts()
-	if _, err := getopt.Parse(args); err != nil {
+	options, getopt, err := parseArgs(args)
+	if err != nil {
 		exitf("failed to parse args: %v", err)
 	}
 	if getopt.Called("help") {
@@ -167,6 +552,7 @@ func Main(args []string, stdout io.Writer, stderr io.Writer) {
 	if err != nil {
 		exitf("failed to init server %v\n", err)
 	}
+	srv.args = args
 
 	if err := srv.start(); err != nil {
 		exitf("failed to start server %v\n", err)
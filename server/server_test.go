@@ -0,0 +1,752 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Joe-Degs/dit"
+)
+
+// startServer starts a server serving a new temporary directory on an
+// ephemeral port of the loopback interface, with set changing its options
+// first if it is not nil. It returns the address of the server and the
+// directory it serves, the server is stopped when the test ends
+func startServer(t testing.TB, set func(*Opts)) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	opts, _ := NewOpts()
+	opts.Secure = dir
+	opts.Address = "127.0.0.1:0"
+	opts.Create = true
+	// lost packets are sent again quickly, tests lose some on purpose
+	opts.Retransmit = 100000
+	if set != nil {
+		set(opts)
+	}
+	addr, stop, err := Start(opts)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	t.Cleanup(func() { stop() })
+	return addr.String(), dir
+}
+
+// randomBytes returns n bytes of noise that compress to nothing
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(b)
+	return b
+}
+
+func TestGetPut(t *testing.T) {
+	addr, dir := startServer(t, nil)
+
+	sizes := []int{0, 1, 511, 512, 513, 1024, 4000, 100 * 1024}
+	for _, blksize := range []int{0, 8, 1024, 1468} {
+		client := &dit.Client{Blksize: blksize}
+		for _, size := range sizes {
+			name := filepath.Join("sub", "file")
+			if err := os.MkdirAll(filepath.Join(dir, "sub"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			want := randomBytes(size)
+
+			n, err := client.Put(addr, name, bytes.NewReader(want))
+			if err != nil {
+				t.Fatalf("blksize %d: put %d bytes: %v", blksize, size, err)
+			}
+			if n != int64(size) {
+				t.Errorf("blksize %d: put %d bytes, sent %d", blksize, size, n)
+			}
+			got, err := os.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("blksize %d: file of %d bytes uploaded as %d bytes that differ", blksize, size, len(got))
+			}
+
+			var buf bytes.Buffer
+			n, err = client.Get(addr, name, &buf)
+			if err != nil {
+				t.Fatalf("blksize %d: get %d bytes: %v", blksize, size, err)
+			}
+			if n != int64(size) || !bytes.Equal(buf.Bytes(), want) {
+				t.Fatalf("blksize %d: file of %d bytes downloaded as %d bytes that differ", blksize, size, buf.Len())
+			}
+		}
+	}
+}
+
+func TestGetMissing(t *testing.T) {
+	addr, _ := startServer(t, nil)
+	var buf bytes.Buffer
+	if _, err := new(dit.Client).Get(addr, "missing", &buf); err == nil {
+		t.Fatal("got a file that does not exist")
+	}
+}
+
+func TestStartAddress(t *testing.T) {
+	addr, _ := startServer(t, nil)
+	if addr == "127.0.0.1:0" {
+		t.Fatalf("Start returned the requested address %s, not the bound one", addr)
+	}
+}
+
+func TestAddressInUse(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("SO_REUSEADDR binds over any socket on windows")
+	}
+	// a socket without SO_REUSEADDR holds the address, the server is refused
+	// it
+	held, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	opts, _ := NewOpts()
+	opts.Secure = t.TempDir()
+	opts.Address = held.LocalAddr().String()
+	opts.outputs(io.Discard, io.Discard)
+	if s, err := newServer(opts); err == nil {
+		s.Close()
+		t.Fatalf("server bound %s held by another socket", opts.Address)
+	} else if !errors.Is(err, syscall.EADDRINUSE) || !strings.Contains(err.Error(), "already in use") {
+		t.Fatalf("got %q, want an address in use error", err)
+	}
+
+	// servers all set SO_REUSEADDR, a second one binds the address of the
+	// first without an error
+	addr, _ := startServer(t, nil)
+	opts.Address = addr
+	s, err := newServer(opts)
+	if err != nil {
+		t.Fatalf("second server on %s: %v", addr, err)
+	}
+	s.Close()
+}
+
+func TestAuthorize(t *testing.T) {
+	// only the loopback host may read, and only the files under boot
+	addr, dir := startServer(t, func(o *Opts) {
+		o.Authorize = func(remote netip.AddrPort, req *dit.ReadWriteRequest) error {
+			if !remote.Addr().IsLoopback() {
+				return fmt.Errorf("%s is not a local client", remote.Addr())
+			}
+			if req.Opcode != dit.Rrq || !strings.HasPrefix(req.Filename, "boot/") {
+				return errors.New("only boot files are served")
+			}
+			return nil
+		}
+	})
+	if err := os.MkdirAll(filepath.Join(dir, "boot"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"boot/kernel", "secret"} {
+		if err := os.WriteFile(filepath.Join(dir, name), randomBytes(100), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client := new(dit.Client)
+	if _, err := client.Get(addr, "boot/kernel", io.Discard); err != nil {
+		t.Fatalf("allowed read failed: %v", err)
+	}
+	if _, err := client.Get(addr, "secret", io.Discard); err == nil || !strings.Contains(err.Error(), dit.AccessViolation.String()) {
+		t.Fatalf("denied read failed with %v, want %s", err, dit.AccessViolation)
+	}
+	if _, err := client.Put(addr, "boot/kernel", bytes.NewReader(randomBytes(10))); err == nil || !strings.Contains(err.Error(), dit.AccessViolation.String()) {
+		t.Fatalf("denied write failed with %v, want %s", err, dit.AccessViolation)
+	}
+}
+
+func TestConcurrentReads(t *testing.T) {
+	addr, dir := startServer(t, nil)
+	want := randomBytes(100 * 1024)
+	if err := os.WriteFile(filepath.Join(dir, "file"), want, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the connections of finished transfers are reused by the next rounds,
+	// every transfer has to read the file from the start all the same
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for round := 0; round < 3; round++ {
+				var buf bytes.Buffer
+				if _, err := new(dit.Client).Get(addr, "file", &buf); err != nil {
+					t.Error(err)
+					return
+				}
+				if !bytes.Equal(buf.Bytes(), want) {
+					t.Errorf("got %d bytes that differ from the %d of the file", buf.Len(), len(want))
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// rawClient speaks the protocol packet by packet, for tests that need to lose,
+// repeat or mangle packets a real client would not
+type rawClient struct {
+	t      testing.TB
+	conn   *net.UDPConn
+	server *net.UDPAddr
+	buf    []byte
+}
+
+func dialRaw(t testing.TB, addr string) *rawClient {
+	t.Helper()
+	server, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &rawClient{t: t, conn: conn, server: server, buf: make([]byte, 65536)}
+}
+
+// send writes p to addr, the address the server listens on if it is nil
+func (c *rawClient) send(p dit.Packet, addr *net.UDPAddr) {
+	c.t.Helper()
+	if addr == nil {
+		addr = c.server
+	}
+	b, err := dit.Unmarshal(p)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if _, err := c.conn.WriteToUDP(b, addr); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// recv waits for the next packet and the address it came from, failing the
+// test if none arrives
+func (c *rawClient) recv() (dit.Packet, *net.UDPAddr) {
+	c.t.Helper()
+	p, addr, err := c.tryRecv(2 * time.Second)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return p, addr
+}
+
+// tryRecv waits up to wait for the next packet
+func (c *rawClient) tryRecv(wait time.Duration) (dit.Packet, *net.UDPAddr, error) {
+	c.conn.SetReadDeadline(time.Now().Add(wait))
+	n, addr, err := c.conn.ReadFromUDP(c.buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	p, err := dit.Marshal(c.buf[:n])
+	return p, addr, err
+}
+
+func TestSinglePortRetransmittedRequest(t *testing.T) {
+	addr, dir := startServer(t, func(o *Opts) { o.SinglePort = true })
+	want := randomBytes(700)
+	if err := os.WriteFile(filepath.Join(dir, "file"), want, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := dialRaw(t, addr)
+	rrq, err := dit.NewRRQ("file", "octet", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.send(rrq, nil)
+	// the first block is lost on its way to the client, which asks again
+	if p, from := c.recv(); from.String() != addr {
+		t.Fatalf("%s came from %s, not the server port %s", dit.Describe(p), from, addr)
+	}
+	c.send(rrq, nil)
+
+	var got []byte
+	for {
+		p, from := c.recv()
+		if from.String() != addr {
+			t.Fatalf("%s came from %s, not the server port %s", dit.Describe(p), from, addr)
+		}
+		data, ok := p.(*dit.DataPacket)
+		if !ok {
+			t.Fatalf("got %s while expecting data", dit.Describe(p))
+		}
+		if int(data.BlockNumber) == len(got)/512+1 {
+			got = append(got, data.Data...)
+		}
+		c.send(dit.NewAck(data.BlockNumber), nil)
+		if data.IsLast(512) {
+			break
+		}
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("recieved %d bytes that differ from the %d of the file", len(got), len(want))
+	}
+}
+
+func TestReload(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no SIGHUP on windows")
+	}
+	dir := t.TempDir()
+	config := filepath.Join(dir, "tftpd.conf")
+	write := func(options string) {
+		file := "secure=" + dir + "\naddress=127.0.0.1:0\ncreate=true\n" + options
+		if err := os.WriteFile(config, []byte(file), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("read-only=true\n")
+
+	args := []string{"--config", config}
+	opts, _, err := parseArgs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.outputs(io.Discard, io.Discard)
+	var authorized atomic.Int64
+	opts.Authorize = func(netip.AddrPort, *dit.ReadWriteRequest) error {
+		authorized.Add(1)
+		return nil
+	}
+	s, err := newServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.args = args
+	errc := make(chan error, 1)
+	cl := make(chan io.Closer)
+	go s.serve(cl)
+	go func() { errc <- s.handleSignals(cl) }()
+	t.Cleanup(func() {
+		s.Close()
+		if err := <-errc; err != nil {
+			t.Error(err)
+		}
+	})
+
+	addr := s.Addr().String()
+	want := randomBytes(700)
+	if _, err := new(dit.Client).Put(addr, "file", bytes.NewReader(want)); err == nil {
+		t.Fatal("read-only server took an upload")
+	}
+
+	// the server reloads the config file on SIGHUP and takes uploads, the
+	// hooks it was started with still apply
+	write("read-only=false\n")
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Signal(syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; s.cur.Load().opts.ReadOnly; i++ {
+		if i == 100 {
+			t.Fatal("server not reloaded after SIGHUP")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := new(dit.Client).Put(addr, "file", bytes.NewReader(want)); err != nil {
+		t.Fatalf("reloaded server refused an upload: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "file")); !bytes.Equal(got, want) {
+		t.Fatal("file is not the uploaded one")
+	}
+	if n := authorized.Load(); n != 1 {
+		t.Fatalf("Authorize called for %d requests after the reload, want 1", n)
+	}
+}
+
+// cancelWriter cancels a transfer once the first block is written to it
+type cancelWriter struct {
+	bytes.Buffer
+	cancel context.CancelFunc
+}
+
+func (w *cancelWriter) Write(b []byte) (int, error) {
+	w.cancel()
+	return w.Buffer.Write(b)
+}
+
+func TestFetch(t *testing.T) {
+	addr, dir := startServer(t, nil)
+	want := randomBytes(100 * 1024)
+	if err := os.WriteFile(filepath.Join(dir, "file"), want, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := dit.Fetch(context.Background(), addr, "file", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("fetched %d bytes that differ from the %d of the file", buf.Len(), len(want))
+	}
+
+	buf.Reset()
+	client := &dit.Client{Blksize: 1024, Retries: 1}
+	if err := client.Fetch(context.Background(), addr, "file", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("blksize 1024: fetched %d bytes that differ from the %d of the file", buf.Len(), len(want))
+	}
+
+	if err := dit.Fetch(context.Background(), addr, "missing", &buf); err == nil {
+		t.Fatal("fetched a file that does not exist")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := dit.Fetch(ctx, addr, "file", &buf); !errors.Is(err, context.Canceled) {
+		t.Fatalf("fetch with a done context returned %v, want %v", err, context.Canceled)
+	}
+
+	// cancelled midway, the transfer stops with the error of the context
+	ctx, cancel = context.WithCancel(context.Background())
+	w := &cancelWriter{cancel: cancel}
+	if err := dit.Fetch(ctx, addr, "file", w); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled fetch returned %v, want %v", err, context.Canceled)
+	}
+	if w.Len() >= len(want) {
+		t.Fatal("cancelled fetch got the whole file")
+	}
+}
+
+func TestPrewarmReplyAddress(t *testing.T) {
+	addr, dir := startServer(t, func(o *Opts) {
+		o.Address = "0.0.0.0:0"
+		o.Prewarm = 2
+	})
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rrq, err := dit.NewRRQ("file", "octet", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server listens on all interfaces, replies come from the address
+	// the request was sent to whether their socket was prewarmed or not
+	for i := 0; i < 4; i++ {
+		c := dialRaw(t, net.JoinHostPort("127.0.0.2", port))
+		c.send(rrq, nil)
+		p, from := c.recv()
+		if !from.IP.Equal(net.IPv4(127, 0, 0, 2)) {
+			t.Fatalf("request %d: %s came from %s, want 127.0.0.2", i, dit.Describe(p), from)
+		}
+		c.send(dit.NewAck(1), from)
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestWorkersBusy(t *testing.T) {
+	addr, dir := startServer(t, func(o *Opts) {
+		o.Workers = 1
+		o.Retransmit = 5000000
+	})
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rrq, err := dit.NewRRQ("file", "octet", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the only worker waits for the first client, the second waits for the
+	// worker and the third is turned away
+	first, second, third := dialRaw(t, addr), dialRaw(t, addr), dialRaw(t, addr)
+	first.send(rrq, nil)
+	_, tid := first.recv()
+	second.send(rrq, nil)
+	if p, _, err := second.tryRecv(100 * time.Millisecond); err == nil {
+		t.Fatalf("queued request answered with %s while the worker is busy", dit.Describe(p))
+	}
+	third.send(rrq, nil)
+	busy, _ := dit.NewError(dit.NotDefined, "server busy")
+	third.expect(busy)
+
+	first.send(dit.NewAck(1), tid)
+	if p, _ := second.recv(); dit.Describe(p) != dit.Describe(data(t, 1, []byte("content"))) {
+		t.Fatalf("queued request answered with %s, want the file", dit.Describe(p))
+	}
+}
+
+// BenchmarkFirstBlock measures how long the server takes from recieving a
+// request to sending the first block of the file
+func BenchmarkFirstBlock(b *testing.B) {
+	for _, prewarm := range []int{0, 16} {
+		b.Run(fmt.Sprintf("prewarm=%d", prewarm), func(b *testing.B) {
+			addr, dir := startServer(b, func(o *Opts) { o.Prewarm = prewarm })
+			if err := os.WriteFile(filepath.Join(dir, "file"), []byte("content"), 0o644); err != nil {
+				b.Fatal(err)
+			}
+			rrq, err := dit.NewRRQ("file", "octet", nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// every request comes from a new port, the server takes
+				// one from a port it is still serving for a retransmission
+				b.StopTimer()
+				c := dialRaw(b, addr)
+				b.StartTimer()
+				c.send(rrq, nil)
+				_, tid := c.recv()
+				b.StopTimer()
+				c.send(dit.NewAck(1), tid)
+				c.conn.Close()
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+func TestPutconnClosesSocket(t *testing.T) {
+	opts, _ := NewOpts()
+	opts.Secure = t.TempDir()
+	opts.Address = "127.0.0.1:0"
+	opts.outputs(io.Discard, io.Discard)
+	s, err := newServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conn, err := dit.Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sconn, err := s.newconn(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a srvconn recycled without ending its transfer lets go of its socket
+	s.putconn(sconn)
+	if sconn.Conn != nil {
+		t.Fatal("recycled srvconn still holds its Conn")
+	}
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("read on the socket of a recycled srvconn: %v, want it closed", err)
+	}
+}
+
+func TestDuplicateRequest(t *testing.T) {
+	addr, dir := startServer(t, nil)
+	want := randomBytes(100)
+	if err := os.WriteFile(filepath.Join(dir, "file"), want, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the request is sent again before the first block comes back, as if
+	// it were lost
+	c := dialRaw(t, addr)
+	rrq, err := dit.NewRRQ("file", "octet", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.send(rrq, nil)
+	c.send(rrq, nil)
+
+	// retransmissions of the first block all come from the one transfer
+	_, tid := c.recv()
+	for {
+		p, from, err := c.tryRecv(300 * time.Millisecond)
+		if err != nil {
+			break
+		}
+		if from.String() != tid.String() {
+			t.Fatalf("got %s from %s, a second transfer next to %s", dit.Describe(p), from, tid)
+		}
+	}
+	c.send(dit.NewAck(1), tid)
+}
+
+func TestVirtual(t *testing.T) {
+	addr, dir := startServer(t, func(o *Opts) {
+		o.Virtual = func(req *dit.ReadWriteRequest, remote netip.AddrPort) (io.ReadCloser, int64, error) {
+			switch req.Filename {
+			case "disk":
+				return nil, 0, nil
+			case "secret":
+				return nil, 0, fs.ErrPermission
+			case "missing":
+				return nil, 0, errors.New("no script for this client")
+			}
+			script := fmt.Sprintf("#!ipxe\nchain %s for %s\n", req.Filename, remote.Addr())
+			return io.NopCloser(strings.NewReader(script)), int64(len(script)), nil
+		}
+	})
+	want := randomBytes(700)
+	if err := os.WriteFile(filepath.Join(dir, "disk"), want, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	client := new(dit.Client)
+	var buf bytes.Buffer
+	if _, err := client.Get(addr, "boot.ipxe", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != "#!ipxe\nchain boot.ipxe for 127.0.0.1\n" {
+		t.Fatalf("got generated file %q", got)
+	}
+
+	// without content from the hook the file on disk is served
+	buf.Reset()
+	if _, err := client.Get(addr, "disk", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatal("file on disk not served when the hook has no content for it")
+	}
+
+	for file, code := range map[string]dit.ErrorCode{"secret": dit.AccessViolation, "missing": dit.FileNotFound} {
+		_, err := client.Get(addr, file, io.Discard)
+		if err == nil || !strings.Contains(err.Error(), code.String()) {
+			t.Errorf("download of %s failed with %v, want %s", file, err, code)
+		}
+	}
+}
+
+func TestCancelTransfer(t *testing.T) {
+	dir := t.TempDir()
+	opts, _ := NewOpts()
+	opts.Secure = dir
+	opts.Address = "127.0.0.1:0"
+	opts.Retransmit = 100000
+	opts.outputs(io.Discard, io.Discard)
+	srv, err := StartServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	if err := os.WriteFile(filepath.Join(dir, "file"), randomBytes(100*1024), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if srv.CancelTransfer(1) {
+		t.Fatal("cancelled a transfer before any started")
+	}
+
+	// the first transfer of the server has id 1
+	c := dialRaw(t, srv.Addr().String())
+	rrq, err := dit.NewRRQ("file", "octet", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.send(rrq, nil)
+	c.recv()
+	if !srv.CancelTransfer(1) {
+		t.Fatal("transfer in progress not cancelled")
+	}
+	for {
+		p, _ := c.recv()
+		if e, ok := p.(*dit.ErrorPacket); ok {
+			if e.ErrorCode != dit.NotDefined {
+				t.Fatalf("got %s, want a not defined error", dit.Describe(p))
+			}
+			break
+		}
+	}
+	for i := 0; srv.Snapshot().Active != 0; i++ {
+		if i == 100 {
+			t.Fatal("cancelled transfer still counted as active")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if srv.CancelTransfer(1) {
+		t.Fatal("cancelled a transfer that already ended")
+	}
+}
+
+// memFile is a file of memStore, stored when it is closed
+type memFile struct {
+	bytes.Buffer
+	close func(b []byte)
+}
+
+func (f *memFile) Close() error {
+	f.close(f.Bytes())
+	return nil
+}
+
+// memStore holds the files of a server in memory, see Opts.Open
+type memStore struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func (m *memStore) open(path string, op dit.Opcode) (io.ReadWriteCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if op == dit.Wrq {
+		return &memFile{close: func(b []byte) {
+			m.mu.Lock()
+			m.files[path] = b
+			m.mu.Unlock()
+		}}, nil
+	}
+	b, ok := m.files[path]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return &memFile{Buffer: *bytes.NewBuffer(b), close: func([]byte) {}}, nil
+}
+
+func TestOpen(t *testing.T) {
+	store := &memStore{files: make(map[string][]byte)}
+	addr, dir := startServer(t, func(o *Opts) { o.Open = store.open })
+
+	client := new(dit.Client)
+	want := randomBytes(100 * 1024)
+	if _, err := client.Put(addr, "file", bytes.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := client.Get(addr, "file", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("downloaded %d bytes that differ from the %d uploaded", buf.Len(), len(want))
+	}
+	_, err := client.Get(addr, "missing", io.Discard)
+	if err == nil || !strings.Contains(err.Error(), dit.FileNotFound.String()) {
+		t.Fatalf("download of a file not in the store failed with %v, want %s", err, dit.FileNotFound)
+	}
+
+	// nothing reaches the disk
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("%d files written to the directory of the server", len(entries))
+	}
+}
@@ -3,13 +3,59 @@ package server
 import (
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/Joe-Degs/dit"
 )
 
+const (
+	// default size of a data block as specified in rfc1350
+	defaultBlksize = 512
+
+	// largest blksize permitted by rfc2348
+	maxBlksize = 65464
+
+	// largest blksize granted without --blocksize. blocks of it fill a 1500
+	// byte ethernet frame after the ip, udp and tftp headers. larger blocks
+	// are sent as fragmented datagrams, which many networks drop, so they
+	// are only used when the operator asks for them
+	safeBlksize = 1468
+
+	// least size of the buffer in front of the file of a transfer. it is
+	// rounded up to whole blocks, so one read or write of the file serves
+	// several blocks even at large blksizes
+	bufferSize = 128 << 10
+)
+
+const (
+	// how long to wait for a packet before retransmitting the last one sent
+	// when --retransmit is not a usable value
+	defaultRetransmit = time.Second
+
+	// number of times a packet is retransmitted before the transfer is
+	// abandoned, unless set with --max-retries
+	maxBlockRetries = 5
+)
+
+var (
+	errTransferDeadline = errors.New("transfer deadline exceeded")
+	errTooManyRetries   = errors.New("too many retransmissions")
+	errQuotaExceeded    = errors.New("file exceeds --max-file-size")
+	errPeerGone         = errors.New("client went away")
+	errOpenTimeout      = errors.New("file not opened within --open-timeout")
+	errIdleTimeout      = errors.New("no packet from client within --idle-timeout")
+	errCancelled        = errors.New("transfer cancelled")
+	errNotWritable      = errors.New("file not in a --writable directory")
+	errOutsideDir       = errors.New("filename outside of the served directory")
+)
+
 type srvconn struct {
 	*dit.Conn
 	id  int64
@@ -18,32 +64,175 @@ type srvconn struct {
 	cfg config
 	buf *dit.FileBuffer
 	f   *os.File
+
+	// file an upload replaces once complete, until then it is written to
+	// the temporary file f. it is empty for uploads written in place
+	target string
+
+	// f was created by the upload in progress, see upload
+	created bool
+
+	// content of a read request supplied by the Virtual hook in place of f,
+	// and its size or -1 if it is not known
+	virtual io.ReadCloser
+	vsize   int64
+
+	// file opened by the Open hook in place of f
+	custom io.ReadWriteCloser
+
+	// server wide counters
+	stats *metrics
+
+	// transfers are recorded here, nil without --audit-log
+	audit *auditLog
+
+	// bytes moved by the current transfer
+	moved int64
+
+	// set by CancelTransfer to abort the current transfer
+	cancelled atomic.Bool
+
+	// locks of the files of transfers with --lock, and the release of the
+	// lock of the current one
+	locks  *fileLocks
+	unlock func()
+
+	// the request of the current transfer, for telling retransmissions of
+	// it apart
+	key requestKey
+
+	// size of data blocks for the current transfer
+	blksize int
+
+	// size of an upload announced by the client with tsize, -1 if it did
+	// not
+	announced int64
+
+	// the last packet sent to the client, kept for retransmission
+	last []byte
+
+	// time after which the current transfer is abandoned, zero for no limit
+	deadline time.Time
+
+	// time after which the transfer is abandoned if nothing is heard from
+	// the client, pushed back with every packet recieved. zero for no limit
+	idle time.Time
+
+	// how long to wait for a packet before retransmitting the last one sent
+	retransmit time.Duration
 }
 
-func newsrvconn(dir string, log *logger, cfg config) *srvconn {
+func newsrvconn(dir string, log *logger, cfg config, stats *metrics, audit *auditLog, locks *fileLocks) *srvconn {
 	return &srvconn{
-		cfg: cfg,
-		log: log,
-		dir: dir,
-		buf: dit.NewFileBuffer(),
+		cfg:   cfg,
+		log:   log,
+		dir:   dir,
+		buf:   dit.NewFileBuffer(),
+		stats: stats,
+		audit: audit,
+		locks: locks,
 	}
 }
 
+// WriteErr sends an error packet to the client, counting it in the server
+// metrics
+func (s *srvconn) WriteErr(code dit.ErrorCode, msg string) error {
+	s.stats.countErr(code)
+	return s.Conn.WriteErr(code, msg)
+}
+
 func (s *srvconn) init() error {
 	req := s.Request()
-	filename := filepath.Join(s.dir, req.Filename)
+	filename, err := confine(s.dir, req.Filename)
+	if err != nil {
+		s.log.Info("refused %s <file=%s>: %v", req.Opcode, req.Filename, err)
+		if serr := s.WriteErr(dit.AccessViolation, "illegal filename"); serr != nil {
+			return fmt.Errorf("%w: failed to send error: %w", err, serr)
+		}
+		return err
+	}
 
-	if s.buf.Is(filename) {
-		return nil
+	if req.Opcode == dit.Wrq && !s.writable(filename) {
+		s.log.Info("refused %s <file=%s>: %v", req.Opcode, req.Filename, errNotWritable)
+		if serr := s.WriteErr(dit.AccessViolation, "directory is not writable"); serr != nil {
+			return fmt.Errorf("%w: failed to send error: %w", errNotWritable, serr)
+		}
+		return errNotWritable
+	}
+
+	if req.Opcode == dit.Rrq && s.cfg.Virtual != nil {
+		r, size, err := s.cfg.Virtual(req, s.Peer())
+		if err != nil {
+			s.log.Info("virtual file error: %v <file=%s>", err, req.Filename)
+			var serr error
+			if errors.Is(err, fs.ErrPermission) {
+				serr = s.WriteErr(dit.AccessViolation, "permision denied")
+			} else {
+				serr = s.WriteErr(dit.FileNotFound, "file does not exist")
+			}
+			if serr != nil {
+				return fmt.Errorf("%w: failed to send error: %w", err, serr)
+			}
+			return err
+		}
+		if r != nil {
+			s.virtual, s.vsize = r, size
+			return nil
+		}
+	}
+
+	// the name of the client next to the path confine cleaned it to shows
+	// how it was mapped, names that climb out of the directory were refused
+	// above
+	if abs, err := filepath.Abs(filename); err == nil {
+		filename = abs
+	}
+	s.log.Verbose("resolved %s <file=%s> to %s", req.Opcode, req.Filename, filename)
+
+	if s.cfg.Lock != "" {
+		unlock, err := s.locks.lock(filename, req.Opcode == dit.Wrq, s.cfg.Lock == lockWait)
+		if err != nil {
+			s.log.Info("refused %s <file=%s>: %v", req.Opcode, req.Filename, err)
+			if serr := s.WriteErr(dit.NotDefined, "file is busy"); serr != nil {
+				return fmt.Errorf("%w: failed to send error: %w", err, serr)
+			}
+			return err
+		}
+		s.unlock = unlock
+	}
+
+	// a slow filesystem must not hold up the client forever
+	var deadline time.Time
+	if s.cfg.OpenTimeout > 0 {
+		deadline = time.Now().Add(time.Duration(s.cfg.OpenTimeout) * time.Second)
+	}
+
+	if s.cfg.Open != nil {
+		return s.openCustom(filename, deadline)
 	}
 
 	// stat and file info stuff before open now
-	_, err := os.Stat(filename)
-	if err != nil {
+	fi, err := fsDeadline(deadline, func() (fs.FileInfo, error) { return os.Stat(filename) }, nil)
+	switch {
+	case errors.Is(err, errOpenTimeout):
+		s.log.Error("stat error: %v <file=%s>", err, req.Filename)
+		_ = s.WriteErr(dit.NotDefined, "timed out opening file")
+		return err
+	case err == nil && req.Opcode == dit.Wrq && s.cfg.NoOverwrite:
+		s.log.Error("write request for existing file <file=%s>", req.Filename)
+		err = fs.ErrExist
+		if serr := s.WriteErr(dit.FileAlreadyExists, "file already exists"); serr != nil {
+			err = fmt.Errorf("%w: failed to send error: %w", err, serr)
+		}
+		return err
+	case err == nil:
+	case errors.Is(err, os.ErrNotExist) && req.Opcode == dit.Wrq && s.cfg.Create:
+		// the file is created when the upload completes
+	default:
 		s.log.Error("stat error: %+v", err)
 		var serr error
 		switch {
-		case errors.Is(err, os.ErrNotExist) && s.cfg.Create:
+		case errors.Is(err, os.ErrNotExist):
 			serr = s.WriteErr(dit.FileNotFound, "file does not exist")
 		case errors.Is(err, os.ErrPermission):
 			serr = s.WriteErr(dit.AccessViolation, "permision denied")
@@ -58,63 +247,888 @@ func (s *srvconn) init() error {
 		return err
 	}
 
-	var flags int
-	switch req.Opcode {
-	case dit.Rrq:
-		flags = os.O_RDONLY
-	case dit.Wrq:
-		flags = os.O_WRONLY | os.O_TRUNC
-		if s.cfg.Create {
-			flags |= os.O_CREATE
-		}
+	open := func() (upload, error) {
+		f, err := os.Open(filename)
+		return upload{f: f}, err
 	}
-
-	f, err := os.OpenFile(filename, flags, fs.ModePerm)
+	if req.Opcode == dit.Wrq {
+		// an open that outlasts the deadline outlives the transfer too, it
+		// must not look at the srvconn once it is recycled
+		noOverwrite, mode := s.cfg.NoOverwrite, s.cfg.FileMode
+		open = func() (upload, error) { return openUpload(filename, fi, noOverwrite, mode) }
+	}
+	up, err := fsDeadline(deadline, open, upload.discard)
 	if err != nil {
 		s.log.Error("open error: %+v", err)
-		if e := s.WriteErr(dit.NotDefined, "could not stat file"); e != nil {
+		code, msg := dit.NotDefined, "could not stat file"
+		switch {
+		case errors.Is(err, errOpenTimeout):
+			msg = "timed out opening file"
+		case errors.Is(err, fs.ErrExist):
+			// created by someone else since it was looked up
+			code, msg = dit.FileAlreadyExists, "file already exists"
+		}
+		if e := s.WriteErr(code, msg); e != nil {
 			return fmt.Errorf("%w: could not send error packet %w", err, e)
 		}
 		return err
 	}
 
-	s.f = f
-	s.buf.WithRequest(req.Opcode, f)
+	s.f, s.target, s.created = up.f, up.target, up.created
+	return nil
+}
+
+// openCustom opens the file of a request with the Open hook, which takes care
+// of everything the server does to files on disk otherwise
+func (s *srvconn) openCustom(filename string, deadline time.Time) error {
+	req := s.Request()
+	// the request and config are released with the srvconn, which an open
+	// that outlasts the deadline outlives
+	open, op := s.cfg.Open, req.Opcode
+	f, err := fsDeadline(deadline, func() (io.ReadWriteCloser, error) { return open(filename, op) },
+		func(f io.ReadWriteCloser) { f.Close() })
+	if err != nil {
+		s.log.Error("open error: %v <file=%s>", err, req.Filename)
+		var serr error
+		switch {
+		case errors.Is(err, errOpenTimeout):
+			serr = s.WriteErr(dit.NotDefined, "timed out opening file")
+		case errors.Is(err, fs.ErrNotExist):
+			serr = s.WriteErr(dit.FileNotFound, "file does not exist")
+		case errors.Is(err, fs.ErrPermission):
+			serr = s.WriteErr(dit.AccessViolation, "permision denied")
+		case errors.Is(err, fs.ErrExist):
+			serr = s.WriteErr(dit.FileAlreadyExists, "file already exists")
+		default:
+			serr = s.WriteErr(dit.NotDefined, "could not open file")
+		}
+		if serr != nil {
+			return fmt.Errorf("%w: failed to send error: %w", err, serr)
+		}
+		return err
+	}
+	s.custom = f
+	return nil
+}
+
+// buffer puts the buffer of the transfer in front of its file once the blksize
+// is negotiated, sized to the whole blocks that fill atleast bufferSize
+func (s *srvconn) buffer() {
+	var file io.ReadWriteCloser = s.f
+	switch {
+	case s.virtual != nil:
+		file = readOnly{s.virtual}
+	case s.custom != nil:
+		file = s.custom
+	}
+	s.buf.SetBufferSize((bufferSize + s.blksize - 1) / s.blksize * s.blksize)
+	s.buf.WithRequest(s.Request().Opcode, file)
+}
+
+// confine returns the path of name, the filename of a request, in dir. Names
+// that are absolute or climb out of dir with .. are refused with
+// errOutsideDir, a request only ever reaches the files under dir
+func confine(dir, name string) (string, error) {
+	if filepath.IsAbs(name) || filepath.VolumeName(name) != "" || strings.HasPrefix(name, "/") || strings.HasPrefix(name, string(filepath.Separator)) {
+		return "", errOutsideDir
+	}
+	filename := filepath.Join(dir, name)
+	rel, err := filepath.Rel(dir, filename)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errOutsideDir
+	}
+	return filename, nil
+}
+
+// writable reports whether filename, the path a write request resolved to, is
+// in one of the --writable directories, or whether there are none
+func (s *srvconn) writable(filename string) bool {
+	if len(s.cfg.Writable) == 0 {
+		return true
+	}
+	up := ".." + string(filepath.Separator)
+	for _, dir := range s.cfg.Writable {
+		rel, err := filepath.Rel(filepath.Join(s.dir, dir), filename)
+		if err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, up) {
+			return true
+		}
+	}
+	return false
+}
+
+// size returns the size of the file of a read request, -1 for content of
+// unknown size like generated content or a named pipe, which is streamed until
+// it ends
+func (s *srvconn) size() (int64, error) {
+	if s.virtual != nil {
+		return s.vsize, nil
+	}
+	if s.custom != nil {
+		st, ok := s.custom.(interface{ Stat() (fs.FileInfo, error) })
+		if !ok {
+			return -1, nil
+		}
+		return fileSize(st.Stat())
+	}
+	return fileSize(s.f.Stat())
+}
+
+// fileSize returns the size of a regular file from its info, -1 for others
+func fileSize(fi fs.FileInfo, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	if !fi.Mode().IsRegular() {
+		return -1, nil
+	}
+	return fi.Size(), nil
+}
+
+// readOnly lets the content of a virtual file stand in for a file in the
+// buffer of a read request, which never writes to it
+type readOnly struct {
+	io.ReadCloser
+}
+
+func (readOnly) Write([]byte) (int, error) {
+	return 0, fs.ErrPermission
+}
+
+// fsDeadline runs fn, a stat or open of the file of a request, waiting for it
+// until deadline if it is not zero. A filesystem that stops answering, like
+// an unreachable NFS server, can block fn indefinitely. It is left to finish in
+// the background then, with discard called on what it returns if it succeeds
+func fsDeadline[T any](deadline time.Time, fn func() (T, error), discard func(T)) (T, error) {
+	if deadline.IsZero() {
+		return fn()
+	}
+
+	type result struct {
+		v   T
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		v, err := fn()
+		done <- result{v, err}
+	}()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.v, r.err
+	case <-timer.C:
+		go func() {
+			if r := <-done; r.err == nil && discard != nil {
+				discard(r.v)
+			}
+		}()
+		var zero T
+		return zero, errOpenTimeout
+	}
+}
+
+// writePacket marshals p and writes it to the client, keeping it for
+// retransmission
+func (s *srvconn) writePacket(p dit.Packet) error {
+	// the last packet is only kept until the next is sent, which reuses it
+	b, err := s.WritePacketBuf(p, s.last)
+	if err != nil {
+		return peerGone(err)
+	}
+	s.last = b
 	return nil
 }
 
+// readPacket waits for the next packet from the client, retransmitting the
+// last packet sent each time the wait times out. It gives up after
+// --max-retries retransmissions, when the transfer deadline passes or when
+// the client has been idle for the idle timeout
+func (s *srvconn) readPacket(buf []byte) (dit.Packet, error) {
+	// with --keepalive a reciever resends its last ack halfway through the
+	// wait as well. the nudge is not counted as a retransmission, so the
+	// transfer is abandoned no sooner than without it
+	keepalive := s.cfg.Keepalive && s.Request().Opcode == dit.Wrq
+	nudged := false
+	for retries := 0; ; {
+		// a cancelled transfer is woken with a read deadline in the past,
+		// one set here after the cancel only delays it to the next timeout
+		if s.cancelled.Load() {
+			_ = s.WriteErr(dit.NotDefined, "transfer cancelled")
+			return nil, errCancelled
+		}
+		wait := s.retransmit
+		if keepalive {
+			wait /= 2
+		}
+		if left := time.Until(s.deadline); !s.deadline.IsZero() && left < wait {
+			wait = left
+		}
+		if wait <= 0 {
+			_ = s.WriteErr(dit.NotDefined, "transfer timed out")
+			return nil, errTransferDeadline
+		}
+		if left := time.Until(s.idle); !s.idle.IsZero() && left < wait {
+			wait = left
+		}
+		if wait <= 0 {
+			s.log.Info("client idle for %ds, abandoning transfer <file=%s>", s.cfg.IdleTimeout, s.Request().Filename)
+			_ = s.WriteErr(dit.NotDefined, "transfer timed out")
+			return nil, errIdleTimeout
+		}
+
+		if err := s.SetReadDeadline(wait); err != nil {
+			return nil, err
+		}
+		p, err := s.ReadPacket(buf)
+		if err != nil {
+			switch {
+			case errors.Is(err, os.ErrDeadlineExceeded):
+				if (!s.idle.IsZero() && !time.Now().Before(s.idle)) || s.cancelled.Load() {
+					// nothing to retransmit to a client that is gone
+					continue
+				}
+				if keepalive && !nudged {
+					nudged = true
+					s.log.Trace("no data for %v, sending ack again <file=%s>", wait, s.Request().Filename)
+					if _, err := s.Write(s.last); err != nil {
+						return nil, peerGone(err)
+					}
+					continue
+				}
+				nudged = false
+				if retries++; retries > s.cfg.MaxRetries {
+					_ = s.WriteErr(dit.NotDefined, "transfer timed out")
+					return nil, errTooManyRetries
+				}
+				if _, err := s.Write(s.last); err != nil {
+					return nil, peerGone(err)
+				}
+				continue
+			case errors.Is(err, dit.ErrMalformedPacket):
+				_ = s.WriteErr(dit.NotDefined, "could not decode packet")
+			}
+			return nil, peerGone(err)
+		}
+		s.idle = after(s.cfg.IdleTimeout)
+		return p, nil
+	}
+}
+
+// after returns the time secs seconds from now, or the zero time for no limit
+// if secs is not positive
+func after(secs int) time.Time {
+	if secs <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(secs) * time.Second)
+}
+
+// peerGone turns the error of a read or write into errPeerGone if it means the
+// client is gone, see dit.IsPeerGone
+func peerGone(err error) error {
+	if dit.IsPeerGone(err) && !errors.Is(err, errPeerGone) {
+		return fmt.Errorf("%w: %v", errPeerGone, err)
+	}
+	return err
+}
+
+func (s *srvconn) ack(block uint16) error {
+	return s.writePacket(dit.NewAck(block))
+}
+
+// negotiate answers the options of the request with an option acknowledgement
+// containing the ones the server is willing to honor. It reports whether the
+// acknowledgement was sent, no acknowledgement is sent if no option was honored
+func (s *srvconn) negotiate() (bool, error) {
+	req := s.Request()
+	s.announced = -1
+	oack, err := dit.NewOAck(nil)
+	if err != nil {
+		return false, err
+	}
+
+	// as specified in rfc2347 the acknowledgement holds nothing but options
+	// the client requested and the server supports, an option the client
+	// did not send is never added. ranging over the options of a request
+	// without any is safe, the acknowledgement allocates its own options as
+	// they are accepted
+	refused := dit.MarshalOpts(s.cfg.Refuse)
+	for opt, val := range req.Options {
+		// an option refused with --refuse is ignored like an unknown one
+		if s.cfg.Refuse != "" && opt == refused {
+			continue
+		}
+		switch opt {
+		case dit.Blksize:
+			// the server may answer with a smaller blksize than requested
+			max := s.cfg.BlockSize
+			if max == 0 {
+				max = safeBlksize
+			}
+			if val > max {
+				val = max
+			}
+			s.blksize = val
+			oack.SetOption(opt, val)
+		case dit.Timeout:
+			// the client decides how long we wait before retransmitting
+			s.retransmit = time.Duration(val) * time.Second
+			oack.SetOption(opt, val)
+		case dit.Tsize:
+			// netascii translation changes the number of bytes on the
+			// wire, so the size of the file is not what the client would
+			// recieve. rather than report a size the transfer will not
+			// match, tsize is left out of the acknowledgement in that mode
+			if mode, _ := dit.ParseMode(req.Mode); mode == dit.Netascii {
+				continue
+			}
+			// as specified in rfc2349 a read request is answered with the
+			// size of the file and a write request with the size the
+			// client announced
+			if req.Opcode == dit.Rrq {
+				size, err := s.size()
+				if err != nil {
+					_ = s.WriteErr(dit.NotDefined, "could not stat file")
+					return false, err
+				}
+				if size < 0 {
+					continue
+				}
+				val = int(size)
+			} else if s.cfg.MaxFileSize > 0 && val > s.cfg.MaxFileSize {
+				_ = s.WriteErr(dit.DiskFull, "file too large")
+				return false, errQuotaExceeded
+			} else {
+				s.announced = int64(val)
+			}
+			oack.SetOption(opt, val)
+		case dit.Offset:
+			if !s.cfg.Offset || req.Opcode != dit.Rrq {
+				continue
+			}
+			size, err := s.size()
+			if err != nil {
+				_ = s.WriteErr(dit.NotDefined, "could not stat file")
+				return false, err
+			}
+			// only files on disk of a known size can be read from an
+			// offset, other content only from the start
+			if size < 0 || s.f == nil {
+				continue
+			}
+			// the client can not get what it asked for, terminate the
+			// negotiation as specified in rfc2347
+			if int64(val) > size {
+				_ = s.WriteErr(dit.RequestDenied, "offset beyond end of file")
+				return false, fmt.Errorf("offset %d beyond file size %d", val, size)
+			}
+			if _, err := s.f.Seek(int64(val), io.SeekStart); err != nil {
+				_ = s.WriteErr(dit.NotDefined, "could not seek file")
+				return false, err
+			}
+			oack.SetOption(opt, val)
+		default:
+			// options registered by the user of the server
+			if s.cfg.Negotiate == nil || opt <= dit.Offset {
+				continue
+			}
+			if val, ok := s.cfg.Negotiate(req, opt, val); ok {
+				oack.SetOption(opt, val)
+			}
+		}
+	}
+
+	// what was asked for next to what was agreed answers most questions
+	// about slow transfers and clients that do not interoperate
+	if len(req.Options) > 0 {
+		s.log.Info("negotiated <file=%s>: requested %q, accepted %q", req.Filename, dit.Describe(req), dit.Describe(oack))
+	}
+	if len(oack.Options) == 0 {
+		return false, nil
+	}
+	return true, s.writePacket(oack)
+}
+
+// waitAck reads packets from the client into buf until it acknowledges block
+func (s *srvconn) waitAck(buf []byte, block uint16) error {
+	for {
+		p, err := s.readPacket(buf)
+		if err != nil {
+			return err
+		}
+
+		switch p := p.(type) {
+		case *dit.AckPacket:
+			// acks of earlier blocks are duplicates and can be ignored
+			if p.BlockNumber == block {
+				return nil
+			}
+		case *dit.ErrorPacket:
+			return fmt.Errorf("client sent error %s: %s", p.ErrorCode, p.ErrMsg)
+		default:
+			_ = s.WriteErr(dit.IllegalOperation, "expected ack packet")
+			return fmt.Errorf("unexpected %T during read request", p)
+		}
+	}
+}
+
+// sendFile handles a read request. It sends the file to the client a block at
+// a time, waiting for each block to be acknowledged before sending the next
+func (s *srvconn) sendFile() error {
+	ackbuf := make([]byte, 512)
+
+	oack, err := s.negotiate()
+	if err != nil {
+		return err
+	}
+	s.buffer()
+	if oack {
+		if err := s.waitAck(ackbuf, 0); err != nil {
+			return err
+		}
+	}
+
+	var sent int
+	buf := make([]byte, s.blksize)
+	for block := uint16(1); ; block++ {
+		n, err := s.buf.ReadNext(buf)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			_ = s.WriteErr(dit.NotDefined, "could not read file")
+			return err
+		}
+		if sent += n; s.cfg.MaxFileSize > 0 && sent > s.cfg.MaxFileSize {
+			_ = s.WriteErr(dit.AccessViolation, "file too large")
+			return errQuotaExceeded
+		}
+
+		data, err := dit.NewData(block, buf[:n])
+		if err != nil {
+			return err
+		}
+		if err := s.writePacket(data); err != nil {
+			return err
+		}
+		s.stats.bytesWritten.Add(int64(n))
+		s.moved += int64(n)
+		s.log.Trace("sent block %d (%d bytes) <file=%s>", block, n, s.Request().Filename)
+		if err := s.waitAck(ackbuf, block); err != nil {
+			// the last block is retransmitted like the others until the
+			// retries run out, the client may have it all the same
+			if data.IsLast(s.blksize) && errors.Is(err, errTooManyRetries) {
+				err = fmt.Errorf("%w: %w", dit.ErrNoFinalAck, err)
+			}
+			return err
+		}
+
+		// a short block terminates the transfer
+		if data.IsLast(s.blksize) {
+			return nil
+		}
+	}
+}
+
+// healthResponse is the content of the --health-file
+var healthResponse = []byte("ok\n")
+
+// sendHealth answers a request for the --health-file with healthResponse. The
+// options of the request are ignored, the response fits in a single block of
+// the default size
+func (s *srvconn) sendHealth() error {
+	data, err := dit.NewData(1, healthResponse)
+	if err != nil {
+		return err
+	}
+	if err := s.writePacket(data); err != nil {
+		return err
+	}
+	return s.waitAck(make([]byte, 512), 1)
+}
+
+// recvFile handles a write request. It acknowledges data packets from the
+// client and writes them to the file until a block shorter than blksize
+// signals the end of the transfer
+func (s *srvconn) recvFile() error {
+	var (
+		seq      dit.BlockSequence
+		recieved int
+		blocks   int
+
+		// times the block after seq.Last() was asked for again because it
+		// ended short of the announced size
+		reasked int
+	)
+	oack, err := s.negotiate()
+	if err != nil {
+		return err
+	}
+	s.buffer()
+	if !oack {
+		if err := s.ack(seq.Last()); err != nil {
+			return err
+		}
+	}
+
+	// one extra byte so we can tell when a peer sends more than blksize
+	buf := make([]byte, s.blksize+5)
+
+	for {
+		p, err := s.readPacket(buf)
+		if err != nil {
+			return err
+		}
+
+		switch p := p.(type) {
+		case *dit.DataPacket:
+			s.log.Trace("recieved block %d (%d bytes) <file=%s>", p.BlockNumber, len(p.Data), s.Request().Filename)
+			switch seq.Classify(p.BlockNumber) {
+			case dit.BlockDuplicate:
+				// our last ack got lost, send it again
+				if err := s.ack(seq.Last()); err != nil {
+					return err
+				}
+				continue
+			case dit.BlockOutOfWindow:
+				continue
+			}
+
+			// the peer is misbehaving if it sends more than was negotiated
+			if len(p.Data) > s.blksize {
+				_ = s.WriteErr(dit.IllegalOperation, "data block larger than blksize")
+				return fmt.Errorf("block %d: %d bytes exceeds blksize %d", p.BlockNumber, len(p.Data), s.blksize)
+			}
+
+			// a block shorter than blksize ends the transfer, one that
+			// falls short of the size the client announced was cut on the
+			// way. it is not written, acknowledging the block before it
+			// again asks for it once more. a client that keeps sending it
+			// announced the wrong size, after --max-retries the block is
+			// taken as the end of the file
+			if s.announced >= 0 && p.IsLast(s.blksize) && int64(recieved+len(p.Data)) < s.announced {
+				if reasked < s.cfg.MaxRetries {
+					reasked++
+					s.log.Verbose("block %d of %d bytes ends short of the announced %d bytes, asking for it again <file=%s>", p.BlockNumber, len(p.Data), s.announced, s.Request().Filename)
+					if err := s.ack(seq.Last()); err != nil {
+						return err
+					}
+					continue
+				}
+				s.log.Info("file ends at %d bytes, short of the announced %d bytes <file=%s>", recieved+len(p.Data), s.announced, s.Request().Filename)
+			}
+			reasked = 0
+
+			if recieved += len(p.Data); s.cfg.MaxFileSize > 0 && recieved > s.cfg.MaxFileSize {
+				_ = s.WriteErr(dit.DiskFull, "file too large")
+				s.removeFile()
+				return errQuotaExceeded
+			}
+			if _, err := s.buf.Write(p.Data); err != nil {
+				_ = s.WriteErr(dit.DiskFull, "could not write data")
+				return err
+			}
+			s.stats.bytesRead.Add(int64(len(p.Data)))
+			s.moved += int64(len(p.Data))
+
+			seq.Advance()
+
+			// the file is complete once the last block is acknowledged,
+			// so it has to reach the disk before the ack goes out
+			done := p.IsLast(s.blksize)
+
+			// with --flush-every the buffered blocks are written out
+			// every so often instead of once the buffer is full
+			if blocks++; s.cfg.FlushEvery > 0 && !done && blocks%s.cfg.FlushEvery == 0 {
+				if err := s.buf.Flush(); err != nil {
+					_ = s.WriteErr(dit.DiskFull, "could not write data")
+					return err
+				}
+			}
+			if done {
+				if err := s.buf.Close(); err != nil {
+					_ = s.WriteErr(dit.DiskFull, "could not write data")
+					return err
+				}
+				if err := s.syncFile(); err != nil {
+					_ = s.WriteErr(dit.DiskFull, "could not write data")
+					return err
+				}
+				if err := s.commitFile(); err != nil {
+					if errors.Is(err, fs.ErrExist) {
+						_ = s.WriteErr(dit.FileAlreadyExists, "file already exists")
+					} else {
+						_ = s.WriteErr(dit.NotDefined, "could not save file")
+					}
+					return err
+				}
+			}
+			if err := s.ack(seq.Last()); err != nil {
+				return err
+			}
+			if done {
+				return nil
+			}
+		case *dit.ErrorPacket:
+			return fmt.Errorf("client sent error %s: %s", p.ErrorCode, p.ErrMsg)
+		default:
+			_ = s.WriteErr(dit.IllegalOperation, "expected data packet")
+			return fmt.Errorf("unexpected %T during write request", p)
+		}
+	}
+}
+
 func (s *srvconn) start(cl chan<- *srvconn) {
+	s.stats.active.Add(1)
+	defer s.stats.active.Add(-1)
+
+	req := s.Request()
+	began := time.Now()
+	s.moved = 0
+	s.blksize = defaultBlksize
+	s.deadline = after(s.cfg.Timeout)
+	s.idle = after(s.cfg.IdleTimeout)
+	s.retransmit = time.Duration(s.cfg.Retransmit) * time.Microsecond
+	if s.retransmit <= 0 {
+		s.retransmit = defaultRetransmit
+	}
+
+	// probes are answered without touching the filesystem, so they tell
+	// whether the server is up even when the directory is unusable
+	if s.cfg.Health != "" && req.Opcode == dit.Rrq && req.Filename == s.cfg.Health {
+		if err := s.sendHealth(); err != nil {
+			s.log.Verbose("health check failed: %v", err)
+		}
+		cl <- s.end()
+		return
+	}
+
 	if err := s.init(); err != nil {
-		cl <- s
+		s.audit.record(s.Peer(), req, 0, time.Since(began), err)
 		s.log.Error("failed to initialize connection: %v", err)
+		cl <- s.end()
 		return
 	}
 
-	req := s.Request()
-
+	var err error
 	switch req.Opcode {
 	case dit.Rrq:
-		s.log.Info("%+v\n", req)
+		s.log.Info("transfer %d: %+v\n", s.id, req)
+		err = s.sendFile()
 	case dit.Wrq:
-		s.log.Info("%+v\n", req)
+		s.log.Info("transfer %d: %+v\n", s.id, req)
+		err = s.recvFile()
+	}
+	switch {
+	case errors.Is(err, errPeerGone):
+		// nobody is left to tell, this is not a failure of the server
+		s.log.Verbose("transfer abandoned <file=%s>: %v", req.Filename, err)
+	case errors.Is(err, errCancelled):
+		s.log.Info("transfer %d cancelled <file=%s>", s.id, req.Filename)
+	case errors.Is(err, dit.ErrNoFinalAck):
+		s.log.Info("transfer unconfirmed <file=%s>: %v", req.Filename, err)
+	case err != nil:
+		s.log.Error("transfer failed <file=%s>: %v", req.Filename, err)
 	}
+	if err != nil && req.Opcode == dit.Wrq {
+		s.removeFile()
+	}
+	s.audit.record(s.Peer(), req, s.moved, time.Since(began), err)
 
-	cl <- s
+	cl <- s.end()
 }
 
 func (s *srvconn) end() *srvconn {
-	s.buf.Reset() // reset buffer
+	s.last = s.last[:0] // keep the buffer for the next transfer
+	s.buf.Reset()       // reset buffer
+
+	// every transfer opens its own file, so concurrent reads of the same file
+	// each have their own offset
 	if s.f != nil {
-		s.f.Seek(0, 0) // seek back to beginning of file
+		s.f.Close()
+		s.f = nil
+	}
+	if s.virtual != nil {
+		s.virtual.Close()
+		s.virtual = nil
+	}
+	if s.custom != nil {
+		s.custom.Close()
+		s.custom = nil
 	}
-	s.Conn.Close()
+	if s.unlock != nil {
+		s.unlock()
+		s.unlock = nil
+	}
+	// the socket and request belong to this transfer only, a recycled
+	// srvconn gets the Conn of its next request in newconn
+	s.Conn.Release()
+	s.Conn = nil
+	s.target, s.created = "", false
 	return s
 }
 
+// upload is the file an upload is written to
+type upload struct {
+	f *os.File
+
+	// f is a temporary file renamed over target when the upload completes,
+	// target is empty for an upload written to the file itself
+	target string
+
+	// f was created for the upload, it is removed if the upload fails
+	created bool
+}
+
+// discard closes the file of an upload that is not going to happen and
+// removes it if it was created for it
+func (u upload) discard() {
+	u.f.Close()
+	if u.target != "" || u.created {
+		os.Remove(u.f.Name())
+	}
+}
+
+// openUpload opens the file an upload to filename is written to. fi is the
+// info of the file, nil if it does not exist yet, and mode the permissions of a
+// new one.
+//
+// An upload is written next to the file and renamed over it when complete, so a
+// failed transfer never leaves a truncated file and readers see either the old
+// file or the new one. The replacement keeps the mode of an existing file and a
+// symlink is followed to replace the file it points to. Where a replacement is
+// not possible the upload is written to the file itself: when the directory is
+// not writable, like with files created ahead of uploads in a directory tftpd
+// can not write to, and when a new file would cut off the other hard links of
+// the old one or change its owner. New files with noOverwrite are created in
+// place as well, creating them exclusively is what keeps a file created while
+// the upload is in progress from being replaced
+func openUpload(filename string, fi fs.FileInfo, noOverwrite bool, mode fs.FileMode) (upload, error) {
+	if fi == nil && noOverwrite {
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+		return upload{f: f, created: true}, err
+	}
+
+	target := filename
+	if fi != nil {
+		mode = fi.Mode().Perm()
+		if lfi, err := os.Lstat(filename); err == nil && lfi.Mode()&fs.ModeSymlink != 0 {
+			if target, err = filepath.EvalSymlinks(filename); err != nil {
+				return upload{}, err
+			}
+		}
+		if shared(fi) {
+			return openInPlace(target, mode, fi == nil)
+		}
+	}
+	f, err := createTemp(target, mode)
+	if errors.Is(err, fs.ErrPermission) {
+		return openInPlace(target, mode, fi == nil)
+	}
+	return upload{f: f, target: target}, err
+}
+
+// openInPlace truncates the file name for an upload to be written to it, or
+// creates it with mode if create is set. A failed upload leaves a file that
+// existed truncated
+func openInPlace(name string, mode fs.FileMode, create bool) (upload, error) {
+	flag := os.O_WRONLY | os.O_TRUNC
+	if create {
+		flag |= os.O_CREATE | os.O_EXCL
+	}
+	f, err := os.OpenFile(name, flag, mode)
+	return upload{f: f, created: create}, err
+}
+
+// createTemp creates a file for writing in the directory of name, with a
+// random suffix so concurrent uploads of the same file do not collide. the
+// umask of the process still applies to mode
+func createTemp(name string, mode fs.FileMode) (f *os.File, err error) {
+	dir, base := filepath.Split(name)
+	for i := 0; i < 10; i++ {
+		tmp := filepath.Join(dir, fmt.Sprintf(".%s.%d.part", base, rand.Uint32()))
+		f, err = os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+		if !errors.Is(err, fs.ErrExist) {
+			break
+		}
+	}
+	return f, err
+}
+
+// the operations that make an upload durable and put it in place, tests
+// replace them to see the order they are done in
+var (
+	fsync  = (*os.File).Sync
+	rename = os.Rename
+)
+
+// commitFile completes an upload, moving it from its temporary file over the
+// file the client asked for unless it was written in place
+func (s *srvconn) commitFile() error {
+	// the Open hook decides what becomes of a file once it is closed
+	if s.custom != nil {
+		err := s.custom.Close()
+		s.custom = nil
+		return err
+	}
+	tmp := s.f.Name()
+	err := s.f.Close()
+	s.f = nil
+	if s.target == "" {
+		return err
+	}
+	if err == nil {
+		err = rename(tmp, s.target)
+	}
+	if err != nil {
+		if rerr := os.Remove(tmp); rerr != nil {
+			s.log.Error("failed to remove temporary file: %v", rerr)
+		}
+	}
+	return err
+}
+
+// removeFile closes the file of an aborted write request and removes it, so
+// that no partial file is left behind. A file that existed before an upload
+// written in place is left as the upload left it, there is nothing to restore
+// it from
+func (s *srvconn) removeFile() {
+	if s.f == nil {
+		return
+	}
+	name := s.f.Name()
+	s.f.Close()
+	s.f = nil
+	if s.target == "" && !s.created {
+		s.log.Info("upload written in place failed, the file is incomplete <file=%s>", name)
+		return
+	}
+	if err := os.Remove(name); err != nil {
+		s.log.Error("failed to remove partial file: %v", err)
+	}
+}
+
+// syncFile commits the uploaded file to stable storage if the server was
+// started with --sync
+func (s *srvconn) syncFile() error {
+	if !s.cfg.Sync || s.f == nil || s.Request().Opcode != dit.Wrq {
+		return nil
+	}
+	return fsync(s.f)
+}
+
 func (s *srvconn) Close() (err error) {
 	if s.f != nil {
+		if err = s.syncFile(); err != nil {
+			s.log.Error("sync error: %+v", err)
+		}
 		err = s.f.Close()
 	}
+	if s.virtual != nil {
+		err = s.virtual.Close()
+	}
+	if s.custom != nil {
+		err = s.custom.Close()
+	}
 	if err1 := s.Conn.Close(); err1 != nil {
 		err = err1
 	}
@@ -0,0 +1,1550 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Joe-Degs/dit"
+)
+
+// expect fails the test unless the next packet the client recieves is want
+func (c *rawClient) expect(want dit.Packet) {
+	c.t.Helper()
+	p, _ := c.recv()
+	if dit.Describe(p) != dit.Describe(want) {
+		c.t.Fatalf("got %s, want %s", dit.Describe(p), dit.Describe(want))
+	}
+}
+
+// startWrite sends a write request for name with options and waits for the
+// server to answer it, returning the answer and the address of the server TID
+func (c *rawClient) startWrite(name string, options map[dit.Option]int) (dit.Packet, *net.UDPAddr) {
+	c.t.Helper()
+	wrq, err := dit.NewWRQ(name, "octet", options)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.send(wrq, nil)
+	return c.recv()
+}
+
+func data(t testing.TB, block uint16, b []byte) *dit.DataPacket {
+	t.Helper()
+	p, err := dit.NewData(block, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestRecvShortBlockAskedAgain(t *testing.T) {
+	addr, dir := startServer(t, nil)
+	want := randomBytes(1024)
+
+	c := dialRaw(t, addr)
+	p, tid := c.startWrite("file", map[dit.Option]int{dit.Tsize: len(want)})
+	if _, ok := p.(*dit.OAckPacket); !ok {
+		t.Fatalf("got %s, want an OACK", dit.Describe(p))
+	}
+	c.send(data(t, 1, want[:512]), tid)
+	c.expect(dit.NewAck(1))
+
+	// the second block is cut on the way, it ends short of the tsize
+	c.send(data(t, 2, want[512:600]), tid)
+	c.expect(dit.NewAck(1))
+
+	c.send(data(t, 2, want[512:]), tid)
+	c.expect(dit.NewAck(2))
+	c.send(data(t, 3, nil), tid)
+	c.expect(dit.NewAck(3))
+
+	got, err := os.ReadFile(filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("file is %d bytes, want the %d sent", len(got), len(want))
+	}
+}
+
+func TestRecvShortBlockAcceptedAfterRetries(t *testing.T) {
+	addr, dir := startServer(t, func(o *Opts) { o.MaxRetries = 2 })
+	want := randomBytes(600)
+
+	// the client announces more than it has, the server asks for the short
+	// block --max-retries times and takes it as the end of the file then
+	c := dialRaw(t, addr)
+	_, tid := c.startWrite("file", map[dit.Option]int{dit.Tsize: 1024})
+	c.send(data(t, 1, want[:512]), tid)
+	c.expect(dit.NewAck(1))
+	for i := 0; i < 2; i++ {
+		c.send(data(t, 2, want[512:]), tid)
+		c.expect(dit.NewAck(1))
+	}
+	c.send(data(t, 2, want[512:]), tid)
+	c.expect(dit.NewAck(2))
+
+	got, err := os.ReadFile(filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("file is %d bytes, want the %d sent", len(got), len(want))
+	}
+}
+
+// waitGone waits for the transfer of an aborted upload to be cleaned up, until
+// dir holds nothing but the files in keep
+func waitGone(t testing.TB, dir string, keep ...string) {
+	t.Helper()
+	var names []string
+	for i := 0; i < 100; i++ {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = names[:0]
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		if len(names) == len(keep) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("directory holds %q after the upload failed, want %q", names, keep)
+}
+
+// abortUpload uploads a block of name and then aborts the upload
+func abortUpload(t testing.TB, addr, name string) {
+	t.Helper()
+	c := dialRaw(t, addr)
+	p, tid := c.startWrite(name, nil)
+	if _, ok := p.(*dit.AckPacket); !ok {
+		t.Fatalf("got %s, want an ACK", dit.Describe(p))
+	}
+	c.send(data(t, 1, randomBytes(512)), tid)
+	c.expect(dit.NewAck(1))
+	abort, _ := dit.NewError(dit.NotDefined, "going away")
+	c.send(abort, tid)
+}
+
+func TestUploadAbortLeavesNoPartialFile(t *testing.T) {
+	addr, dir := startServer(t, nil)
+	abortUpload(t, addr, "new")
+	waitGone(t, dir)
+
+	// a file that existed is left as it was
+	want := []byte("old content")
+	if err := os.WriteFile(filepath.Join(dir, "old"), want, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	abortUpload(t, addr, "old")
+	waitGone(t, dir, "old")
+	if got, _ := os.ReadFile(filepath.Join(dir, "old")); !bytes.Equal(got, want) {
+		t.Fatalf("aborted upload changed the file to %q", got)
+	}
+}
+
+func TestUploadKeepsLinks(t *testing.T) {
+	addr, dir := startServer(t, nil)
+	if err := os.Mkdir(filepath.Join(dir, "real"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "real", "file")
+	if err := os.WriteFile(file, []byte("old"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(file, filepath.Join(dir, "symlink")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(file, filepath.Join(dir, "hardlink")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"symlink", "hardlink", "real/file"} {
+		want := randomBytes(700 + len(name))
+		if _, err := new(dit.Client).Put(addr, name, bytes.NewReader(want)); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		// every name still leads to the same file, which has the upload
+		for _, other := range []string{"symlink", "hardlink", "real/file"} {
+			got, err := os.ReadFile(filepath.Join(dir, other))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("upload to %s: %s is not the uploaded file", name, other)
+			}
+		}
+		if fi, err := os.Lstat(filepath.Join(dir, "symlink")); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			t.Fatalf("upload to %s replaced the symlink", name)
+		}
+		if fi, err := os.Stat(file); err != nil || fi.Mode().Perm() != 0o600 {
+			t.Fatalf("upload to %s changed the mode of the file", name)
+		}
+	}
+}
+
+func TestUploadReadOnlyDirectory(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("directory permissions do not apply to root")
+	}
+	addr, dir := startServer(t, nil)
+	if err := os.WriteFile(filepath.Join(dir, "file"), nil, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(dir, 0o555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dir, 0o755)
+
+	// a file created ahead for uploads is written to in place
+	want := randomBytes(1000)
+	if _, err := new(dit.Client).Put(addr, "file", bytes.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "file")); !bytes.Equal(got, want) {
+		t.Fatal("file is not the uploaded one")
+	}
+}
+
+func TestUploadNoOverwrite(t *testing.T) {
+	addr, dir := startServer(t, func(o *Opts) { o.NoOverwrite = true })
+
+	want := randomBytes(1000)
+	if _, err := new(dit.Client).Put(addr, "file", bytes.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "file")); !bytes.Equal(got, want) {
+		t.Fatal("file is not the uploaded one")
+	}
+
+	_, err := new(dit.Client).Put(addr, "file", bytes.NewReader(randomBytes(10)))
+	if err == nil || !strings.Contains(err.Error(), dit.FileAlreadyExists.String()) {
+		t.Fatalf("overwriting the file failed with %v, want %s", err, dit.FileAlreadyExists)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "file")); !bytes.Equal(got, want) {
+		t.Fatal("file was overwritten")
+	}
+
+	// a new file created for an upload that fails is removed
+	abortUpload(t, addr, "new")
+	waitGone(t, dir, "file")
+}
+
+func TestMaxRetries(t *testing.T) {
+	for _, retries := range []int{0, 1, 3} {
+		addr, dir := startServer(t, func(o *Opts) { o.MaxRetries = retries })
+		if err := os.WriteFile(filepath.Join(dir, "file"), randomBytes(700), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		rrq, err := dit.NewRRQ("file", "octet", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the client never acknowledges the first block, it is sent again
+		// --max-retries times before the server gives up
+		c := dialRaw(t, addr)
+		c.send(rrq, nil)
+		sent := 0
+		for {
+			p, _ := c.recv()
+			if _, ok := p.(*dit.ErrorPacket); ok {
+				break
+			}
+			if _, ok := p.(*dit.DataPacket); !ok {
+				t.Fatalf("got %s while expecting data", dit.Describe(p))
+			}
+			sent++
+		}
+		if sent != retries+1 {
+			t.Errorf("--max-retries %d: block sent %d times, want %d", retries, sent, retries+1)
+		}
+	}
+}
+
+func TestRecvOversizedBlock(t *testing.T) {
+	addr, dir := startServer(t, nil)
+	c := dialRaw(t, addr)
+	p, tid := c.startWrite("file", nil)
+	if ack, ok := p.(*dit.AckPacket); !ok || ack.BlockNumber != 0 {
+		t.Fatalf("got %s, want the ack of block 0", dit.Describe(p))
+	}
+
+	// no blksize was negotiated, a block of 1024 bytes is twice the 512
+	c.send(data(t, 1, randomBytes(1024)), tid)
+	p, _ = c.recv()
+	if e, ok := p.(*dit.ErrorPacket); !ok || e.ErrorCode != dit.IllegalOperation {
+		t.Fatalf("got %s, want an illegal operation error", dit.Describe(p))
+	}
+	waitGone(t, dir)
+}
+
+func TestUploadFileMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no permission bits on windows")
+	}
+	// the umask of the process is what a file created with all permissions
+	// lacks
+	probe := filepath.Join(t.TempDir(), "probe")
+	f, err := os.OpenFile(probe, os.O_CREATE|os.O_WRONLY, 0o777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	fi, err := os.Stat(probe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed := fi.Mode().Perm()
+
+	for _, mode := range []string{"0644", "0600", "0666"} {
+		addr, dir := startServer(t, func(o *Opts) { o.FileMode = mode })
+		if _, err := new(dit.Client).Put(addr, "file", bytes.NewReader(randomBytes(700))); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(filepath.Join(dir, "file"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := strconv.ParseUint(mode, 8, 32)
+		if got := fi.Mode().Perm(); got != os.FileMode(want)&allowed {
+			t.Errorf("--file-mode %s: uploaded file has mode %04o, want %04o", mode, got, os.FileMode(want)&allowed)
+		}
+	}
+}
+
+func TestReadOffset(t *testing.T) {
+	want := randomBytes(1300)
+	for _, tt := range []struct {
+		name    string
+		allow   bool
+		offset  int
+		from    int  // byte of the file the transfer starts from
+		refused bool // the offset ends the negotiation with an error
+	}{
+		{name: "resume mid-file", allow: true, offset: 700, from: 700},
+		{name: "resume at end of file", allow: true, offset: 1300, from: 1300},
+		{name: "beyond end of file", allow: true, offset: 1301, refused: true},
+		{name: "not allowed", offset: 700, from: 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, dir := startServer(t, func(o *Opts) { o.Offset = tt.allow })
+			if err := os.WriteFile(filepath.Join(dir, "file"), want, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			c := dialRaw(t, addr)
+			rrq, err := dit.NewRRQ("file", "octet", map[dit.Option]int{dit.Offset: tt.offset})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.send(rrq, nil)
+			p, tid := c.recv()
+			if tt.refused {
+				if e, ok := p.(*dit.ErrorPacket); !ok || e.ErrorCode != dit.RequestDenied {
+					t.Fatalf("got %s, want the request denied", dit.Describe(p))
+				}
+				return
+			}
+			if tt.allow {
+				if oack, ok := p.(*dit.OAckPacket); !ok || oack.Options[dit.Offset] != tt.offset {
+					t.Fatalf("got %s, want the offset acknowledged", dit.Describe(p))
+				}
+				c.send(dit.NewAck(0), tid)
+				p, _ = c.recv()
+			}
+
+			// the blocks are numbered from 1 wherever the transfer
+			// starts
+			var got []byte
+			for block := uint16(1); ; block++ {
+				d, ok := p.(*dit.DataPacket)
+				if !ok || d.BlockNumber != block {
+					t.Fatalf("got %s, want block %d", dit.Describe(p), block)
+				}
+				got = append(got, d.Data...)
+				c.send(dit.NewAck(block), tid)
+				if len(d.Data) < 512 {
+					break
+				}
+				p, _ = c.recv()
+			}
+			if !bytes.Equal(got, want[tt.from:]) {
+				t.Fatalf("got %d bytes, want the %d from byte %d of the file", len(got), len(want)-tt.from, tt.from)
+			}
+		})
+	}
+}
+
+func TestTransferDeadline(t *testing.T) {
+	// a client that acknowledges every block but takes two seconds over the
+	// file, --timeout ends its transfer after one unless it is 0
+	for _, tt := range []struct {
+		name    string
+		timeout int
+		cut     bool
+	}{
+		{name: "one second", timeout: 1, cut: true},
+		{name: "no limit", timeout: 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, dir := startServer(t, func(o *Opts) {
+				o.Timeout = tt.timeout
+				o.MaxRetries = 100
+			})
+			want := randomBytes(7 * 512)
+			if err := os.WriteFile(filepath.Join(dir, "file"), want, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			rrq, err := dit.NewRRQ("file", "octet", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := dialRaw(t, addr)
+			began := time.Now()
+			c.send(rrq, nil)
+			var got []byte
+			for next := uint16(1); ; {
+				p, tid, err := c.tryRecv(5 * time.Second)
+				if err != nil {
+					t.Fatalf("transfer still going after %v: %v", time.Since(began), err)
+				}
+				if _, ok := p.(*dit.ErrorPacket); ok {
+					if !tt.cut {
+						t.Fatalf("got %s after %v, want the whole file", dit.Describe(p), time.Since(began))
+					}
+					if took := time.Since(began); took < time.Second || took > 2*time.Second {
+						t.Fatalf("transfer abandoned after %v, want about the one second of --timeout", took)
+					}
+					return
+				}
+				d, ok := p.(*dit.DataPacket)
+				if !ok || d.BlockNumber != next {
+					// retransmissions of the block being held back
+					continue
+				}
+				got = append(got, d.Data...)
+				time.Sleep(250 * time.Millisecond)
+				c.send(dit.NewAck(next), tid)
+				if len(d.Data) < 512 {
+					break
+				}
+				next++
+			}
+			if tt.cut {
+				t.Fatalf("transfer completed after %v, want it cut off by --timeout", time.Since(began))
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("got %d bytes, want the %d of the file", len(got), len(want))
+			}
+		})
+	}
+}
+
+func TestRetransmitTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		retransmit int // --retransmit in microseconds
+		timeout    int // timeout option of the client in seconds, 0 for none
+		min, max   time.Duration
+	}{
+		{name: "--retransmit", retransmit: 200000, min: 150 * time.Millisecond, max: 700 * time.Millisecond},
+		{name: "timeout option", retransmit: 200000, timeout: 1, min: 900 * time.Millisecond, max: 1500 * time.Millisecond},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, dir := startServer(t, func(o *Opts) { o.Retransmit = tt.retransmit })
+			if err := os.WriteFile(filepath.Join(dir, "file"), randomBytes(700), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			var options map[dit.Option]int
+			if tt.timeout > 0 {
+				options = map[dit.Option]int{dit.Timeout: tt.timeout}
+			}
+			rrq, err := dit.NewRRQ("file", "octet", options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := dialRaw(t, addr)
+			c.send(rrq, nil)
+			if tt.timeout > 0 {
+				p, tid := c.recv()
+				if _, ok := p.(*dit.OAckPacket); !ok {
+					t.Fatalf("got %s, want an OACK", dit.Describe(p))
+				}
+				c.send(dit.NewAck(0), tid)
+			}
+
+			// the first block is not acknowledged, the time until it is
+			// sent again is the retransmit timeout
+			p, _ := c.recv()
+			sent := time.Now()
+			if _, ok := p.(*dit.DataPacket); !ok {
+				t.Fatalf("got %s, want block 1", dit.Describe(p))
+			}
+			p, _ = c.recv()
+			if _, ok := p.(*dit.DataPacket); !ok {
+				t.Fatalf("got %s, want block 1 again", dit.Describe(p))
+			}
+			if wait := time.Since(sent); wait < tt.min || wait > tt.max {
+				t.Fatalf("block sent again after %v, want between %v and %v", wait, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestNegotiateWithoutOptions(t *testing.T) {
+	// every kind of option is negotiable, the request has none of them
+	addr, dir := startServer(t, func(o *Opts) {
+		o.Offset = true
+		o.Negotiate = func(*dit.ReadWriteRequest, dit.Option, int) (int, bool) { return 0, true }
+	})
+	if err := os.WriteFile(filepath.Join(dir, "file"), randomBytes(100), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range []dit.Opcode{dit.Rrq, dit.Wrq} {
+		req := &dit.ReadWriteRequest{Opcode: op, Filename: "file", Mode: "octet"}
+		if req.Options != nil {
+			t.Fatal("request has options")
+		}
+		c := dialRaw(t, addr)
+		c.send(req, nil)
+
+		// nothing to acknowledge, the transfer starts right away
+		p, _ := c.recv()
+		switch p := p.(type) {
+		case *dit.DataPacket:
+			if op != dit.Rrq || p.BlockNumber != 1 {
+				t.Fatalf("%s: got %s, want block 1", op, dit.Describe(p))
+			}
+		case *dit.AckPacket:
+			if op != dit.Wrq || p.BlockNumber != 0 {
+				t.Fatalf("%s: got %s, want the ack of block 0", op, dit.Describe(p))
+			}
+		default:
+			t.Fatalf("%s: got %s, want the transfer to start", op, dit.Describe(p))
+		}
+	}
+}
+
+func TestUploadPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		create, noOverwrite bool
+		existing, fresh     dit.ErrorCode // refusal of the upload, 0 if it is accepted
+	}{
+		{create: false, noOverwrite: false, existing: 0, fresh: dit.FileNotFound},
+		{create: true, noOverwrite: false, existing: 0, fresh: 0},
+		{create: false, noOverwrite: true, existing: dit.FileAlreadyExists, fresh: dit.FileNotFound},
+		{create: true, noOverwrite: true, existing: dit.FileAlreadyExists, fresh: 0},
+	} {
+		name := fmt.Sprintf("--create=%v --no-overwrite=%v", tt.create, tt.noOverwrite)
+		addr, dir := startServer(t, func(o *Opts) {
+			o.Create = tt.create
+			o.NoOverwrite = tt.noOverwrite
+		})
+		old := randomBytes(100)
+		if err := os.WriteFile(filepath.Join(dir, "existing"), old, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		for file, refused := range map[string]dit.ErrorCode{"existing": tt.existing, "fresh": tt.fresh} {
+			want := randomBytes(700)
+			_, err := new(dit.Client).Put(addr, file, bytes.NewReader(want))
+			got, _ := os.ReadFile(filepath.Join(dir, file))
+			if refused == 0 {
+				if err != nil {
+					t.Errorf("%s: upload of %s failed: %v", name, file, err)
+				} else if !bytes.Equal(got, want) {
+					t.Errorf("%s: %s is not the uploaded file", name, file)
+				}
+				continue
+			}
+			if err == nil || !strings.Contains(err.Error(), refused.String()) {
+				t.Errorf("%s: upload of %s failed with %v, want %s", name, file, err, refused)
+			}
+			if file == "existing" && !bytes.Equal(got, old) {
+				t.Errorf("%s: refused upload changed %s", name, file)
+			}
+		}
+	}
+}
+
+func TestMaxFileSize(t *testing.T) {
+	addr, dir := startServer(t, func(o *Opts) { o.MaxFileSize = 1000 })
+	client := new(dit.Client)
+	for _, size := range []int{900, 1000} {
+		want := randomBytes(size)
+		name := fmt.Sprintf("file%d", size)
+		if _, err := client.Put(addr, name, bytes.NewReader(want)); err != nil {
+			t.Fatalf("upload of %d bytes: %v", size, err)
+		}
+		var buf bytes.Buffer
+		if _, err := client.Get(addr, name, &buf); err != nil {
+			t.Fatalf("download of %d bytes: %v", size, err)
+		}
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Fatalf("downloaded %d bytes that differ from the %d uploaded", buf.Len(), size)
+		}
+	}
+
+	// an upload going past the quota is aborted and leaves nothing behind
+	_, err := client.Put(addr, "large", bytes.NewReader(randomBytes(2000)))
+	if err == nil || !strings.Contains(err.Error(), dit.DiskFull.String()) {
+		t.Fatalf("upload past the quota failed with %v, want %s", err, dit.DiskFull)
+	}
+	waitGone(t, dir, "file900", "file1000")
+
+	// one announcing it with tsize is refused before it starts
+	c := dialRaw(t, addr)
+	p, _ := c.startWrite("large", map[dit.Option]int{dit.Tsize: 2000})
+	if e, ok := p.(*dit.ErrorPacket); !ok || e.ErrorCode != dit.DiskFull {
+		t.Fatalf("got %s, want a disk full error", dit.Describe(p))
+	}
+
+	// a file past the quota is not served
+	if err := os.WriteFile(filepath.Join(dir, "large"), randomBytes(2000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(addr, "large", io.Discard); err == nil || !strings.Contains(err.Error(), dit.AccessViolation.String()) {
+		t.Fatalf("download past the quota failed with %v, want %s", err, dit.AccessViolation)
+	}
+}
+
+func TestTsizeNetascii(t *testing.T) {
+	// every line ending grows to CR LF on the wire in netascii
+	addr, dir := startServer(t, nil)
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("one\ntwo\nthree\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, mode := range []string{"octet", "netascii"} {
+		rrq, err := dit.NewRRQ("file", mode, map[dit.Option]int{dit.Tsize: 0, dit.Blksize: 1024})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := dialRaw(t, addr)
+		c.send(rrq, nil)
+		p, _ := c.recv()
+		oack, ok := p.(*dit.OAckPacket)
+		if !ok {
+			t.Fatalf("%s: got %s, want an OACK", mode, dit.Describe(p))
+		}
+		size, acked := oack.Options[dit.Tsize]
+		switch {
+		case mode == "octet" && (!acked || size != 14):
+			t.Errorf("octet: acknowledged %s, want the tsize of 14 bytes of the file", dit.Describe(oack))
+		case mode == "netascii" && acked:
+			t.Errorf("netascii: acknowledged tsize %d, which is not what the transfer sends", size)
+		}
+	}
+}
+
+func TestPeerGone(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("refused datagrams are reported to the socket on linux")
+	}
+	dir := t.TempDir()
+	opts, _ := NewOpts()
+	opts.Secure = dir
+	opts.Address = "127.0.0.1:0"
+	opts.Retransmit = 100000
+	opts.MaxRetries = 100
+	srv, err := StartServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	if err := os.WriteFile(filepath.Join(dir, "file"), randomBytes(2000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the client goes away after the first block, the server hears of it
+	// from the port unreachable of its retransmission instead of retrying
+	// for ten seconds
+	c := dialRaw(t, srv.Addr().String())
+	rrq, err := dit.NewRRQ("file", "octet", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.send(rrq, nil)
+	c.recv()
+	c.conn.Close()
+	for i := 0; ; i++ {
+		if srv.Snapshot().Active == 0 {
+			break
+		}
+		if i == 200 {
+			t.Fatal("transfer still in progress two seconds after the client went away")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the server goes on serving
+	if _, err := new(dit.Client).Get(srv.Addr().String(), "file", io.Discard); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHealthFile(t *testing.T) {
+	addr, dir := startServer(t, func(o *Opts) { o.Health = ".dit-health" })
+	// the probe is answered even with the directory gone
+	if err := os.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	client := new(dit.Client)
+	var buf bytes.Buffer
+	if _, err := client.Get(addr, ".dit-health", &buf); err != nil {
+		t.Fatalf("probe failed: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), healthResponse) {
+		t.Fatalf("probe answered with %q, want %q", buf.Bytes(), healthResponse)
+	}
+	_, err := client.Get(addr, "missing", io.Discard)
+	if err == nil || !strings.Contains(err.Error(), dit.FileNotFound.String()) {
+		t.Fatalf("request for a missing file failed with %v, want %s", err, dit.FileNotFound)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	for _, keepalive := range []bool{false, true} {
+		addr, dir := startServer(t, func(o *Opts) {
+			o.Keepalive = keepalive
+			o.Retransmit = 400000
+		})
+		c := dialRaw(t, addr)
+		p, tid := c.startWrite("file", nil)
+		if ack, ok := p.(*dit.AckPacket); !ok || ack.BlockNumber != 0 {
+			t.Fatalf("got %s, want the ack of block 0", dit.Describe(p))
+		}
+
+		// the client stalls for less than the retransmit timeout, with
+		// --keepalive the server nudges it halfway through
+		acked := time.Now()
+		p, _, err := c.tryRecv(300 * time.Millisecond)
+		switch {
+		case keepalive && err != nil:
+			t.Fatalf("--keepalive: no ack sent again within 300ms: %v", err)
+		case keepalive:
+			if ack, ok := p.(*dit.AckPacket); !ok || ack.BlockNumber != 0 {
+				t.Fatalf("--keepalive: got %s, want the ack of block 0 again", dit.Describe(p))
+			}
+			if wait := time.Since(acked); wait < 150*time.Millisecond {
+				t.Fatalf("--keepalive: ack sent again after %v, want about half of 400ms", wait)
+			}
+		case err == nil:
+			t.Fatalf("got %s before the retransmit timeout", dit.Describe(p))
+		}
+
+		// the transfer goes on where it was
+		want := randomBytes(100)
+		c.send(data(t, 1, want), tid)
+		for {
+			p, _ := c.recv()
+			if ack, ok := p.(*dit.AckPacket); ok && ack.BlockNumber == 1 {
+				break
+			} else if !ok || ack.BlockNumber != 0 {
+				t.Fatalf("got %s, want the ack of block 1", dit.Describe(p))
+			}
+		}
+		if got, _ := os.ReadFile(filepath.Join(dir, "file")); !bytes.Equal(got, want) {
+			t.Fatalf("file is %d bytes, want the %d sent", len(got), len(want))
+		}
+	}
+}
+
+func TestBlockSize8(t *testing.T) {
+	for size, valid := range map[int]bool{7: false, 8: true, 512: true, 65464: true, 65465: false} {
+		opts, _ := NewOpts()
+		opts.BlockSize = size
+		if _, err := opts.connConfig(); (err == nil) != valid {
+			t.Errorf("--blocksize %d: got error %v, want valid %v", size, err, valid)
+		}
+	}
+
+	// a server capped at the smallest block grants it to a client asking for
+	// more, the transfer takes a block for every 8 bytes
+	addr, dir := startServer(t, func(o *Opts) { o.BlockSize = 8 })
+	for _, size := range []int{0, 7, 8, 9, 1000} {
+		want := randomBytes(size)
+		if err := os.WriteFile(filepath.Join(dir, "file"), want, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		conn, err := (&dit.Client{Blksize: 1024}).Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		_, err = conn.Get("file", &buf)
+		negotiated := conn.NegotiatedOptions()
+		conn.Close()
+		if err != nil {
+			t.Fatalf("file of %d bytes: %v", size, err)
+		}
+		if negotiated[dit.Blksize] != 8 {
+			t.Fatalf("file of %d bytes: negotiated %v, want blksize 8", size, negotiated)
+		}
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Fatalf("file of %d bytes downloaded as %d bytes that differ", size, buf.Len())
+		}
+	}
+}
+
+// registered once for the test binary, options can not be unregistered
+var vendorOpt, vendorErr = dit.RegisterOption("x-vendor", func(val string) (int, error) { return strconv.Atoi(val) })
+
+func TestNegotiateRegisteredOption(t *testing.T) {
+	if vendorErr != nil {
+		t.Fatal(vendorErr)
+	}
+	// the server grants at most 10
+	addr, dir := startServer(t, func(o *Opts) {
+		o.Negotiate = func(req *dit.ReadWriteRequest, opt dit.Option, val int) (int, bool) {
+			if opt != vendorOpt {
+				return 0, false
+			}
+			if val > 10 {
+				val = 10
+			}
+			return val, true
+		}
+	})
+	if err := os.WriteFile(filepath.Join(dir, "file"), randomBytes(100), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rrq, err := dit.NewRRQ("file", "octet", map[dit.Option]int{vendorOpt: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := dialRaw(t, addr)
+	c.send(rrq, nil)
+	want, _ := dit.NewOAck(map[dit.Option]int{vendorOpt: 10})
+	c.expect(want)
+}
+
+func TestReadOnly(t *testing.T) {
+	addr, dir := startServer(t, func(o *Opts) {
+		o.Create = true
+		o.ReadOnly = true
+	})
+	old := randomBytes(100)
+	if err := os.WriteFile(filepath.Join(dir, "existing"), old, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c := dialRaw(t, addr)
+	for _, file := range []string{"existing", "fresh"} {
+		p, _ := c.startWrite(file, nil)
+		if e, ok := p.(*dit.ErrorPacket); !ok || e.ErrorCode != dit.AccessViolation {
+			t.Fatalf("write request for %s answered with %s, want an access violation", file, dit.Describe(p))
+		}
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "existing")); !bytes.Equal(got, old) {
+		t.Fatal("refused upload changed the existing file")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "fresh")); !os.IsNotExist(err) {
+		t.Fatalf("refused upload created a file: %v", err)
+	}
+
+	// reads are still served
+	var buf bytes.Buffer
+	if _, err := new(dit.Client).Get(addr, "existing", &buf); err != nil || !bytes.Equal(buf.Bytes(), old) {
+		t.Fatalf("download from a read-only server failed: %v", err)
+	}
+}
+
+// closeNotifier reports on closed when it is closed
+type closeNotifier struct {
+	io.ReadWriter
+	closed chan struct{}
+}
+
+func (c closeNotifier) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestOpenTimeout(t *testing.T) {
+	release := make(chan struct{})
+	closed := make(chan struct{})
+	want := randomBytes(700)
+	addr, _ := startServer(t, func(o *Opts) {
+		o.OpenTimeout = 1
+		o.Open = func(path string, op dit.Opcode) (io.ReadWriteCloser, error) {
+			if filepath.Base(path) != "hung" {
+				return closeNotifier{bytes.NewBuffer(want), make(chan struct{})}, nil
+			}
+			// a filesystem that stops answering
+			<-release
+			return closeNotifier{new(bytes.Buffer), closed}, nil
+		}
+	})
+
+	c := dialRaw(t, addr)
+	rrq, err := dit.NewRRQ("hung", "octet", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	c.send(rrq, nil)
+	p, _ := c.recv()
+	if e, ok := p.(*dit.ErrorPacket); !ok || e.ErrorCode != dit.NotDefined {
+		t.Fatalf("got %s, want a not defined error", dit.Describe(p))
+	}
+	if d := time.Since(start); d < time.Second {
+		t.Fatalf("request refused after %v, before --open-timeout", d)
+	}
+
+	// the connection of the refused request is recycled for the next ones,
+	// which the open finishing late must not disturb
+	get := func() {
+		t.Helper()
+		var buf bytes.Buffer
+		if _, err := new(dit.Client).Get(addr, "file", &buf); err != nil || !bytes.Equal(buf.Bytes(), want) {
+			t.Fatalf("request after a timed out open failed: %v", err)
+		}
+	}
+	get()
+
+	// a file opened after the client was sent away is closed again
+	close(release)
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("file opened after the timeout was not closed")
+	}
+	get()
+}
+
+// logBuffer collects the log of a server, which writes it from many goroutines
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *logBuffer) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(b)
+}
+
+func (l *logBuffer) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.String()
+}
+
+func TestLogNegotiation(t *testing.T) {
+	var log logBuffer
+	addr, dir := startServer(t, func(o *Opts) { o.outputs(&log, io.Discard) })
+	if err := os.WriteFile(filepath.Join(dir, "file"), randomBytes(3000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := (&dit.Client{Blksize: 1024}).Get(addr, "file", &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	out := log.String()
+	if !strings.Contains(out, "negotiated <file=file>") {
+		t.Fatalf("negotiation not logged:\n%s", out)
+	}
+	if !strings.Contains(out, `accepted "OACK blksize=1024"`) {
+		t.Fatalf("log does not show the accepted blksize:\n%s", out)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	dir := t.TempDir()
+	opts, _ := NewOpts()
+	opts.Secure = dir
+	opts.Address = "127.0.0.1:0"
+	opts.Retransmit = 100000
+	opts.MaxRetries = 100
+	opts.IdleTimeout = 1
+	srv, err := StartServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	if err := os.WriteFile(filepath.Join(dir, "file"), randomBytes(2000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the client stops answering after the first block but keeps its port,
+	// the retransmissions alone would go on for ten seconds
+	c := dialRaw(t, srv.Addr().String())
+	rrq, err := dit.NewRRQ("file", "octet", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	c.send(rrq, nil)
+	c.recv()
+	for {
+		p, _, err := c.tryRecv(2 * time.Second)
+		if err != nil {
+			t.Fatalf("transfer not abandoned: %v", err)
+		}
+		if e, ok := p.(*dit.ErrorPacket); ok {
+			if e.ErrorCode != dit.NotDefined {
+				t.Fatalf("got %s, want a timeout error", dit.Describe(p))
+			}
+			break
+		}
+	}
+	if d := time.Since(start); d < time.Second || d > 2*time.Second {
+		t.Fatalf("transfer abandoned after %v, want about --idle-timeout", d)
+	}
+	for i := 0; srv.Snapshot().Active != 0; i++ {
+		if i == 100 {
+			t.Fatal("abandoned transfer still counted as active")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestForceMode(t *testing.T) {
+	addr, dir := startServer(t, func(o *Opts) { o.ForceMode = "octet" })
+	want := []byte("line one\nline two\r\x00binary\n")
+	if err := os.WriteFile(filepath.Join(dir, "file"), want, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the client asks for netascii and gets the bytes of the file untouched
+	c := dialRaw(t, addr)
+	rrq, err := dit.NewRRQ("file", "netascii", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.send(rrq, nil)
+	c.expect(data(t, 1, want))
+
+	opts, _ := NewOpts()
+	opts.Secure = dir
+	opts.Address = "127.0.0.1:0"
+	opts.ForceMode = "binary"
+	opts.outputs(io.Discard, io.Discard)
+	if s, err := newServer(opts); err == nil {
+		s.Close()
+		t.Fatal("server started with an unknown --force-mode")
+	}
+}
+
+func TestSupportedOptions(t *testing.T) {
+	addr, dir := startServer(t, nil)
+	if err := os.WriteFile(filepath.Join(dir, "file"), randomBytes(3000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// every supported option is acknowledged with the value the server
+	// settled on, tsize with the size of the file
+	requested := map[dit.Option]int{dit.Blksize: 1024, dit.Timeout: 2, dit.Tsize: 0}
+	accepted := map[dit.Option]int{dit.Blksize: 1024, dit.Timeout: 2, dit.Tsize: 3000}
+	for _, opt := range dit.SupportedOptions() {
+		val, ok := requested[opt]
+		if !ok {
+			t.Errorf("no value to request for supported option %s", opt)
+			continue
+		}
+		rrq, err := dit.NewRRQ("file", "octet", map[dit.Option]int{opt: val})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := dialRaw(t, addr)
+		c.send(rrq, nil)
+		want, err := dit.NewOAck(map[dit.Option]int{opt: accepted[opt]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.expect(want)
+	}
+}
+
+func TestBlksizeClamp(t *testing.T) {
+	for _, tt := range []struct {
+		blocksize, requested, granted int
+	}{
+		{0, 1024, 1024},
+		{0, 1468, 1468},
+		{0, 8192, 1468},
+		{0, 65464, 1468},
+		{9000, 8192, 8192},
+		{9000, 65464, 9000},
+		{65464, 65464, 65464},
+	} {
+		addr, dir := startServer(t, func(o *Opts) { o.BlockSize = tt.blocksize })
+		if err := os.WriteFile(filepath.Join(dir, "file"), randomBytes(100), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		rrq, err := dit.NewRRQ("file", "octet", map[dit.Option]int{dit.Blksize: tt.requested})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := dialRaw(t, addr)
+		c.send(rrq, nil)
+		p, _ := c.recv()
+		oack, ok := p.(*dit.OAckPacket)
+		if !ok || oack.Options[dit.Blksize] != tt.granted {
+			t.Errorf("--blocksize %d: request for blksize %d answered with %s, want blksize %d",
+				tt.blocksize, tt.requested, dit.Describe(p), tt.granted)
+		}
+	}
+}
+
+func TestLock(t *testing.T) {
+	for _, mode := range []string{lockRefuse, lockWait} {
+		addr, dir := startServer(t, func(o *Opts) { o.Lock = mode })
+		old := randomBytes(1000)
+		if err := os.WriteFile(filepath.Join(dir, "file"), old, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		// an upload of the file is left halfway
+		want := randomBytes(700)
+		c := dialRaw(t, addr)
+		p, tid := c.startWrite("file", nil)
+		if _, ok := p.(*dit.AckPacket); !ok {
+			t.Fatalf("--lock=%s: got %s, want an ACK", mode, dit.Describe(p))
+		}
+		c.send(data(t, 1, want[:512]), tid)
+		c.expect(dit.NewAck(1))
+
+		// a read of the file meanwhile is refused or waits for the upload
+		type result struct {
+			b   []byte
+			err error
+		}
+		done := make(chan result, 1)
+		go func() {
+			var buf bytes.Buffer
+			_, err := new(dit.Client).Get(addr, "file", &buf)
+			done <- result{buf.Bytes(), err}
+		}()
+		if mode == lockRefuse {
+			r := <-done
+			if r.err == nil || !strings.Contains(r.err.Error(), "file is busy") {
+				t.Fatalf("--lock=%s: read during an upload failed with %v, want file is busy", mode, r.err)
+			}
+		} else {
+			select {
+			case r := <-done:
+				t.Fatalf("--lock=%s: read of %d bytes during an upload did not wait: %v", mode, len(r.b), r.err)
+			case <-time.After(200 * time.Millisecond):
+			}
+		}
+
+		// the ack of block 1 is retransmitted while the read waits
+		c.send(data(t, 2, want[512:]), tid)
+		for {
+			p, _ := c.recv()
+			if dit.Describe(p) == dit.Describe(dit.NewAck(2)) {
+				break
+			}
+			if dit.Describe(p) != dit.Describe(dit.NewAck(1)) {
+				t.Fatalf("--lock=%s: got %s, want ACK block=2", mode, dit.Describe(p))
+			}
+		}
+		if mode == lockWait {
+			// the waiting read gets the uploaded file whole
+			r := <-done
+			if r.err != nil {
+				t.Fatalf("--lock=%s: read after the upload: %v", mode, r.err)
+			}
+			if !bytes.Equal(r.b, want) {
+				t.Fatalf("--lock=%s: read %d bytes that are not the uploaded file", mode, len(r.b))
+			}
+		}
+	}
+}
+
+func TestUnknownSize(t *testing.T) {
+	streams := map[string][]byte{"stream1000": randomBytes(1000), "stream1024": randomBytes(1024)}
+	addr, _ := startServer(t, func(o *Opts) {
+		o.Virtual = func(req *dit.ReadWriteRequest, remote netip.AddrPort) (io.ReadCloser, int64, error) {
+			// a reader that can not tell its size, like a pipe
+			return io.NopCloser(io.MultiReader(bytes.NewReader(streams[req.Filename]))), -1, nil
+		}
+	})
+
+	// tsize is left out of the acknowledgement, the other options are kept
+	rrq, err := dit.NewRRQ("stream1000", "octet", map[dit.Option]int{dit.Tsize: 0, dit.Blksize: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := dialRaw(t, addr)
+	c.send(rrq, nil)
+	want, _ := dit.NewOAck(map[dit.Option]int{dit.Blksize: 512})
+	c.expect(want)
+
+	// the stream is sent until it ends, one of whole blocks with an empty one
+	for name, want := range streams {
+		var buf bytes.Buffer
+		if _, err := new(dit.Client).Get(addr, name, &buf); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Fatalf("%s: got %d bytes that differ from the %d of the stream", name, buf.Len(), len(want))
+		}
+	}
+}
+
+// writeRecorder keeps the size of every write to a file, with the content
+type writeRecorder struct {
+	mu     sync.Mutex
+	writes []int
+	bytes.Buffer
+}
+
+func (w *writeRecorder) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writes = append(w.writes, len(b))
+	return w.Buffer.Write(b)
+}
+
+func (w *writeRecorder) Close() error { return nil }
+
+func TestFlushEvery(t *testing.T) {
+	want := randomBytes(10000)
+	for _, tt := range []struct {
+		every  int
+		writes []int
+	}{
+		{0, []int{10000}},
+		{4, []int{2048, 2048, 2048, 2048, 1808}},
+	} {
+		w := new(writeRecorder)
+		addr, _ := startServer(t, func(o *Opts) {
+			o.FlushEvery = tt.every
+			o.Open = func(string, dit.Opcode) (io.ReadWriteCloser, error) { return w, nil }
+		})
+		if _, err := new(dit.Client).Put(addr, "file", bytes.NewReader(want)); err != nil {
+			t.Fatalf("--flush-every %d: %v", tt.every, err)
+		}
+		w.mu.Lock()
+		writes, got := w.writes, w.Bytes()
+		w.mu.Unlock()
+		if fmt.Sprint(writes) != fmt.Sprint(tt.writes) {
+			t.Errorf("--flush-every %d: upload written in %v bytes, want %v", tt.every, writes, tt.writes)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("--flush-every %d: wrote %d bytes that differ from the upload", tt.every, len(got))
+		}
+	}
+}
+
+func TestOAckOnlyRequested(t *testing.T) {
+	// everything the server can negotiate is turned on
+	addr, dir := startServer(t, func(o *Opts) {
+		o.Offset = true
+		o.BlockSize = 1024
+		o.Negotiate = func(*dit.ReadWriteRequest, dit.Option, int) (int, bool) { return 1, true }
+	})
+	if err := os.WriteFile(filepath.Join(dir, "file"), randomBytes(3000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		requested, acked map[dit.Option]int
+	}{
+		{map[dit.Option]int{dit.Blksize: 1024}, map[dit.Option]int{dit.Blksize: 1024}},
+		{map[dit.Option]int{dit.Tsize: 0}, map[dit.Option]int{dit.Tsize: 3000}},
+		{map[dit.Option]int{dit.Blksize: 2048, dit.Timeout: 3}, map[dit.Option]int{dit.Blksize: 1024, dit.Timeout: 3}},
+	} {
+		rrq, err := dit.NewRRQ("file", "octet", tt.requested)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := dialRaw(t, addr)
+		c.send(rrq, nil)
+		want, _ := dit.NewOAck(tt.acked)
+		c.expect(want)
+	}
+
+	// a refused option is left out like an unknown one, with nothing left
+	// to acknowledge the transfer starts right away
+	addr, dir = startServer(t, func(o *Opts) { o.Refuse = "blksize" })
+	want := randomBytes(100)
+	if err := os.WriteFile(filepath.Join(dir, "file"), want, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rrq, err := dit.NewRRQ("file", "octet", map[dit.Option]int{dit.Blksize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := dialRaw(t, addr)
+	c.send(rrq, nil)
+	c.expect(data(t, 1, want))
+}
+
+func TestWritable(t *testing.T) {
+	addr, dir := startServer(t, func(o *Opts) { o.Writable = []string{"uploads"} })
+	for _, sub := range []string{"uploads/nested", "assets"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for file, refused := range map[string]bool{
+		"uploads/file":        false,
+		"uploads/nested/file": false,
+		"assets/file":         true,
+		"file":                true,
+		"uploads":             true,
+		"uploads-other":       true,
+	} {
+		want := randomBytes(700)
+		_, err := new(dit.Client).Put(addr, file, bytes.NewReader(want))
+		got, _ := os.ReadFile(filepath.Join(dir, file))
+		if !refused {
+			if err != nil {
+				t.Errorf("upload of %s failed: %v", file, err)
+			} else if !bytes.Equal(got, want) {
+				t.Errorf("%s is not the uploaded file", file)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), dit.AccessViolation.String()) {
+			t.Errorf("upload of %s failed with %v, want %s", file, err, dit.AccessViolation)
+		}
+		if bytes.Equal(got, want) {
+			t.Errorf("refused upload of %s was written", file)
+		}
+	}
+}
+
+func TestRuntDatagram(t *testing.T) {
+	addr, dir := startServer(t, nil)
+	want := randomBytes(1000)
+	if err := os.WriteFile(filepath.Join(dir, "file"), want, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	runts := [][]byte{nil, {0}}
+
+	// datagrams too short for an opcode to the listener and into a transfer
+	c := dialRaw(t, addr)
+	for _, b := range runts {
+		if _, err := c.conn.WriteToUDP(b, c.server); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rrq, err := dit.NewRRQ("file", "octet", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.send(rrq, nil)
+	p, tid := c.recv()
+	if dit.Describe(p) != dit.Describe(data(t, 1, want[:512])) {
+		t.Fatalf("got %s, want block 1", dit.Describe(p))
+	}
+	for _, b := range runts {
+		if _, err := c.conn.WriteToUDP(b, tid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.send(dit.NewAck(1), tid)
+	for {
+		p, _ := c.recv()
+		if dit.Describe(p) == dit.Describe(data(t, 2, want[512:])) {
+			break
+		}
+		if dit.Describe(p) != dit.Describe(data(t, 1, want[:512])) {
+			t.Fatalf("got %s, want block 2", dit.Describe(p))
+		}
+	}
+	c.send(dit.NewAck(2), tid)
+
+	// the server is still up
+	var buf bytes.Buffer
+	if _, err := new(dit.Client).Get(addr, "file", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("downloaded %d bytes that differ from the %d of the file", buf.Len(), len(want))
+	}
+}
+
+func TestLogResolvedPath(t *testing.T) {
+	var log logBuffer
+	addr, dir := startServer(t, func(o *Opts) {
+		o.Verbose = true
+		o.outputs(&log, io.Discard)
+	})
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "file"), randomBytes(100), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := new(dit.Client).Get(addr, "sub/../file", io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	// the name of the client is logged as sent, the path cleaned
+	want := fmt.Sprintf("<file=sub/../file> to %s\n", filepath.Join(dir, "file"))
+	if out := log.String(); !strings.Contains(out, want) {
+		t.Fatalf("log does not show %q:\n%s", want, out)
+	}
+
+	// a name that climbs out is refused before it is resolved
+	if _, err := new(dit.Client).Get(addr, "sub/../../file", io.Discard); err == nil {
+		t.Fatal("read of a file outside the directory succeeded")
+	}
+	out := log.String()
+	if want := "refused Rrq <file=sub/../../file>: " + errOutsideDir.Error(); !strings.Contains(out, want) {
+		t.Fatalf("log does not show %q:\n%s", want, out)
+	}
+	if strings.Contains(out, "resolved Rrq <file=sub/../../file>") {
+		t.Fatalf("log shows the refused name as resolved:\n%s", out)
+	}
+}
+
+func TestReadOutsideDir(t *testing.T) {
+	addr, dir := startServer(t, nil)
+	// a file next to the served directory, one climb away
+	if err := os.WriteFile(filepath.Join(dir, "..", "x"), []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"../x", "/etc/passwd", "sub/../../x", ".."} {
+		c := dialRaw(t, addr)
+		rrq, err := dit.NewRRQ(name, "octet", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.send(rrq, nil)
+		p, _ := c.recv()
+		if e, ok := p.(*dit.ErrorPacket); !ok || e.ErrorCode != dit.AccessViolation {
+			t.Errorf("read request for %s answered with %s, want an access violation", name, dit.Describe(p))
+		}
+	}
+}
+
+func TestWriteOutsideDir(t *testing.T) {
+	// --create is on, a write outside the directory would make a new file
+	addr, dir := startServer(t, nil)
+	outside := filepath.Join(dir, "..", "x")
+	old := []byte("keep")
+	if err := os.WriteFile(outside, old, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"../x", "../new", "/tmp/new", "sub/../../x"} {
+		c := dialRaw(t, addr)
+		p, _ := c.startWrite(name, nil)
+		if e, ok := p.(*dit.ErrorPacket); !ok || e.ErrorCode != dit.AccessViolation {
+			t.Errorf("write request for %s answered with %s, want an access violation", name, dit.Describe(p))
+		}
+	}
+	if got, _ := os.ReadFile(outside); !bytes.Equal(got, old) {
+		t.Fatal("file outside the directory overwritten")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "..", "new")); !os.IsNotExist(err) {
+		t.Fatalf("file created outside the directory: %v", err)
+	}
+}
+
+func TestSyncBeforeRename(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		ops []string
+	)
+	record := func(op string) {
+		mu.Lock()
+		defer mu.Unlock()
+		ops = append(ops, op)
+	}
+	fsync = func(f *os.File) error {
+		record("sync " + filepath.Base(f.Name()))
+		return f.Sync()
+	}
+	rename = func(from, to string) error {
+		record("rename " + filepath.Base(from))
+		return os.Rename(from, to)
+	}
+	t.Cleanup(func() { fsync, rename = (*os.File).Sync, os.Rename })
+
+	for _, durable := range []bool{true, false} {
+		mu.Lock()
+		ops = nil
+		mu.Unlock()
+		addr, dir := startServer(t, func(o *Opts) { o.Sync = durable })
+		content := randomBytes(1500)
+		if _, err := new(dit.Client).Put(addr, "file", bytes.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := os.ReadFile(filepath.Join(dir, "file")); err != nil || !bytes.Equal(got, content) {
+			t.Fatalf("--sync=%v: uploaded file differs: %v", durable, err)
+		}
+
+		// the ack of the last block is only sent once the file is in place
+		mu.Lock()
+		got := strings.Join(ops, ", ")
+		mu.Unlock()
+		tmp := got[strings.LastIndex(got, " ")+1:]
+		want := "rename " + tmp
+		if durable {
+			want = "sync " + tmp + ", " + want
+		}
+		if !strings.HasPrefix(tmp, ".file.") || got != want {
+			t.Fatalf("--sync=%v: got %q, want %q", durable, got, want)
+		}
+	}
+}
+
+func TestFinalAckLost(t *testing.T) {
+	var log logBuffer
+	dir := t.TempDir()
+	opts, _ := NewOpts()
+	opts.Secure = dir
+	opts.Address = "127.0.0.1:0"
+	opts.Retransmit = 100000
+	opts.outputs(&log, &log)
+	srv, err := StartServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	if err := os.WriteFile(filepath.Join(dir, "file"), randomBytes(700), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := dialRaw(t, srv.Addr().String())
+	rrq, err := dit.NewRRQ("file", "octet", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.send(rrq, nil)
+	_, tid := c.recv()
+	c.send(dit.NewAck(1), tid)
+
+	// the ack of the short last block is lost once, the server sends the
+	// block again and the transfer completes with the second ack
+	for i := 0; i < 2; i++ {
+		p, _ := c.recv()
+		if d, ok := p.(*dit.DataPacket); !ok || d.BlockNumber != 2 {
+			t.Fatalf("got %s, want the last block", dit.Describe(p))
+		}
+	}
+	c.send(dit.NewAck(2), tid)
+	if p, _, err := c.tryRecv(300 * time.Millisecond); err == nil {
+		t.Fatalf("got %s after the last ack", dit.Describe(p))
+	}
+	for i := 0; srv.Snapshot().Active != 0; i++ {
+		if i == 100 {
+			t.Fatal("transfer still active after the last ack")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if out := log.String(); strings.Contains(out, "unconfirmed") || strings.Contains(out, "failed") {
+		t.Fatalf("transfer did not complete:\n%s", out)
+	}
+}
@@ -3,6 +3,8 @@ package server
 
 import (
 	"context"
+	"fmt"
+	"io/fs"
 	"net"
 	"os"
 	"syscall"
@@ -11,19 +13,34 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-func udpListen(addr string) (conn *dit.Conn, err error) {
+// udpListen binds the listening socket of the server to addr. The socket is
+// bound with SO_REUSEADDR, which lets a restarted server bind while replies of
+// the old one linger. It also lets another server that sets it bind the same
+// address without an error, the kernel then hands each request to only one of
+// them, so running two servers on one address is not detected
+func udpListen(addr string, priority int) (conn *dit.Conn, err error) {
 	config := &net.ListenConfig{
 		Control: func(net, addr string, c syscall.RawConn) error {
-			return c.Control(func(fd uintptr) {
+			var serr error
+			err := c.Control(func(fd uintptr) {
 				// set socket option to let multiple processes to
 				// listen on the same port
 				unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
 
-				// set the priority of the socket high to recieve the
-				// fucking packets becuase no packets are coming
-				// socket priority [low - high] => [1 - 7]
-				unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, syscall.SO_PRIORITY, 7)
+				if serr = setPriority(fd, priority); serr != nil {
+					serr = fmt.Errorf("failed to set socket priority %d: %w", priority, serr)
+				}
+
+				// ask for the destination address of recieved packets so
+				// replies leave from the address the client sent to. only
+				// one of these succeeds depending on the socket family
+				unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_PKTINFO, 1)
+				unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_RECVPKTINFO, 1)
 			})
+			if err != nil {
+				return err
+			}
+			return serr
 		},
 	}
 
@@ -37,3 +54,10 @@ func restartProcess() error {
 	proc := "/proc/self/exe"
 	return syscall.Exec(proc, os.Args, os.Environ())
 }
+
+// shared reports whether the file of fi has other hard links or belongs to
+// another user, which replacing it with a new file would cut off
+func shared(fi fs.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && (st.Nlink > 1 || int(st.Uid) != os.Geteuid())
+}
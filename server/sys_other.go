@@ -0,0 +1,59 @@
+//go:build !linux && !windows
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/Joe-Degs/dit"
+	"golang.org/x/sys/unix"
+)
+
+// udpListen binds the listening socket of the server to addr with
+// SO_REUSEADDR, see the linux version. Replies leave from the address the
+// kernel picks, the destination of requests is not known on these platforms
+func udpListen(addr string, priority int) (conn *dit.Conn, err error) {
+	config := &net.ListenConfig{
+		Control: func(net, addr string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+
+				if serr = setPriority(fd, priority); serr != nil {
+					serr = fmt.Errorf("failed to set socket priority %d: %w", priority, serr)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+
+	if conn, err = dit.ListenConfigConn(context.Background(), config, addr); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// restartProcess replaces the process with a new run of its executable, there
+// is no /proc/self/exe to exec on these platforms
+func restartProcess() error {
+	proc, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(proc, os.Args, os.Environ())
+}
+
+// shared reports whether the file of fi has other hard links or belongs to
+// another user, which replacing it with a new file would cut off
+func shared(fi fs.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && (st.Nlink > 1 || int(st.Uid) != os.Geteuid())
+}
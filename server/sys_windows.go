@@ -0,0 +1,68 @@
+//go:build windows
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/Joe-Degs/dit"
+	"golang.org/x/sys/windows"
+)
+
+// udpListen binds the listening socket of the server to addr. On windows
+// SO_REUSEADDR lets any other socket bind the same address, even one taking
+// requests away from a running server, so a second server is never refused
+func udpListen(addr string, priority int) (conn *dit.Conn, err error) {
+	config := &net.ListenConfig{
+		Control: func(net, addr string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				// set socket option to let multiple processes to
+				// listen on the same port
+				windows.SetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, windows.SO_REUSEADDR, 1)
+
+				if serr = setPriority(fd, priority); serr != nil {
+					serr = fmt.Errorf("failed to set socket priority %d: %w", priority, serr)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+
+	if conn, err = dit.ListenConfigConn(context.Background(), config, addr); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// restartProcess starts the executable again with the same arguments and exits
+// when it is running, windows cannot replace a running process like exec
+func restartProcess() error {
+	proc, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(proc, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = os.Environ()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	os.Exit(0)
+	return nil
+}
+
+// shared reports whether replacing the file of fi with a new file would cut it
+// off from its other names or owner, which is not checked on windows
+func shared(fi fs.FileInfo) bool {
+	return false
+}
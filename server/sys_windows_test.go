@@ -0,0 +1,44 @@
+//go:build windows
+
+package server
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Joe-Degs/dit"
+)
+
+// TestServeWindows is a smoke test that the server binds and serves a file on
+// windows
+func TestServeWindows(t *testing.T) {
+	addr, dir := startServer(t, nil)
+	want := []byte("hello from windows\n")
+	if err := os.WriteFile(filepath.Join(dir, "file"), want, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := new(dit.Client).Get(addr, "file", &buf); err != nil {
+		t.Fatalf("get from %s: %v", addr, err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("got %q, want %q", buf.Bytes(), want)
+	}
+}
+
+// TestUDPListenReuseWindows checks that SO_REUSEADDR is set, a second socket
+// binds the address of a listening one
+func TestUDPListenReuseWindows(t *testing.T) {
+	c, err := udpListen("127.0.0.1:0", 0)
+	if err != nil {
+		t.Fatalf("failed to bind: %v", err)
+	}
+	defer c.Close()
+	again, err := udpListen(c.Addr().String(), 0)
+	if err != nil {
+		t.Fatalf("failed to bind %s again: %v", c.Addr(), err)
+	}
+	again.Close()
+}
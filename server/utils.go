@@ -4,11 +4,22 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/Joe-Degs/dit"
 )
 
-var verbose bool
+// logging levels set with --verbosity
+const (
+	levelQuiet = iota // only errors
+	levelInfo         // errors and informational messages
+	levelDebug        // everything above and details of requests
+	levelTrace        // everything above and every packet of a transfer
+)
 
 const (
 	reset  = "\033[0m"
@@ -21,15 +32,75 @@ func dirExists(filename string) bool {
 	return err == nil && fi.IsDir()
 }
 
+// tftpPort is the port of the tftp service, used when the system does not
+// know the service by name
+const tftpPort = 69
+
+// listenAddress turns the --address value, [host][:port], into an address to
+// listen on. The port can be a service name like tftp and defaults to the tftp
+// port when left out, the host can be a name or an ip address
+func listenAddress(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// a host without a port, possibly a bracketed ipv6 address
+		host, port = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"), "tftp"
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		p, err := net.LookupPort("udp", port)
+		switch {
+		case err == nil:
+			port = strconv.Itoa(p)
+		case port == "tftp":
+			port = strconv.Itoa(tftpPort)
+		default:
+			return "", fmt.Errorf("invalid --address %q: unknown port %q", addr, port)
+		}
+	}
+	if host != "" && net.ParseIP(host) == nil {
+		if _, err := net.LookupHost(host); err != nil {
+			return "", fmt.Errorf("invalid --address %q: could not resolve host %q: %w", addr, host, err)
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// the first file descriptor passed by systemd socket activation, see
+// sd_listen_fds(3)
+const listenFdsStart = 3
+
+// systemdListen returns a listening connection from the first socket passed
+// to the process by systemd socket activation
+func systemdListen() (*dit.Conn, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, fmt.Errorf("no sockets passed by systemd: LISTEN_PID is not set to this process")
+	}
+	if n, err := strconv.Atoi(os.Getenv("LISTEN_FDS")); err != nil || n < 1 {
+		return nil, fmt.Errorf("no sockets passed by systemd: LISTEN_FDS is not set")
+	}
+
+	// the variables are not meant for child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	conn, err := dit.ListenFD(listenFdsStart)
+	if err != nil {
+		return nil, err
+	}
+	// the connection has its own copy of the socket
+	os.NewFile(listenFdsStart, "systemd socket").Close()
+	return conn, nil
+}
+
 type logger struct {
 	*log.Logger
 	prefix   string
+	level    int
 	writeErr bool
 	out, err io.Writer
 }
 
-func newlogger(prefix string, out, err io.Writer) *logger {
-	l := &logger{prefix: prefix, out: out, err: err}
+func newlogger(prefix string, level int, out, err io.Writer) *logger {
+	l := &logger{prefix: prefix, level: level, out: out, err: err}
 	l.Logger = log.New(l, prefix, 0)
 	return l
 }
@@ -51,6 +122,9 @@ func green(s string) string {
 }
 
 func (l *logger) Info(format string, v ...any) {
+	if l.level < levelInfo {
+		return
+	}
 	pre := l.Prefix()
 	defer func() {
 		l.SetPrefix(pre)
@@ -78,7 +152,14 @@ func (l *logger) Fatalf(format string, v ...any) {
 }
 
 func (l *logger) Verbose(format string, v ...any) {
-	if verbose {
+	if l.level >= levelDebug {
+		l.Info(format, v...)
+	}
+}
+
+// Trace logs packet level details of transfers
+func (l *logger) Trace(format string, v ...any) {
+	if l.level >= levelTrace {
 		l.Info(format, v...)
 	}
 }
@@ -3,16 +3,23 @@
 package dit
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 	"unicode/utf8"
 )
 
 // Packet is a TFTP protocol packet
 type Packet interface {
+	// MarshalAppend appends the binary format of the packet to dst and
+	// returns the extended slice, like append. Building packets into a
+	// reused slice this way does not allocate
+	MarshalAppend(dst []byte) ([]byte, error)
+
 	opcode() Opcode
 	marshal() ([]byte, error)
 	unmarshal([]byte) error
@@ -23,8 +30,44 @@ func opcode(b []byte) Opcode {
 	return Opcode(binary.BigEndian.Uint16(b[0:2]))
 }
 
+// checkOpcode returns ErrUnknownOpcode if b starts with an opcode that is not
+// one of the six of rfc1350 and rfc2347, including the reserved opcode 0. It is
+// checked ahead of the length so short packets of an unknown opcode report it
+func checkOpcode(b []byte) error {
+	if len(b) < 2 {
+		return nil
+	}
+	if op := opcode(b); op < Rrq || op > OAck {
+		return fmt.Errorf("%w: %d", ErrUnknownOpcode, op)
+	}
+	return nil
+}
+
+// smallest valid packet, an opcode and a block number or error code
+const minPacketLen = 4
+
+// largest request accepted by a listener. rfc1350 keeps requests within the
+// 512 bytes of a data packet
+const maxRequestLen = 512
+
+var (
+	// ErrUnknownOpcode is returned when decoding a packet with an opcode
+	// that is not part of the protocol
+	ErrUnknownOpcode = errors.New("dit: opcode not recognized")
+
+	// ErrNilPacket is returned when encoding a nil packet
+	ErrNilPacket = errors.New("dit: cannot marshal nil packet")
+)
+
 // MarshalPacket marshals a binary packet into a packet structure
 func Marshal(b []byte) (Packet, error) {
+	if err := checkOpcode(b); err != nil {
+		return nil, err
+	}
+	if len(b) < minPacketLen {
+		return nil, fmt.Errorf("packet of %d bytes is too short", len(b))
+	}
+
 	var p Packet
 	switch op := opcode(b); op {
 	case Rrq, Wrq:
@@ -38,7 +81,7 @@ func Marshal(b []byte) (Packet, error) {
 	case Error:
 		p = &ErrorPacket{Opcode: op}
 	default:
-		return nil, fmt.Errorf("opcode %d not recognized", op)
+		return nil, fmt.Errorf("%w: %d", ErrUnknownOpcode, op)
 	}
 
 	if err := p.unmarshal(b); err != nil {
@@ -48,31 +91,236 @@ func Marshal(b []byte) (Packet, error) {
 	return p, nil
 }
 
+// DecodePacket decodes a binary packet into its packet structure, it is the
+// same as Marshal
+func DecodePacket(b []byte) (Packet, error) {
+	return Marshal(b)
+}
+
+// DecodePacketN decodes the packet at the start of b and returns the number of
+// bytes it occupied, for iterating over packets laid back to back in a buffer.
+// Packets carry no length, the end of request, option acknowledgement and error
+// packets is found from their null terminated strings and a data packet is
+// taken to run to the end of b
+func DecodePacketN(b []byte) (Packet, int, error) {
+	n, err := packetLen(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	p, err := Marshal(b[:n])
+	if err != nil {
+		return nil, 0, err
+	}
+	return p, n, nil
+}
+
+// packetLen returns the length of the packet at the start of b
+func packetLen(b []byte) (int, error) {
+	if err := checkOpcode(b); err != nil {
+		return 0, err
+	}
+	if len(b) < minPacketLen {
+		return 0, fmt.Errorf("packet of %d bytes is too short", len(b))
+	}
+
+	// skip returns the offset after the null terminated string at i
+	skip := func(i int) (int, error) {
+		end := bytes.IndexByte(b[i:], 0)
+		if end < 0 {
+			return 0, fmt.Errorf("dit: unterminated string at byte %d", i)
+		}
+		return i + end + 1, nil
+	}
+	// options run until the next packet, which starts with the null high
+	// byte of its opcode, or the end of b
+	skipOptions := func(i int) (int, error) {
+		var err error
+		for i < len(b) && b[i] != 0 {
+			if i, err = skip(i); err != nil {
+				return 0, err
+			}
+			if i, err = skip(i); err != nil {
+				return 0, err
+			}
+		}
+		return i, nil
+	}
+
+	switch op := opcode(b); op {
+	case Rrq, Wrq:
+		i, err := skip(2) // filename
+		if err != nil {
+			return 0, err
+		}
+		if i, err = skip(i); err != nil { // mode
+			return 0, err
+		}
+		return skipOptions(i)
+	case OAck:
+		return skipOptions(2)
+	case Ack:
+		return 4, nil
+	case Error:
+		return skip(4)
+	case Data:
+		return len(b), nil
+	default:
+		return 0, fmt.Errorf("%w: %d", ErrUnknownOpcode, op)
+	}
+}
+
+// Describe returns a one line human readable description of p, such as
+//
+//	RRQ file=pxelinux.0 mode=octet blksize=1468 tsize=0
+//	DATA block=3 len=512
+func Describe(p Packet) string {
+	var sb strings.Builder
+	switch p := p.(type) {
+	case *ReadWriteRequest:
+		fmt.Fprintf(&sb, "%s file=%s mode=%s", strings.ToUpper(p.Opcode.String()), p.Filename, p.Mode)
+		describeOpts(&sb, p.Options)
+	case *DataPacket:
+		fmt.Fprintf(&sb, "DATA block=%d len=%d", p.BlockNumber, len(p.Data))
+	case *AckPacket:
+		fmt.Fprintf(&sb, "ACK block=%d", p.BlockNumber)
+	case *OAckPacket:
+		sb.WriteString("OACK")
+		describeOpts(&sb, p.Options)
+	case *ErrorPacket:
+		fmt.Fprintf(&sb, "ERROR code=%s msg=%q", p.ErrorCode, p.ErrMsg)
+	case nil:
+		sb.WriteString("<nil>")
+	default:
+		fmt.Fprintf(&sb, "%T", p)
+	}
+	return sb.String()
+}
+
+// write options in the order they are declared so descriptions are stable
+func describeOpts(sb *strings.Builder, options map[Option]int) {
+	for opt := Blksize; opt < firstCustom+Option(registeredOptions()); opt++ {
+		if val, ok := options[opt]; ok && opt != Unknown {
+			fmt.Fprintf(sb, " %s=%d", UnmarshalOpts(opt), val)
+		}
+	}
+}
+
 // UnmarshalPacket unmarshals a structured packet into its binary format
 func Unmarshal(p Packet) ([]byte, error) {
 	if p == nil {
-		return nil, fmt.Errorf("cannot marshal nil packet")
+		return nil, ErrNilPacket
 	}
 	return p.marshal()
 }
 
-func encode(op Opcode, args ...any) ([]byte, error) {
-	var p Packet
-	switch op {
-	case Error:
-		p = &ErrorPacket{
-			Opcode:    op,
-			ErrorCode: args[0].(ErrorCode),
-			ErrMsg:    args[1].(string),
+// RoundTrip marshals p to its binary format and unmarshals it back into a new
+// packet. A packet that survives the round trip should be structurally equal
+// to p, which makes it useful for checking the parser against itself
+func RoundTrip(p Packet) (Packet, error) {
+	b, err := Unmarshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return Marshal(b)
+}
+
+// maximum size of the data in a data packet, the largest blksize permitted by
+// rfc2348
+const maxDataLen = 65464
+
+// Mode is the transfer mode of a read/write request as specified in rfc1350
+type Mode int
+
+const (
+	Octet    Mode = iota // raw 8 bit bytes
+	Netascii             // text with network line endings
+	Mail                 // obsolete delivery of the data to a user
+)
+
+// wire names of the modes, indexed by Mode
+var modes = []string{"octet", "netascii", "mail"}
+
+// String returns the name of m as it is written in requests
+func (m Mode) String() string {
+	if m < 0 || int(m) >= len(modes) {
+		return "Mode(" + strconv.Itoa(int(m)) + ")"
+	}
+	return modes[m]
+}
+
+// ParseMode returns the Mode named s, ignoring case as modes are case
+// insensitive on the wire
+func ParseMode(s string) (Mode, error) {
+	for m, name := range modes {
+		if strings.EqualFold(name, s) {
+			return Mode(m), nil
 		}
-	default:
-		return nil, fmt.Errorf("decode for %s not implemented", op)
 	}
-	b, err := p.marshal()
-	if err != nil {
+	return 0, fmt.Errorf("dit: invalid mode %q", s)
+}
+
+// validate the options of a request or an option acknowledgement
+func validateOpts(options map[Option]int) error {
+	for opt, val := range options {
+		if _, err := ValidateOptValue(opt, strconv.Itoa(val)); err != nil {
+			return fmt.Errorf("dit: option %s: %w", opt, err)
+		}
+	}
+	return nil
+}
+
+func newRequest(op Opcode, filename, mode string, options map[Option]int) (*ReadWriteRequest, error) {
+	if filename == "" || strings.IndexByte(filename, 0) >= 0 {
+		return nil, fmt.Errorf("dit: invalid filename %q", filename)
+	}
+	if _, err := ParseMode(mode); err != nil {
+		return nil, err
+	}
+	if err := validateOpts(options); err != nil {
+		return nil, err
+	}
+	return &ReadWriteRequest{Opcode: op, Filename: filename, Mode: mode, Options: options}, nil
+}
+
+// NewRRQ returns a read request for filename in the transfer mode. The options
+// are optional and can be nil
+func NewRRQ(filename, mode string, options map[Option]int) (*ReadWriteRequest, error) {
+	return newRequest(Rrq, filename, mode, options)
+}
+
+// NewWRQ returns a write request for filename in the transfer mode. The options
+// are optional and can be nil
+func NewWRQ(filename, mode string, options map[Option]int) (*ReadWriteRequest, error) {
+	return newRequest(Wrq, filename, mode, options)
+}
+
+// NewData returns a data packet carrying data as block
+func NewData(block uint16, data []byte) (*DataPacket, error) {
+	if len(data) > maxDataLen {
+		return nil, fmt.Errorf("dit: %d bytes of data exceeds maximum blksize", len(data))
+	}
+	return &DataPacket{Opcode: Data, BlockNumber: block, Data: data}, nil
+}
+
+// NewAck returns a packet acknowledging block
+func NewAck(block uint16) *AckPacket {
+	return &AckPacket{Opcode: Ack, BlockNumber: block}
+}
+
+// NewOAck returns an option acknowledgement of options
+func NewOAck(options map[Option]int) (*OAckPacket, error) {
+	if err := validateOpts(options); err != nil {
 		return nil, err
 	}
-	return b, nil
+	return &OAckPacket{Opcode: OAck, Options: options}, nil
+}
+
+// NewError returns an error packet with code and msg
+func NewError(code ErrorCode, msg string) (*ErrorPacket, error) {
+	if strings.IndexByte(msg, 0) >= 0 {
+		return nil, fmt.Errorf("dit: error message contains a null byte")
+	}
+	return &ErrorPacket{Opcode: Error, ErrorCode: code, ErrMsg: msg}, nil
 }
 
 // A TFTP protocol opcode as specified in rfc1350 and rfc2347
@@ -109,14 +357,33 @@ const (
 	// unknown to signal the server cannot parse the null terminated option
 	// that it was presented
 	Unknown
+
+	// Non-standard, after Unknown to keep the values of the options before it
+	//
+	// offset option. a client resuming an interrupted download requests the
+	// byte offset in the file that the transfer should start from. servers
+	// only honor it when explicitly configured to
+	Offset
 )
 
+// SupportedOptions returns the options the client and server of dit both
+// implement, as opposed to those they only parse. A client can request these
+// knowing what they do on either end. Windowsize is parsed but transfers are
+// still acknowledged block by block, and the server only honors Offset when
+// configured to, so neither is included
+func SupportedOptions() []Option {
+	return []Option{Blksize, Timeout, Tsize}
+}
+
 // ErrInvalidOptVal is returned if the value of an option is not between the
 // range of accepted values.
 var ErrInvalidOptVal = errors.New("dit: invalid option value")
 
 func ValidateOptValue(opt Option, val string) (int, error) {
-	valInt, err := strconv.Atoi(val)
+	if o, ok := lookupOption(opt); ok {
+		return o.validate(trimToken(val))
+	}
+	valInt, err := strconv.Atoi(trimToken(val))
 	if err != nil {
 		return valInt, err
 	}
@@ -139,15 +406,23 @@ func ValidateOptValue(opt Option, val string) (int, error) {
 		if valInt >= 1 && valInt <= 65535 {
 			return valInt, nil
 		}
+	case Offset:
+		// the upper bound is the size of the requested file
+		if valInt >= 0 {
+			return valInt, nil
+		}
 	}
 
 	return 0, ErrInvalidOptVal
 }
 
-// MarshalOpts mashals an option string to its Option equivalent. It returns
-// Unknown if the option string is not recognized
+// MarshalOpts mashals an option string to its Option equivalent, including the
+// options added with RegisterOption. It returns Unknown if the option string is
+// not recognized. Matching ignores case and
+// surrounding spaces and nulls
 func MarshalOpts(opt string) Option {
-	switch strings.ToLower(opt) {
+	opt = strings.ToLower(trimToken(opt))
+	switch opt {
 	case "blksize":
 		return Blksize
 	case "timeout":
@@ -156,11 +431,19 @@ func MarshalOpts(opt string) Option {
 		return Tsize
 	case "windowsize":
 		return Windowsize
+	case "offset":
+		return Offset
 	default:
-		return Unknown
+		return lookupOptionName(opt)
 	}
 }
 
+// trimToken strips the spaces and stray nulls some clients send around option
+// names and values
+func trimToken(s string) string {
+	return strings.Trim(s, " \t\x00")
+}
+
 // Unmarshal convert an Option to its string equivalent. It returns "unknown" if
 // the option is not recognized.
 func UnmarshalOpts(opt Option) string {
@@ -173,7 +456,12 @@ func UnmarshalOpts(opt Option) string {
 		return "tsize"
 	case Windowsize:
 		return "windowsize"
+	case Offset:
+		return "offset"
 	default:
+		if o, ok := lookupOption(opt); ok {
+			return o.name
+		}
 		return "unknown"
 	}
 }
@@ -191,7 +479,8 @@ type ReadWriteRequest struct {
 }
 
 // loop through a byte slice and retrieve all null terminated strings as
-// proper golang utf8 string values
+// proper golang utf8 string values. Empty strings are kept, so that the
+// position of a string in the result matches its position in the packet
 func getNullTerminatedStrings(strs []byte) ([]string, error) {
 	var strVals []string
 
@@ -204,83 +493,158 @@ func getNullTerminatedStrings(strs []byte) ([]string, error) {
 			// if a null byte is encountered we read byte from last null position
 			// to new null position, and keep it in a slice for later processing
 			if s == 0 {
-				if bytes := strs[lastNull:i]; len(bytes) >= 1 {
-					if !utf8.Valid(bytes) {
-						// returns the string values extracted so far if an
-						// error is encountered while extracting
-						return strVals, fmt.Errorf("dit: filename contains illegal utf8 values, %s", bytes)
-					}
-					strVals = append(strVals, string(bytes))
-					lastNull = i + 1
+				bytes := strs[lastNull:i]
+				if !utf8.Valid(bytes) {
+					// returns the string values extracted so far if an
+					// error is encountered while extracting
+					return strVals, fmt.Errorf("dit: filename contains illegal utf8 values, %s", bytes)
 				}
+				strVals = append(strVals, string(bytes))
+				lastNull = i + 1
 			}
 		}
 	}
 	return strVals, nil
 }
 
+// parseOptions pairs up option names and values from the null terminated
+// strings of a packet and adds them to options, which is allocated when the
+// first valid one is found if it is nil. An empty options is returned as is for
+// pooled requests to keep their map. Unknown options and options with invalid
+// or empty values are skipped. Empty strings where a name is expected are
+// padding some clients put between or after the options and are skipped too,
+// as is a trailing name without a value
+func parseOptions(optVals []string, options map[Option]int) map[Option]int {
+	for i := 0; i < len(optVals); {
+		if trimToken(optVals[i]) == "" {
+			i++
+			continue
+		}
+		if i+1 == len(optVals) {
+			break
+		}
+		name, value := optVals[i], optVals[i+1]
+		i += 2
+
+		opt := MarshalOpts(name)
+		if opt == Unknown || value == "" {
+			continue
+		}
+		if val, err := ValidateOptValue(opt, value); err == nil {
+			if options == nil {
+				options = make(map[Option]int)
+			}
+			options[opt] = val
+		}
+	}
+	return options
+}
+
 func (p *ReadWriteRequest) unmarshal(b []byte) error {
 	strVals, err := getNullTerminatedStrings(b[2:])
 	if err != nil {
 		return err
 	}
 
+	// a request without a filename or mode is not a request, an empty
+	// filename would otherwise name the served directory itself
+	if len(strVals) < 1 || strVals[0] == "" {
+		return errors.New("dit: request has no filename")
+	}
+	if len(strVals) < 2 || strVals[1] == "" {
+		return errors.New("dit: request has no mode")
+	}
+	p.Filename = strVals[0]
+	p.Mode = strVals[1]
+
 	// options are extensions and if there is a problem parsing one, it is not
-	//  a reason to stop the parsing process, we continue to parse as much as
-	//  we can and then return the errors encountered afterwards
-	if len(strVals) >= 2 {
-		// we got some filename, mode and probably options
-		p.Filename = strVals[0]
-		p.Mode = strVals[1]
-
-		if optVals := strVals[2:]; len(optVals) >= 2 {
-			options := make(map[Option]int)
-			for i := 0; i < len(optVals); i += 2 {
-				opt := MarshalOpts(optVals[i])
-				if opt == Unknown {
-					continue
-				}
-				var val int
-				val, err = ValidateOptValue(opt, optVals[i+1])
-				if err == nil {
-					options[opt] = val
-				}
-			}
+	//  a reason to stop the parsing process, we skip the ones we can not make
+	//  sense of and keep the rest
+	p.Options = parseOptions(strVals[2:], p.Options)
+	return nil
+}
 
-			// give the options to the request if we got some
-			if len(options) >= 1 {
-				p.Options = options
-			}
-		}
+// requests decoded by Accept are recycled once their connection is released,
+// sparing the allocations of a request and its options for every one of them
+// when clients arrive in bursts
+var requestPool = sync.Pool{
+	New: func() any { return new(ReadWriteRequest) },
+}
+
+// decodeRequest decodes the read or write request in b into a request from
+// the pool
+func decodeRequest(b []byte) (*ReadWriteRequest, error) {
+	if err := checkOpcode(b); err != nil {
+		return nil, err
+	}
+	if len(b) < minPacketLen {
+		return nil, fmt.Errorf("packet of %d bytes is too short", len(b))
+	}
+	req := requestPool.Get().(*ReadWriteRequest)
+	req.Opcode = opcode(b)
+	if err := req.unmarshal(b); err != nil {
+		putRequest(req)
+		return nil, fmt.Errorf("unmarshal packet: %w", err)
 	}
+	return req, nil
+}
 
-	return err
+// putRequest clears req and returns it to the pool, the options map is emptied
+// rather than dropped so the next request can fill it
+func putRequest(req *ReadWriteRequest) {
+	for opt := range req.Options {
+		delete(req.Options, opt)
+	}
+	*req = ReadWriteRequest{Options: req.Options}
+	requestPool.Put(req)
 }
 
-// convert go string to null terminated string of bytes
-func nullTerminate(s string) []byte {
-	return append([]byte(s), 0)
+// appendString appends s and its null terminator to dst
+func appendString(dst []byte, s string) []byte {
+	return append(append(dst, s...), 0)
 }
 
-func (p *ReadWriteRequest) marshal() ([]byte, error) {
-	data := make([]byte, 2)
-	binary.BigEndian.PutUint16(data, uint16(p.Opcode))
-	data = append(data, nullTerminate(p.Filename)...)
-	data = append(data, nullTerminate(p.Mode)...)
-	if len(p.Options) >= 1 {
-		for opt, val := range p.Options {
-			valStr := strconv.Itoa(val)
-			data = append(data, nullTerminate(UnmarshalOpts(opt))...)
-			data = append(data, nullTerminate(valStr)...)
+// appendOpts appends the options and their values as null terminated strings.
+// they are written in the order they are declared, like in descriptions, so
+// the same options always marshal to the same bytes
+func appendOpts(dst []byte, options map[Option]int) []byte {
+	if len(options) == 0 {
+		return dst
+	}
+	for opt := Blksize; opt < firstCustom+Option(registeredOptions()); opt++ {
+		if val, ok := options[opt]; ok && opt != Unknown {
+			dst = appendString(dst, UnmarshalOpts(opt))
+			dst = strconv.AppendInt(dst, int64(val), 10)
+			dst = append(dst, 0)
 		}
 	}
-	return data, nil
+	return dst
+}
+
+func (p *ReadWriteRequest) marshal() ([]byte, error) {
+	return p.MarshalAppend(nil)
+}
+
+func (p *ReadWriteRequest) MarshalAppend(dst []byte) ([]byte, error) {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(p.Opcode))
+	dst = appendString(dst, p.Filename)
+	dst = appendString(dst, p.Mode)
+	return appendOpts(dst, p.Options), nil
 }
 
 func (p ReadWriteRequest) opcode() Opcode {
 	return p.Opcode
 }
 
+// SetOption sets the value of opt in the request. The options map is allocated
+// if the request has none, which is the case for requests without options
+func (p *ReadWriteRequest) SetOption(opt Option, val int) {
+	if p.Options == nil {
+		p.Options = make(map[Option]int)
+	}
+	p.Options[opt] = val
+}
+
 // OAckPacket is an optional acknowledgement packet structure as specified in RFC2347
 type OAckPacket struct {
 	Opcode  Opcode
@@ -291,41 +655,35 @@ func (OAckPacket) opcode() Opcode {
 	return OAck
 }
 
-func (p *OAckPacket) unmarshal(b []byte) error {
-	if optVals, err := getNullTerminatedStrings(b[2:]); len(optVals) >= 2 {
-		options := make(map[Option]int)
-		for i := 0; i < len(optVals); i += 2 {
-			opt := MarshalOpts(optVals[i])
-			if opt == Unknown {
-				continue
-			}
-			var val int
-			val, err = ValidateOptValue(opt, optVals[i+1])
-			if err == nil {
-				options[opt] = val
-			}
-		}
+// SetOption sets the value of opt in the acknowledgement, allocating the
+// options map if needed
+func (p *OAckPacket) SetOption(opt Option, val int) {
+	if p.Options == nil {
+		p.Options = make(map[Option]int)
+	}
+	p.Options[opt] = val
+}
 
-		if len(options) >= 1 {
-			p.Options = options
-		}
-	} else if err != nil {
+func (p *OAckPacket) unmarshal(b []byte) error {
+	optVals, err := getNullTerminatedStrings(b[2:])
+	if err != nil {
 		return err
 	}
-
+	// rfc2347 only has servers acknowledge the options they accept, an
+	// acknowledgement of none is not a reply to anything
+	if p.Options = parseOptions(optVals, nil); len(p.Options) == 0 {
+		return errors.New("dit: option acknowledgement has no options")
+	}
 	return nil
 }
 
 func (p *OAckPacket) marshal() ([]byte, error) {
-	data := make([]byte, 2)
-	binary.BigEndian.PutUint16(data, uint16(p.Opcode))
-	if len(p.Options) >= 1 {
-		for opt, val := range p.Options {
-			data = append(data, nullTerminate(UnmarshalOpts(opt))...)
-			data = append(data, nullTerminate(strconv.Itoa(val))...)
-		}
-	}
-	return data, nil
+	return p.MarshalAppend(nil)
+}
+
+func (p *OAckPacket) MarshalAppend(dst []byte) ([]byte, error) {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(p.Opcode))
+	return appendOpts(dst, p.Options), nil
 }
 
 // DataPacket is a TFTP data packet as described in RFC1350, apendix I
@@ -339,6 +697,13 @@ func (DataPacket) opcode() Opcode {
 	return Data
 }
 
+// IsLast reports whether p is the last block of a transfer with blocks of
+// blksize bytes. As specified in rfc1350 a block shorter than blksize, even an
+// empty one, terminates the transfer
+func (p *DataPacket) IsLast(blksize int) bool {
+	return len(p.Data) < blksize
+}
+
 func (p *DataPacket) unmarshal(b []byte) error {
 	p.BlockNumber = binary.BigEndian.Uint16(b[2:4])
 
@@ -352,10 +717,13 @@ func (p *DataPacket) unmarshal(b []byte) error {
 }
 
 func (p *DataPacket) marshal() ([]byte, error) {
-	data := make([]byte, 4, len(p.Data)+4)
-	binary.BigEndian.PutUint16(data[0:2], uint16(p.Opcode))
-	binary.BigEndian.PutUint16(data[2:4], p.BlockNumber)
-	return append(data, p.Data...), nil
+	return p.MarshalAppend(make([]byte, 0, len(p.Data)+4))
+}
+
+func (p *DataPacket) MarshalAppend(dst []byte) ([]byte, error) {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(p.Opcode))
+	dst = binary.BigEndian.AppendUint16(dst, p.BlockNumber)
+	return append(dst, p.Data...), nil
 }
 
 // AckPacket is a TFTP acknowledgement packet as described in RFC1350,apendix I
@@ -374,10 +742,12 @@ func (p *AckPacket) unmarshal(b []byte) error {
 }
 
 func (p *AckPacket) marshal() ([]byte, error) {
-	data := make([]byte, 4)
-	binary.BigEndian.PutUint16(data[0:2], uint16(p.Opcode))
-	binary.BigEndian.PutUint16(data[2:4], p.BlockNumber)
-	return data, nil
+	return p.MarshalAppend(make([]byte, 0, 4))
+}
+
+func (p *AckPacket) MarshalAppend(dst []byte) ([]byte, error) {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(p.Opcode))
+	return binary.BigEndian.AppendUint16(dst, p.BlockNumber), nil
 }
 
 // ErrorCode represents a TFTP error code as specified in RFC1350, apendix I
@@ -424,9 +794,11 @@ func (p *ErrorPacket) unmarshal(b []byte) error {
 }
 
 func (p *ErrorPacket) marshal() ([]byte, error) {
-	data := make([]byte, 4, len(p.ErrMsg)+5)
-	binary.BigEndian.PutUint16(data[0:2], uint16(p.Opcode))
-	binary.BigEndian.PutUint16(data[2:4], uint16(p.ErrorCode))
-	data = append(data, nullTerminate(p.ErrMsg)...)
-	return data, nil
+	return p.MarshalAppend(make([]byte, 0, len(p.ErrMsg)+5))
+}
+
+func (p *ErrorPacket) MarshalAppend(dst []byte) ([]byte, error) {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(p.Opcode))
+	dst = binary.BigEndian.AppendUint16(dst, uint16(p.ErrorCode))
+	return appendString(dst, p.ErrMsg), nil
 }
@@ -0,0 +1,380 @@
+package dit
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		packet  string
+		want    *ReadWriteRequest
+		wantErr bool
+	}{
+		{
+			name:   "no options",
+			packet: "\x00\x01file\x00octet\x00",
+			want:   &ReadWriteRequest{Opcode: Rrq, Filename: "file", Mode: "octet"},
+		},
+		{
+			name:   "options",
+			packet: "\x00\x02file\x00octet\x00blksize\x001024\x00tsize\x000\x00",
+			want: &ReadWriteRequest{Opcode: Wrq, Filename: "file", Mode: "octet",
+				Options: map[Option]int{Blksize: 1024, Tsize: 0}},
+		},
+		{
+			name:   "trailing padding",
+			packet: "\x00\x01file\x00octet\x00\x00",
+			want:   &ReadWriteRequest{Opcode: Rrq, Filename: "file", Mode: "octet"},
+		},
+		{
+			name:   "padding between options",
+			packet: "\x00\x01file\x00octet\x00\x00blksize\x001024\x00\x00\x00timeout\x003\x00",
+			want: &ReadWriteRequest{Opcode: Rrq, Filename: "file", Mode: "octet",
+				Options: map[Option]int{Blksize: 1024, Timeout: 3}},
+		},
+		{
+			name:   "dangling option name",
+			packet: "\x00\x01file\x00octet\x00blksize\x001024\x00tsize\x00",
+			want: &ReadWriteRequest{Opcode: Rrq, Filename: "file", Mode: "octet",
+				Options: map[Option]int{Blksize: 1024}},
+		},
+		{
+			name:   "empty option value",
+			packet: "\x00\x01file\x00octet\x00blksize\x00\x00tsize\x000\x00",
+			want: &ReadWriteRequest{Opcode: Rrq, Filename: "file", Mode: "octet",
+				Options: map[Option]int{Tsize: 0}},
+		},
+		{
+			name:    "empty filename and mode",
+			packet:  "\x00\x01\x00\x00",
+			wantErr: true,
+		},
+		{
+			name:    "empty filename",
+			packet:  "\x00\x01\x00octet\x00",
+			wantErr: true,
+		},
+		{
+			name:    "empty mode",
+			packet:  "\x00\x02file\x00\x00",
+			wantErr: true,
+		},
+		{
+			name:    "no mode",
+			packet:  "\x00\x01file\x00",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := DecodePacket([]byte(tt.packet))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("decoded %s, want an error", Describe(p))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(p, tt.want) {
+				t.Errorf("got %s, want %s", Describe(p), Describe(tt.want))
+			}
+		})
+	}
+}
+
+func TestDataIsLast(t *testing.T) {
+	tests := []struct {
+		blksize, len int
+		last         bool
+	}{
+		{512, 0, true},
+		{512, 511, true},
+		{512, 512, false},
+		{1024, 512, true},
+		{1024, 1023, true},
+		{1024, 1024, false},
+	}
+	for _, tt := range tests {
+		p, err := NewData(1, make([]byte, tt.len))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.IsLast(tt.blksize); got != tt.last {
+			t.Errorf("block of %d bytes with blksize %d: IsLast() = %v, want %v", tt.len, tt.blksize, got, tt.last)
+		}
+	}
+}
+
+// FuzzDecodePacket checks that every packet that decodes survives a round trip
+// through RoundTrip unchanged
+func FuzzDecodePacket(f *testing.F) {
+	for _, seed := range []string{
+		"\x00\x01file\x00octet\x00",
+		"\x00\x02file\x00octet\x00blksize\x001024\x00tsize\x000\x00",
+		"\x00\x01file\x00octet\x00\x00blksize\x001024\x00\x00\x00timeout\x003\x00",
+		"\x00\x01file\x00octet\x00blksize\x001024\x00tsize\x00",
+		"\x00\x01file\x00octet\x00blksize\x00\x00tsize\x000\x00",
+		"\x00\x01\x00octet\x00",
+		"\x00\x03\x00\x01data",
+		"\x00\x03\x00\x02",
+		"\x00\x04\x00\x07",
+		"\x00\x05\x00\x01file not found\x00",
+		"\x00\x06blksize\x001468\x00windowsize\x008\x00",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		p, err := DecodePacket(b)
+		if err != nil {
+			return
+		}
+		q, err := RoundTrip(p)
+		if err != nil {
+			t.Fatalf("%s decoded from %q does not round trip: %v", Describe(p), b, err)
+		}
+		if !reflect.DeepEqual(p, q) {
+			t.Fatalf("%s decoded from %q round trips to %s", Describe(p), b, Describe(q))
+		}
+	})
+}
+
+func TestSetOptionWithoutOptions(t *testing.T) {
+	req := &ReadWriteRequest{Opcode: Rrq, Filename: "file", Mode: "octet"}
+	req.SetOption(Blksize, 1024)
+	if want := map[Option]int{Blksize: 1024}; !reflect.DeepEqual(req.Options, want) {
+		t.Errorf("request options are %v, want %v", req.Options, want)
+	}
+	oack := &OAckPacket{Opcode: OAck}
+	oack.SetOption(Tsize, 700)
+	if want := map[Option]int{Tsize: 700}; !reflect.DeepEqual(oack.Options, want) {
+		t.Errorf("acknowledged options are %v, want %v", oack.Options, want)
+	}
+}
+
+func TestMarshalOptsTrims(t *testing.T) {
+	for name, want := range map[string]Option{
+		" BlkSize ":   Blksize,
+		"blksize\x00": Blksize,
+		"\tTSIZE":     Tsize,
+		"time out":    Unknown,
+	} {
+		if got := MarshalOpts(name); got != want {
+			t.Errorf("MarshalOpts(%q) = %s, want %s", name, got, want)
+		}
+	}
+	if val, err := ValidateOptValue(Blksize, " 1024\x00"); err != nil || val != 1024 {
+		t.Errorf("ValidateOptValue(%q) = %d, %v, want 1024", " 1024\x00", val, err)
+	}
+
+	p, err := DecodePacket([]byte("\x00\x01file\x00octet\x00 BlkSize \x00 1024 \x00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[Option]int{Blksize: 1024}; !reflect.DeepEqual(p.(*ReadWriteRequest).Options, want) {
+		t.Errorf("decoded %s, want options %v", Describe(p), want)
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	_, dialErr := Dial("tcp", "127.0.0.1:69")
+	_, listenErr := Listen("ip4:udp", "127.0.0.1")
+	_, decodeErr := DecodePacket([]byte("\x00\x09file\x00"))
+	_, _, decodeNErr := DecodePacketN([]byte("\x00\x0a"))
+	_, nilErr := Unmarshal(nil)
+	for _, tt := range []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"Dial tcp", dialErr, ErrUnsupportedNetwork},
+		{"Listen ip4:udp", listenErr, ErrUnsupportedNetwork},
+		{"DecodePacket opcode 9", decodeErr, ErrUnknownOpcode},
+		{"DecodePacketN opcode 10", decodeNErr, ErrUnknownOpcode},
+		{"Unmarshal nil", nilErr, ErrNilPacket},
+	} {
+		if !errors.Is(tt.err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.err, tt.want)
+		}
+	}
+}
+
+func TestDecodePacketN(t *testing.T) {
+	packets := []string{
+		"\x00\x01file\x00octet\x00blksize\x001024\x00",
+		"\x00\x06blksize\x001024\x00",
+		"\x00\x04\x00\x00",
+		"\x00\x05\x00\x01file not found\x00",
+		"\x00\x02other\x00netascii\x00",
+		"\x00\x03\x00\x01the data runs to the end",
+	}
+	var b []byte
+	for _, p := range packets {
+		b = append(b, p...)
+	}
+	for i, want := range packets {
+		p, n, err := DecodePacketN(b)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if n != len(want) {
+			t.Fatalf("packet %d: %s occupied %d bytes, want %d", i, Describe(p), n, len(want))
+		}
+		q, _ := DecodePacket([]byte(want))
+		if !reflect.DeepEqual(p, q) {
+			t.Fatalf("packet %d: decoded %s, want %s", i, Describe(p), Describe(q))
+		}
+		b = b[n:]
+	}
+	if len(b) != 0 {
+		t.Fatalf("%d bytes left after the last packet", len(b))
+	}
+	if _, _, err := DecodePacketN([]byte("\x00\x01file")); err == nil {
+		t.Fatal("decoded a request cut short")
+	}
+}
+
+func TestUnknownOpcode(t *testing.T) {
+	for _, op := range []string{"\x00\x00", "\x00\x63"} {
+		for _, b := range []string{op, op + "\x00\x01", op + "file\x00octet\x00"} {
+			if _, err := DecodePacket([]byte(b)); !errors.Is(err, ErrUnknownOpcode) {
+				t.Errorf("DecodePacket(%q): got %v, want %v", b, err, ErrUnknownOpcode)
+			}
+			if _, _, err := DecodePacketN([]byte(b)); !errors.Is(err, ErrUnknownOpcode) {
+				t.Errorf("DecodePacketN(%q): got %v, want %v", b, err, ErrUnknownOpcode)
+			}
+		}
+	}
+
+	// the six opcodes of rfc1350 and rfc2347 all decode
+	for _, b := range []string{
+		"\x00\x01file\x00octet\x00",
+		"\x00\x02file\x00octet\x00",
+		"\x00\x03\x00\x01",
+		"\x00\x04\x00\x01",
+		"\x00\x05\x00\x01\x00",
+		"\x00\x06blksize\x00512\x00",
+	} {
+		if _, err := DecodePacket([]byte(b)); err != nil {
+			t.Errorf("DecodePacket(%q): %v", b, err)
+		}
+	}
+}
+
+func TestOAckPacket(t *testing.T) {
+	options := map[Option]int{Windowsize: 4, Tsize: 3000, Timeout: 2, Blksize: 1024}
+	oack, err := NewOAck(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rrq, err := NewRRQ("file", "octet", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// options come out in the order they are declared however the map
+	// iterates, so the same packet always marshals to the same bytes
+	const opts = "blksize\x001024\x00timeout\x002\x00tsize\x003000\x00windowsize\x004\x00"
+	for _, tt := range []struct {
+		p    Packet
+		want string
+	}{
+		{oack, "\x00\x06" + opts},
+		{rrq, "\x00\x01file\x00octet\x00" + opts},
+	} {
+		for i := 0; i < 20; i++ {
+			b, err := Unmarshal(tt.p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.want {
+				t.Fatalf("%s marshaled to %q, want %q", Describe(tt.p), b, tt.want)
+			}
+		}
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	tests := []struct {
+		s    string
+		mode Mode
+		ok   bool
+	}{
+		{"octet", Octet, true},
+		{"OCTET", Octet, true},
+		{"NetAscii", Netascii, true},
+		{"mail", Mail, true},
+		{"octett", 0, false},
+		{"binary", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		m, err := ParseMode(tt.s)
+		if (err == nil) != tt.ok || m != tt.mode {
+			t.Errorf("ParseMode(%q) = %v, %v, want %v and ok %v", tt.s, m, err, tt.mode, tt.ok)
+		}
+	}
+
+	// every mode survives the trip through its wire name
+	for m := Octet; m <= Mail; m++ {
+		if got, err := ParseMode(m.String()); err != nil || got != m {
+			t.Errorf("ParseMode(%q) = %v, %v, want %v", m.String(), got, err, m)
+		}
+	}
+	if s := Mode(len(modes)).String(); s != "Mode(3)" {
+		t.Errorf("String of an unknown mode = %q, want Mode(3)", s)
+	}
+}
+
+func BenchmarkDecodeRequest(b *testing.B) {
+	rrq, _ := NewRRQ("pxelinux.0", "octet", map[Option]int{Blksize: 1428, Tsize: 0})
+	req, _ := Unmarshal(rrq)
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			p, err := decodeRequest(req)
+			if err != nil {
+				b.Fatal(err)
+			}
+			putRequest(p)
+		}
+	})
+	b.Run("fresh", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := Marshal(req); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkMarshalAppend(b *testing.B) {
+	data, _ := NewData(1, make([]byte, 1428))
+	oack, _ := NewOAck(map[Option]int{Blksize: 1428, Tsize: 1 << 20})
+	for name, p := range map[string]Packet{"data": data, "oack": oack} {
+		p := p
+		b.Run(name+"/append", func(b *testing.B) {
+			b.ReportAllocs()
+			buf := make([]byte, 0, 1432)
+			for i := 0; i < b.N; i++ {
+				if _, err := p.MarshalAppend(buf[:0]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(name+"/marshal", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := p.marshal(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package dit
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrTransferDone is returned by Transfer.Step once the transfer is over
+var ErrTransferDone = errors.New("dit: transfer is done")
+
+// Transfer is the data phase of a transfer, the exchange of data blocks and
+// their acknowledgements that follows a request and its option negotiation,
+// without a socket. It is driven by feeding it the packets recieved from the
+// peer and sending the packets it returns, which makes the protocol easy to
+// drive over any transport and to step through deterministically.
+//
+// A sending transfer reads the blocks it sends from a reader and a recieving
+// one writes the blocks it recieves to a writer. Blocks are acknowledged one
+// by one, windowsize is not supported
+type Transfer struct {
+	r       io.Reader
+	w       io.Writer
+	blksize int
+
+	// block sent last by a sender and the blocks recieved by a receiver
+	block uint16
+	seq   BlockSequence
+
+	// packet sent last, for retransmission, and the buffer of the data
+	// blocks of a sender
+	last Packet
+	buf  []byte
+	done bool
+}
+
+// NewSendTransfer returns a transfer that sends the content of r in blocks of
+// blksize bytes, like a server answering a read request or a client making a
+// write request
+func NewSendTransfer(r io.Reader, blksize int) *Transfer {
+	return &Transfer{r: r, blksize: blksize, buf: make([]byte, blksize)}
+}
+
+// NewRecvTransfer returns a transfer that writes the data blocks of blksize
+// bytes it recieves to w, like a server answering a write request or a client
+// making a read request
+func NewRecvTransfer(w io.Writer, blksize int) *Transfer {
+	return &Transfer{w: w, blksize: blksize}
+}
+
+// Step advances the transfer with the packet in recieved from the peer and
+// returns the packet to send in reply, nil if there is nothing to send. A
+// sender is started with a nil packet, which returns the first data block, a
+// receiver is started by the first data block.
+//
+// done reports that the transfer is complete once out is sent. An error from
+// the peer or a packet that breaks the protocol fails the transfer, out is then
+// the error packet to tell the peer if there is one. Packets returned are only
+// valid until the next call to Step
+func (t *Transfer) Step(in Packet) (out Packet, done bool, err error) {
+	if t.done {
+		return nil, true, ErrTransferDone
+	}
+	if p, ok := in.(*ErrorPacket); ok {
+		t.done = true
+		return nil, true, fmt.Errorf("dit: peer sent error %s: %s", p.ErrorCode, p.ErrMsg)
+	}
+	if t.r != nil {
+		out, err = t.send(in)
+	} else {
+		out, err = t.recv(in)
+	}
+	if err != nil {
+		t.done = true
+		return out, true, err
+	}
+	if out != nil {
+		t.last = out
+	}
+	return out, t.done, nil
+}
+
+// Retransmit returns the packet sent last, to be sent again when the peer does
+// not answer in time. It is nil before anything was sent
+func (t *Transfer) Retransmit() Packet {
+	return t.last
+}
+
+// Done reports whether the transfer is over
+func (t *Transfer) Done() bool {
+	return t.done
+}
+
+func (t *Transfer) send(in Packet) (Packet, error) {
+	switch p := in.(type) {
+	case nil:
+		// only the start of the transfer has no packet to answer
+		if t.block != 0 {
+			return nil, nil
+		}
+	case *AckPacket:
+		// acks of earlier blocks are duplicates and are ignored, answering
+		// them would double every block from then on
+		if p.BlockNumber != t.block {
+			return nil, nil
+		}
+		// the ack of a short block ends the transfer
+		if d, ok := t.last.(*DataPacket); ok && d.IsLast(t.blksize) {
+			t.done = true
+			return nil, nil
+		}
+	default:
+		return illegal(fmt.Errorf("dit: unexpected %s packet while sending", in.opcode()))
+	}
+
+	n, err := io.ReadFull(t.r, t.buf)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		p, _ := NewError(NotDefined, "could not read data")
+		return p, err
+	}
+	t.block++
+	return NewData(t.block, t.buf[:n])
+}
+
+func (t *Transfer) recv(in Packet) (Packet, error) {
+	p, ok := in.(*DataPacket)
+	if !ok {
+		if in == nil {
+			return nil, nil
+		}
+		return illegal(fmt.Errorf("dit: unexpected %s packet while recieving", in.opcode()))
+	}
+
+	switch t.seq.Classify(p.BlockNumber) {
+	case BlockDuplicate:
+		// our last ack got lost, send it again
+		return NewAck(t.seq.Last()), nil
+	case BlockOutOfWindow:
+		return nil, nil
+	}
+	if len(p.Data) > t.blksize {
+		return illegal(fmt.Errorf("dit: block %d: %d bytes exceeds blksize %d", p.BlockNumber, len(p.Data), t.blksize))
+	}
+	if _, err := t.w.Write(p.Data); err != nil {
+		p, _ := NewError(NotDefined, "could not write data")
+		return p, err
+	}
+	t.seq.Advance()
+	t.done = p.IsLast(t.blksize)
+	return NewAck(t.seq.Last()), nil
+}
+
+// illegal fails a transfer with err, telling the peer it broke the protocol
+func illegal(err error) (Packet, error) {
+	p, _ := NewError(IllegalOperation, "unexpected packet")
+	return p, err
+}
@@ -0,0 +1,83 @@
+package dit
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func TestTransfer(t *testing.T) {
+	content := make([]byte, 1100)
+	rand.New(rand.NewSource(1)).Read(content)
+	var got bytes.Buffer
+	sender := NewSendTransfer(bytes.NewReader(content), 512)
+	reciever := NewRecvTransfer(&got, 512)
+
+	d1, _ := NewData(1, content[:512])
+	d2, _ := NewData(2, content[512:1024])
+	d3, _ := NewData(3, content[1024:])
+	retransmit := &AckPacket{} // stands for the sender retransmitting
+
+	// a read request served block by block, the first block and the ack of
+	// the second are lost on the way
+	tests := []struct {
+		name string
+		t    *Transfer
+		in   Packet
+		out  Packet
+		done bool
+		err  error
+	}{
+		{"sender starts", sender, nil, d1, false, nil},
+		{"block 1 lost, sent again", sender, retransmit, d1, false, nil},
+		{"block 1 recieved", reciever, d1, NewAck(1), false, nil},
+		{"block 2 sent", sender, NewAck(1), d2, false, nil},
+		{"block 2 recieved", reciever, d2, NewAck(2), false, nil},
+		{"ack 2 lost, block 2 sent again", sender, retransmit, d2, false, nil},
+		{"duplicate block 2 acknowledged again", reciever, d2, NewAck(2), false, nil},
+		{"duplicate ack 1 ignored", sender, NewAck(1), nil, false, nil},
+		{"block 3 sent", sender, NewAck(2), d3, false, nil},
+		{"short block 3 ends the reciever", reciever, d3, NewAck(3), true, nil},
+		{"ack of the short block ends the sender", sender, NewAck(3), nil, true, nil},
+		{"sender done", sender, NewAck(3), nil, true, ErrTransferDone},
+		{"reciever done", reciever, d3, nil, true, ErrTransferDone},
+	}
+	for _, tt := range tests {
+		var (
+			out  Packet
+			done bool
+			err  error
+		)
+		if tt.in == retransmit {
+			out, done = tt.t.Retransmit(), tt.t.Done()
+		} else {
+			out, done, err = tt.t.Step(tt.in)
+		}
+		if Describe(out) != Describe(tt.out) || done != tt.done || !errors.Is(err, tt.err) {
+			t.Fatalf("%s: got %s, done %v, error %v, want %s, done %v, error %v",
+				tt.name, Describe(out), done, err, Describe(tt.out), tt.done, tt.err)
+		}
+	}
+	if !bytes.Equal(got.Bytes(), content) {
+		t.Fatalf("recieved %d bytes that differ from the %d sent", got.Len(), len(content))
+	}
+
+	// packets that do not belong in the data phase fail it
+	rrq, _ := NewRRQ("file", "octet", nil)
+	for name, tr := range map[string]*Transfer{
+		"sender":    NewSendTransfer(bytes.NewReader(content), 512),
+		"reciever":  NewRecvTransfer(&got, 512),
+		"oversized": NewRecvTransfer(&got, 8),
+	} {
+		in := Packet(rrq)
+		if name == "oversized" {
+			in = d1
+		}
+		out, done, err := tr.Step(in)
+		e, ok := out.(*ErrorPacket)
+		if err == nil || !done || !ok || e.ErrorCode != IllegalOperation {
+			t.Errorf("%s: got %s, done %v, error %v, want an illegal operation", name, Describe(out), done, err)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package dit
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// the protocol runs over unix datagram sockets for local use and tests that
+// should not depend on the network. Their addresses are paths instead of hosts
+// and ports, so the TID of a peer is the path of its socket. Like a server on
+// udp replies from a new port, a unixgram listener replies from a new socket
+// bound next to its own, and a client binds a socket of its own for the
+// replies to reach it
+
+func listenUnix(address string) (*Conn, error) {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: address, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{u: conn, done: make(chan struct{})}, nil
+}
+
+func dialUnix(localAddr, remoteAddr string) (*Conn, error) {
+	var (
+		conn *net.UnixConn
+		err  error
+	)
+	if localAddr != "" {
+		conn, err = net.ListenUnixgram("unixgram", &net.UnixAddr{Name: localAddr, Net: "unixgram"})
+	} else {
+		conn, err = bindUnix(filepath.Join(os.TempDir(), "dit"), 0, 0, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	raddr := &net.UnixAddr{Name: remoteAddr, Net: "unixgram"}
+	return &Conn{u: conn, udialed: raddr, upeer: raddr, done: make(chan struct{})}, nil
+}
+
+// bindUnix binds a unixgram socket at prefix followed by a dot and a number
+// between lo and hi, any number if both are zero. Like connectWithRange it
+// tries a few numbers in case the path of one is taken
+func bindUnix(prefix string, lo, hi uint16, next func(lo, hi uint16) uint16) (conn *net.UnixConn, err error) {
+	if lo == 0 && hi == 0 {
+		lo, hi = 1, 65535
+	}
+	if next == nil {
+		next = randomPort
+	}
+	for i := 0; i < 10; i++ {
+		laddr := &net.UnixAddr{Name: fmt.Sprintf("%s.%d", prefix, next(lo, hi)), Net: "unixgram"}
+		if conn, err = net.ListenUnixgram("unixgram", laddr); err == nil {
+			return
+		}
+	}
+	return
+}
+
+// closeUnix closes a unixgram socket and removes its path, which unlike a port
+// outlives the socket. Abstract sockets, whose names start with @ on linux,
+// have no path
+func closeUnix(conn *net.UnixConn) error {
+	laddr, _ := conn.LocalAddr().(*net.UnixAddr)
+	err := conn.Close()
+	if laddr != nil && laddr.Name != "" && laddr.Name[0] != '@' {
+		os.Remove(laddr.Name)
+	}
+	return err
+}
+
+// named reports whether addr is the address of a socket that can be replied
+// to, which an unnamed one can not
+func named(addr *net.UnixAddr) bool {
+	return addr != nil && addr.Name != ""
+}
+
+// acceptUnix is AcceptRange for unixgram listeners
+func (c *Conn) acceptUnix(lo, hi uint16) (*Conn, error) {
+	if c.abuf == nil {
+		c.abuf = make([]byte, maxRequestLen)
+	}
+	buf := c.abuf
+	for {
+		n, raddr, err := c.u.ReadFromUnix(buf)
+		if err != nil {
+			return nil, fmt.Errorf("accept: %w", err)
+		}
+		if !named(raddr) || n < 2 {
+			continue
+		}
+
+		if op := opcode(buf[:n]); op != Rrq && op != Wrq {
+			_ = c.writeErrTo(IllegalOperation, "cannot perform operation", raddr)
+			continue
+		}
+
+		req, err := decodeRequest(buf[:n])
+		if err != nil {
+			_ = c.writeErrTo(NotDefined, "could not decode packet", raddr)
+			continue
+		}
+
+		conn, err := bindUnix(c.u.LocalAddr().String(), lo, hi, c.nextPort)
+		if err == nil {
+			if err = setBuffers(conn, c.rbuf, c.wbuf); err != nil {
+				closeUnix(conn)
+			}
+		}
+		if err != nil {
+			_ = c.writeErrTo(NotDefined, "could not connect", raddr)
+			return nil, fmt.Errorf("accept: %w", err)
+		}
+
+		return &Conn{
+			u:         conn,
+			upeer:     raddr,
+			connected: true,
+			req:       req,
+			done:      make(chan struct{}),
+			trace:     c.trace,
+		}, nil
+	}
+}
+
+// readUnix is ReadPeer for unixgram connections, and Read with reject set. The
+// datagrams from sockets other than the peer of a transfer in progress are
+// answered with an UnknownTID error and dropped, or returned with
+// ErrUnexpectedTID if reject is set
+func (c *Conn) readUnix(b []byte, reject bool) (int, error) {
+	for {
+		n, from, err := c.u.ReadFromUnix(b)
+		if err != nil || !c.connected || c.knownSocket(from) {
+			return n, err
+		}
+		if named(from) {
+			_ = c.writeErrTo(UnknownTID, "unknown transfer id", from)
+		}
+		if reject {
+			return n, ErrUnexpectedTID
+		}
+	}
+}
+
+// knownSocket is knownTID for unixgram connections
+func (c *Conn) knownSocket(from *net.UnixAddr) bool {
+	if c.AllowAnyTID {
+		return true
+	}
+	return named(from) && c.upeer != nil && from.Name == c.upeer.Name
+}
+
+// unixReply is the TID check of readReply for unixgram connections. Like
+// firstReply the first reply binds the transfer to the socket it comes from,
+// unless that is the socket of the previous transfer
+func (c *Conn) unixReply(from *net.UnixAddr) bool {
+	if !named(from) {
+		return false
+	}
+	if c.connected {
+		if c.knownSocket(from) {
+			return true
+		}
+		_ = c.writeErrTo(UnknownTID, "unknown transfer id", from)
+		return false
+	}
+	if !c.AllowAnyTID && from.Name == c.ustale && from.Name != c.udialed.Name {
+		return false
+	}
+	c.connected = true
+	c.upeer = from
+	return true
+}
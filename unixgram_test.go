@@ -0,0 +1,163 @@
+package dit
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// serveUnix answers n requests on l, sending the files of a read request
+// and keeping the uploads of a write request in files. A stray socket sends a
+// packet to the connection of a read request before its transfer starts
+func serveUnix(t *testing.T, l *Conn, n int, files map[string][]byte, stray *net.UnixConn) {
+	buf := make([]byte, 516)
+	for i := 0; i < n; i++ {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.SetReadDeadline(5 * time.Second)
+		req := conn.Request()
+		switch req.Opcode {
+		case Rrq:
+			b, _ := Unmarshal(NewAck(1))
+			if _, err := stray.WriteTo(b, conn.Addr()); err != nil {
+				t.Error(err)
+			}
+			data := files[req.Filename]
+			for block := uint16(1); ; block++ {
+				chunk := data
+				if len(chunk) > 512 {
+					chunk = chunk[:512]
+				}
+				data = data[len(chunk):]
+				p, _ := NewData(block, chunk)
+				if _, err := conn.WritePacket(p); err != nil {
+					t.Error(err)
+					break
+				}
+				if ack, err := conn.ReadPacket(buf); err != nil {
+					t.Errorf("no ack for block %d: %v", block, err)
+					break
+				} else if a, ok := ack.(*AckPacket); !ok || a.BlockNumber != block {
+					t.Errorf("got %s, want the ack of block %d", Describe(ack), block)
+					break
+				}
+				if len(chunk) < 512 {
+					break
+				}
+			}
+		case Wrq:
+			var got []byte
+			for block := uint16(0); ; block++ {
+				if err := conn.WriteAck(block); err != nil {
+					t.Error(err)
+					break
+				}
+				if block > 0 && len(got) < int(block)*512 {
+					break
+				}
+				p, err := conn.ReadPacket(buf)
+				if err != nil {
+					t.Errorf("no block %d: %v", block+1, err)
+					break
+				}
+				d, ok := p.(*DataPacket)
+				if !ok || d.BlockNumber != block+1 {
+					t.Errorf("got %s, want block %d", Describe(p), block+1)
+					break
+				}
+				got = append(got, d.Data...)
+			}
+			files[req.Filename] = got
+		}
+		conn.Close()
+	}
+}
+
+func TestUnixgramTransfer(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix datagram sockets on windows")
+	}
+	dir := t.TempDir()
+	l, err := Listen("unixgram", filepath.Join(dir, "server"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stray, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, "stray"), Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stray.Close()
+
+	want := make([]byte, 1300)
+	for i := range want {
+		want[i] = byte(i * 7)
+	}
+	files := map[string][]byte{"file": want}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serveUnix(t, l, 2, files, stray)
+	}()
+
+	c, err := DialFrom("unixgram", filepath.Join(dir, "client"), filepath.Join(dir, "server"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := c.Get("file", &buf); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("got %d bytes that differ from the %d of the file", buf.Len(), len(want))
+	}
+	if _, err := c.Put("upload", bytes.NewReader(want[:1024])); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	c.Close()
+	<-done
+	if !bytes.Equal(files["upload"], want[:1024]) {
+		t.Fatalf("uploaded %d bytes that differ from the %d sent", len(files["upload"]), 1024)
+	}
+
+	// the stray packet was answered as one of an unknown transfer
+	b := make([]byte, 516)
+	stray.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := stray.Read(b)
+	if err != nil {
+		t.Fatalf("stray packet not answered: %v", err)
+	}
+	if p, err := Marshal(b[:n]); err != nil {
+		t.Fatal(err)
+	} else if e, ok := p.(*ErrorPacket); !ok || e.ErrorCode != UnknownTID {
+		t.Fatalf("stray packet answered with %s, want an unknown TID error", Describe(p))
+	}
+
+	// the sockets of the transfers are removed when they are closed, the
+	// one of the listener with it
+	l.Close()
+	if names, _ := os.ReadDir(dir); len(names) != 1 || names[0].Name() != "stray" {
+		t.Fatalf("sockets left behind: %v", names)
+	}
+
+	// a client dialed without a path gets a socket in the temporary
+	// directory
+	c, err = Dial("unixgram", filepath.Join(dir, "server"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := c.Addr().String()
+	if filepath.Dir(name) != filepath.Clean(os.TempDir()) {
+		t.Errorf("client socket bound at %s, want it in %s", name, os.TempDir())
+	}
+	c.Close()
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("client socket %s left behind", name)
+	}
+}